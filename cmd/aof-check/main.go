@@ -0,0 +1,89 @@
+// aof-check 检查AOF文件是否完整, 加上 --fix 时把文件截到最后一条完整的命令
+//
+//	aof-check [--fix] <file.aof>
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"redis.simple/lib/aof"
+	"strings"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate the file to the last valid command")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--fix] <file.aof>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	size := info.Size()
+	count, checkErr := check(file)
+	_ = file.Close()
+
+	if checkErr == nil {
+		fmt.Printf("AOF analyzed: size=%d, commands=%d\n", size, count)
+		fmt.Println("AOF is valid")
+		return
+	}
+	validUpTo := checkErr.Offset
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", size, validUpTo, size-validUpTo)
+	fmt.Printf("0x%08x: %v\n", validUpTo, checkErr.Err)
+	if !*fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		os.Exit(1)
+	}
+
+	fmt.Printf("This will shrink the AOF from %d bytes, with %d bytes, to %d bytes\n", size, size-validUpTo, validUpTo)
+	fmt.Print("Continue? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Println("Aborting...")
+		os.Exit(1)
+	}
+	if err := os.Truncate(filename, validUpTo); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to truncate AOF:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Successfully truncated AOF")
+}
+
+// 读完整个文件, 返回完整命令的条数
+// 和加载时一样按ReadBlock读, 文件在事务中间结束时整个事务都不算, 截掉之后不会留下没有EXEC的MULTI
+func check(r io.Reader) (int, *aof.Error) {
+	reader := aof.NewReader(r)
+	count := 0
+	for {
+		offset := reader.Offset()
+		block, err := reader.ReadBlock()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			if aofErr, ok := err.(*aof.Error); ok {
+				return count, aofErr
+			}
+			return count, &aof.Error{Offset: offset, Err: err}
+		}
+		count += len(block)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func encode(args ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+func TestCheckValid(t *testing.T) {
+	data := bytes.Join([][]byte{encode("SET", "a", "1"), encode("MULTI"), encode("INCR", "b"), encode("EXEC")}, nil)
+	count, err := check(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 commands, got %d", count)
+	}
+}
+
+// --fix 截到check报告的位置, 事务中间的命令被截断时不能留下没有EXEC的MULTI
+func TestCheckFixTruncatedTx(t *testing.T) {
+	head := encode("SET", "a", "1")
+	last := encode("SET", "c", "3")
+	data := bytes.Join([][]byte{head, encode("MULTI"), encode("SET", "b", "2"), last[:len(last)/2]}, nil)
+	_, checkErr := check(bytes.NewReader(data))
+	if checkErr == nil {
+		t.Fatal("expected an error")
+	}
+	if checkErr.Offset != int64(len(head)) {
+		t.Fatalf("expected offset %d (MULTI), got %d", len(head), checkErr.Offset)
+	}
+
+	fixed := data[:checkErr.Offset]
+	count, checkErr := check(bytes.NewReader(fixed))
+	if checkErr != nil {
+		t.Fatalf("fixed file is still invalid: %v", checkErr)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 command after fix, got %d", count)
+	}
+}
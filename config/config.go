@@ -0,0 +1,175 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"redis.simple/lib/logger"
+	"strconv"
+	"strings"
+)
+
+// 配置项, 字段通过 cfg tag 和配置文件里的名字对应
+// 配置文件的格式和redis.conf一样, 每行一个 "名字 值"
+type ServerProperties struct {
+	Bind           string `cfg:"bind"`
+	Port           int    `cfg:"port"`
+	AppendOnly     bool   `cfg:"appendonly"`
+	AppendFilename string `cfg:"appendfilename"`
+	// AOF什么时候fsync: always 每次写入之后, everysec 后台每秒一次, no 交给操作系统
+	AppendFsync string `cfg:"appendfsync"`
+	// AOF文件比上一次重写之后的大小增长了多少百分比时自动重写, 0表示不自动重写
+	AutoAofRewritePercentage int `cfg:"auto-aof-rewrite-percentage"`
+	// 自动重写时AOF文件最小的大小, 可以带单位(比如64mb)
+	AutoAofRewriteMinSize int64 `cfg:"auto-aof-rewrite-min-size"`
+	// 启动时AOF文件末尾不完整(比如写到一半宕机)时, 截掉不完整的部分继续启动, 否则拒绝启动
+	AofLoadTruncated bool `cfg:"aof-load-truncated"`
+	// 数据库的个数
+	Databases int `cfg:"databases"`
+	// 后台定时任务(主动过期等)每秒执行的次数
+	Hz int `cfg:"hz"`
+	// 客户端空闲多少秒之后断开, 0表示不断开
+	Timeout int `cfg:"timeout"`
+
+	// 内存上限, 可以带单位(比如100mb), 0表示没有上限
+	MaxMemory int64 `cfg:"maxmemory"`
+	// 超过上限时的淘汰策略, 和redis的名字一样
+	MaxMemoryPolicy string `cfg:"maxmemory-policy"`
+	// 淘汰时每个数据库抽样的key的个数
+	MaxMemorySamples int `cfg:"maxmemory-samples"`
+	// LFU计数器的增长速度, 越大增长越慢
+	LfuLogFactor int `cfg:"lfu-log-factor"`
+	// LFU计数器每隔多少分钟减一
+	LfuDecayTime int `cfg:"lfu-decay-time"`
+
+	Peers []string `cfg:"peers"`
+	Self  string   `cfg:"self"`
+}
+
+var Properties *ServerProperties
+
+func init() {
+	// 没有配置文件时的默认值
+	Properties = &ServerProperties{
+		Bind:           "127.0.0.1",
+		Port:           6379,
+		AppendOnly:     false,
+		AppendFilename: "appendonly.aof",
+		AppendFsync:    "everysec",
+		Databases:      16,
+		Hz:             10,
+
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    64 << 20,
+		AofLoadTruncated:         true,
+
+		MaxMemoryPolicy:  "noeviction",
+		MaxMemorySamples: 5,
+		LfuLogFactor:     10,
+		LfuDecayTime:     1,
+	}
+}
+
+func parse(src io.Reader) *ServerProperties {
+	config := *Properties
+
+	// 读取配置文件
+	rawMap := make(map[string]string)
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pivot := strings.IndexAny(line, " \t")
+		if pivot > 0 && pivot < len(line)-1 {
+			key := strings.ToLower(line[0:pivot])
+			value := strings.TrimSpace(line[pivot+1:])
+			rawMap[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Fatal(err)
+	}
+
+	// 按 cfg tag 填充字段
+	t := reflect.TypeOf(&config).Elem()
+	v := reflect.ValueOf(&config).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, ok := field.Tag.Lookup("cfg")
+		if !ok {
+			key = field.Name
+		}
+		value, ok := rawMap[strings.ToLower(key)]
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			v.Field(i).SetString(value)
+		case reflect.Int:
+			intValue, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				v.Field(i).SetInt(intValue)
+			}
+		case reflect.Int64:
+			// int64 的字段是内存大小
+			size, err := parseMemory(value)
+			if err == nil {
+				v.Field(i).SetInt(size)
+			}
+		case reflect.Bool:
+			v.Field(i).SetBool(value == "yes" || value == "true")
+		case reflect.Slice:
+			if field.Type.Elem().Kind() == reflect.String {
+				slice := strings.Split(value, ",")
+				v.Field(i).Set(reflect.ValueOf(slice))
+			}
+		}
+	}
+	return &config
+}
+
+// 和redis.conf一样, 1k是1000, 1kb是1024, 不区分大小写
+var memoryUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1000,
+	"kb": 1024,
+	"m":  1000 * 1000,
+	"mb": 1024 * 1024,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1024 * 1024 * 1024,
+}
+
+func parseMemory(value string) (int64, error) {
+	value = strings.ToLower(value)
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if i < 0 {
+		i = len(value)
+	}
+	unit, ok := memoryUnits[value[i:]]
+	if !ok {
+		return 0, fmt.Errorf("invalid memory unit: %s", value)
+	}
+	size, err := strconv.ParseInt(value[:i], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * unit, nil
+}
+
+// 读取配置文件, 在MakeMultiDB之前调用
+func SetupConfig(configFilename string) {
+	file, err := os.Open(configFilename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	Properties = parse(file)
+}
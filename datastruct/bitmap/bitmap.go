@@ -0,0 +1,102 @@
+package bitmap
+
+// 和redis一样bitmap就是字符串, 只是按bit来操作
+// 第0个bit是第0个字节的最高位, 所以 SETBIT key 7 1 之后 GET key 得到 "\x01"
+// 需要写入时自动扩容, 新的字节都是0
+type BitMap []byte
+
+func toByteSize(bitSize int64) int64 {
+	return (bitSize + 7) / 8
+}
+
+func (b *BitMap) grow(bitSize int64) {
+	byteSize := toByteSize(bitSize)
+	if gap := byteSize - int64(len(*b)); gap > 0 {
+		*b = append(*b, make([]byte, gap)...)
+	}
+}
+
+// 超出长度的bit都是0
+func (b BitMap) GetBit(offset int64) byte {
+	byteIndex := offset / 8
+	if byteIndex >= int64(len(b)) {
+		return 0
+	}
+	return (b[byteIndex] >> (7 - uint(offset%8))) & 1
+}
+
+// 返回原来的值
+func (b *BitMap) SetBit(offset int64, val byte) byte {
+	b.grow(offset + 1)
+	old := b.GetBit(offset)
+	mask := byte(1) << (7 - uint(offset%8))
+	if val == 0 {
+		(*b)[offset/8] &^= mask
+	} else {
+		(*b)[offset/8] |= mask
+	}
+	return old
+}
+
+// 统计 [start, end] 之间(按bit, 都包含)为1的个数
+func (b BitMap) BitCount(start int64, end int64) int64 {
+	var count int64
+	for offset := start; offset <= end; {
+		// 整个字节都在范围内时按字节算
+		if offset%8 == 0 && offset+7 <= end {
+			count += int64(popCount[b[offset/8]])
+			offset += 8
+			continue
+		}
+		count += int64(b.GetBit(offset))
+		offset++
+	}
+	return count
+}
+
+// 在 [start, end] 之间找第一个值为bit的位置, 没有找到返回-1
+func (b BitMap) BitPos(bit byte, start int64, end int64) int64 {
+	// 整个字节都不可能包含bit时跳过
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for offset := start; offset <= end; {
+		if offset%8 == 0 && offset+7 <= end && b[offset/8] == skip {
+			offset += 8
+			continue
+		}
+		if b.GetBit(offset) == bit {
+			return offset
+		}
+		offset++
+	}
+	return -1
+}
+
+// 读取从offset开始width个bit(最多64个), 高位在前, 超出长度的部分是0
+func (b BitMap) GetBits(offset int64, width uint) uint64 {
+	var val uint64
+	for i := uint(0); i < width; i++ {
+		val = val<<1 | uint64(b.GetBit(offset+int64(i)))
+	}
+	return val
+}
+
+// 把val的低width位写到offset开始的位置, 高位在前
+func (b *BitMap) SetBits(offset int64, width uint, val uint64) {
+	b.grow(offset + int64(width))
+	for i := uint(0); i < width; i++ {
+		bit := byte(val>>(width-1-i)) & 1
+		b.SetBit(offset+int64(i), bit)
+	}
+}
+
+// 每个字节里1的个数
+var popCount = func() [256]uint8 {
+	var table [256]uint8
+	for i := range table {
+		table[i] = table[i/2] + uint8(i&1)
+	}
+	return table
+}()
@@ -79,15 +79,15 @@ func fnv32(key string) uint32 {
 }
 
 // 定位shard的index, 第一次hashcode的对应
-// 其实hash % n 就是 hash ^ (n - 1)
+// 其实hash % n 就是 hash & (n - 1)
 func (dict *ConcurrentDict)spread(hashCode uint32) uint32 {
 	if dict == nil {
 		panic("dict is nil")
 	}
 	//tableSize 是2的幂次，
-	//所以hashCode^(tableSize-1)即可得到index
+	//所以hashCode&(tableSize-1)即可得到index
 	tableSize := len(dict.table)
-	return uint32(tableSize - 1) ^ uint32(hashCode)
+	return uint32(tableSize - 1) & uint32(hashCode)
 }
 
 // 根据上一个函数的index取Shard
@@ -110,8 +110,12 @@ func (dict *ConcurrentDict)Get(key string) (val interface{}, exists bool) {
 	// 锁住
 	shard.mutex.RLock()
 	defer shard.mutex.RUnlock()
-	val, exists = shard.m[key]
-	return
+	value, exists := shard.m[key]
+	if !exists {
+		return nil, false
+	}
+	// 存的是带类型的Value, 取出来的是原本的val
+	return value.val, true
 }
 
 
@@ -154,7 +158,7 @@ func (dict *ConcurrentDict)addCount(count int) {
 	if dict == nil {
 		panic("dict is nil")
 	}
-	atomic.AddInt32(&dict.count, 1)
+	atomic.AddInt32(&dict.count, int32(count))
 }
 
 func (dict *ConcurrentDict)PutIfExists(key string, val interface{}, types uint8) (result int) {
@@ -215,6 +219,7 @@ func (dict *ConcurrentDict)Remove(key string) (result int) {
 
 	if _, ok := shard.m[key]; ok {
 		delete(shard.m, key)
+		dict.addCount(-1)
 		return 1
 	} else {
 		return 0
@@ -229,14 +234,15 @@ func (dict *ConcurrentDict)ForEach(consumer Consumer) {
 	}
 
 	for _, shard := range dict.table {
-		for key, val := range shard.m {
-			shard.mutex.RLock()
-			ifContinue := consumer(key, val)
-			defer shard.mutex.RUnlock()
-			if !ifContinue{
+		// 每个shard单独加锁, 不能在循环里defer, 否则要等到函数返回才解锁
+		shard.mutex.RLock()
+		for key, value := range shard.m {
+			if !consumer(key, value.val) {
+				shard.mutex.RUnlock()
 				return
 			}
 		}
+		shard.mutex.RUnlock()
 	}
 }
 
@@ -245,7 +251,7 @@ func (dict *ConcurrentDict)ForEach(consumer Consumer) {
 func (dict *ConcurrentDict)Keys() []string {
 	keys := make([]string, dict.Len())
 	i := 0
-	dict.Foreach(func(key string, val interface{}) bool {
+	dict.ForEach(func(key string, val interface{}) bool {
 		if i < len(keys) {
 			keys[i] = key
 			i++
@@ -258,7 +264,8 @@ func (dict *ConcurrentDict)Keys() []string {
 }
 
 
-func (shard *Shard) RandomKey() string {
+// 空字符串也是合法的key, 所以用ok表示shard是否为空
+func (shard *Shard) RandomKey() (string, bool) {
 	if shard == nil {
 		panic("shard is nil")
 	}
@@ -266,15 +273,15 @@ func (shard *Shard) RandomKey() string {
 	defer shard.mutex.RUnlock()
 
 	for key := range shard.m {
-		return key
+		return key, true
 	}
-	return ""
+	return "", false
 }
 
+// 随机取limit个key, 可能重复(HRANDFIELD负数count就是这个语义)
 func (dict *ConcurrentDict) RandomKeys(limit int) []string {
-	size := dict.Len()
-	if limit >= size {
-		return dict.Keys()
+	if dict.Len() == 0 {
+		return []string{}
 	}
 	shardCount := len(dict.table)
 
@@ -284,10 +291,13 @@ func (dict *ConcurrentDict) RandomKeys(limit int) []string {
 		if shard == nil {
 			continue
 		}
-		key := shard.RandomKey()
-		if key != "" {
+		key, ok := shard.RandomKey()
+		if ok {
 			result[i] = key
 			i++
+		} else if dict.Len() == 0 {
+			// 取的过程中被其他协程删空了(比如主动过期), 不然会一直循环下去
+			return result[:i]
 		}
 	}
 	return result
@@ -307,8 +317,8 @@ func (dict *ConcurrentDict) RandomDistinctKeys(limit int) []string {
 		if shard == nil {
 			continue
 		}
-		key := shard.RandomKey()
-		if key != "" {
+		key, ok := shard.RandomKey()
+		if ok {
 			result[key] = true
 		}
 	}
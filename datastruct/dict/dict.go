@@ -2,6 +2,9 @@ package dict
 
 type Consumer func(key string, val interface{})bool
 
+// Scan 每返回一个key调用一次
+type ScanConsumer func(key string, val interface{})
+
 // 这里的Dict是整个的Dict也就是最大的存储结构
 // 所以只有对key的操作(当然dict类型的操作也是可以的)
 // 取到Value后使用什么方法是类型具体的
@@ -16,6 +19,9 @@ type Dict interface {
 	Keys() []string
 	RandomKeys(limit int) []string
 	RandomDistinctKeys(limit int) []string
+	// 从cursor开始返回大约count个key, 返回下一次的cursor, 为0时表示结束
+	// 从头到尾一直存在的key至少会返回一次
+	Scan(cursor uint64, count int, consumer ScanConsumer) uint64
 }
 
 
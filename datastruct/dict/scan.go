@@ -0,0 +1,105 @@
+package dict
+
+import "sort"
+
+/*
+	cursor 的高32位是shard的下标, 低32位是shard里下一个要返回的key的hash值
+	shard里的key按hash值排序, 每次从cursor记录的hash值往后取, 所以中间有增删也不会漏掉一直存在的key
+	同一个hash值的key总是在一次里全部返回, 这样cursor只需要记hash值
+	SimpleDict 只有一个"shard", cursor就是hash值
+ */
+
+type scanEntry struct {
+	key  string
+	hash uint32
+	val  interface{}
+}
+
+func sortScanEntries(entries []scanEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].hash != entries[j].hash {
+			return entries[i].hash < entries[j].hash
+		}
+		return entries[i].key < entries[j].key
+	})
+}
+
+// 从排好序的entries里取至少count个(同一个hash值的不分开)交给consumer
+// 返回取了几个, 还有剩余时 more 为true, next 是剩下的第一个hash值
+func takeScanBatch(entries []scanEntry, count int, consumer ScanConsumer) (taken int, next uint32, more bool) {
+	i := 0
+	for ; i < len(entries); i++ {
+		if i >= count && entries[i].hash != entries[i-1].hash {
+			break
+		}
+		consumer(entries[i].key, entries[i].val)
+	}
+	if i < len(entries) {
+		return i, entries[i].hash, true
+	}
+	return i, 0, false
+}
+
+func (shard *Shard) scanEntries(start uint32) []scanEntry {
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	entries := make([]scanEntry, 0, len(shard.m))
+	for key, value := range shard.m {
+		if hash := fnv32(key); hash >= start {
+			entries = append(entries, scanEntry{key: key, hash: hash, val: value.val})
+		}
+	}
+	sortScanEntries(entries)
+	return entries
+}
+
+// 和redis一样, 连续遇到太多空的shard也提前返回, 避免一次调用扫完整个表
+const scanEmptyVisitsFactor = 10
+
+func (dict *ConcurrentDict) Scan(cursor uint64, count int, consumer ScanConsumer) uint64 {
+	shardCount := uint64(len(dict.table))
+	shardIndex := cursor >> 32
+	start := uint32(cursor)
+	returned := 0
+	emptyVisits := 0
+	for shardIndex < shardCount {
+		entries := dict.table[shardIndex].scanEntries(start)
+		if len(entries) == 0 {
+			emptyVisits++
+		}
+		taken, next, more := takeScanBatch(entries, count-returned, consumer)
+		returned += taken
+		if more {
+			// 在shard中间停下; shard 0 里的next一定大于0, 不会和结束混淆
+			return shardIndex<<32 | uint64(next)
+		}
+		shardIndex++
+		start = 0
+		if returned >= count || emptyVisits >= count*scanEmptyVisitsFactor {
+			break
+		}
+	}
+	if shardIndex >= shardCount {
+		return 0
+	}
+	return shardIndex << 32
+}
+
+func (dict *SimpleDict) Scan(cursor uint64, count int, consumer ScanConsumer) uint64 {
+	if cursor >= 1<<32 {
+		return 0
+	}
+	start := uint32(cursor)
+	entries := make([]scanEntry, 0, len(dict.m))
+	for key, val := range dict.m {
+		if hash := fnv32(key); hash >= start {
+			entries = append(entries, scanEntry{key: key, hash: hash, val: val})
+		}
+	}
+	sortScanEntries(entries)
+	_, next, more := takeScanBatch(entries, count, consumer)
+	if more {
+		return uint64(next)
+	}
+	return 0
+}
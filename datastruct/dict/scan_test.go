@@ -0,0 +1,175 @@
+package dict
+
+import (
+	"strconv"
+	"testing"
+)
+
+// 从0开始一直scan到cursor为0, 返回每个key出现的次数
+// 每次调用之前执行 between, 用来在两次调用之间修改dict
+func scanAll(t *testing.T, d Dict, count int, between func(round int)) map[string]int {
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for round := 0; ; round++ {
+		if round > 1<<20 {
+			t.Fatal("scan doesn't terminate")
+		}
+		if between != nil {
+			between(round)
+		}
+		cursor = d.Scan(cursor, count, func(key string, val interface{}) {
+			seen[key]++
+		})
+		if cursor == 0 {
+			return seen
+		}
+	}
+}
+
+func makeDicts(n int) map[string]Dict {
+	dicts := map[string]Dict{
+		"concurrent": MakeConcurrent(16),
+		"simple":     MakeSimple(),
+	}
+	for _, d := range dicts {
+		for i := 0; i < n; i++ {
+			d.Put("key"+strconv.Itoa(i), i, STRING)
+		}
+	}
+	return dicts
+}
+
+func TestScanReturnsAllKeys(t *testing.T) {
+	const n = 1000
+	for _, count := range []int{1, 3, 10, 100, 2000} {
+		for name, d := range makeDicts(n) {
+			seen := scanAll(t, d, count, nil)
+			if len(seen) != n {
+				t.Errorf("%s count=%d: expected %d keys, got %d", name, count, n, len(seen))
+			}
+			for i := 0; i < n; i++ {
+				if seen["key"+strconv.Itoa(i)] == 0 {
+					t.Errorf("%s count=%d: key%d is missing", name, count, i)
+				}
+			}
+		}
+	}
+}
+
+func TestScanEmpty(t *testing.T) {
+	for name, d := range makeDicts(0) {
+		called := false
+		cursor := uint64(0)
+		for {
+			cursor = d.Scan(cursor, 10, func(key string, val interface{}) {
+				called = true
+			})
+			if cursor == 0 {
+				break
+			}
+		}
+		if called {
+			t.Errorf("%s: empty dict returned a key", name)
+		}
+	}
+}
+
+// 中间有增删时, 从头到尾一直存在的key至少返回一次
+func TestScanWithConcurrentChanges(t *testing.T) {
+	const n = 500
+	for name, d := range makeDicts(n) {
+		d := d
+		seen := scanAll(t, d, 7, func(round int) {
+			d.Put("new"+strconv.Itoa(round), round, STRING)
+			// 删掉后一半的key, 前一半一直存在
+			if round < n/2 {
+				d.Remove("key" + strconv.Itoa(n/2+round))
+			}
+		})
+		for i := 0; i < n/2; i++ {
+			if seen["key"+strconv.Itoa(i)] == 0 {
+				t.Errorf("%s: key%d is missing", name, i)
+			}
+		}
+	}
+}
+
+// 只有一个key的时候, 连续遇到空shard会提前返回, 但继续scan还是能找到它
+func TestScanSparse(t *testing.T) {
+	d := MakeConcurrent(1 << 10)
+	d.Put("only", 1, STRING)
+	seen := scanAll(t, d, 1, nil)
+	if seen["only"] != 1 {
+		t.Errorf("expected the key once, got %d", seen["only"])
+	}
+}
+
+// cursor 高32位是shard的下标, 低32位是shard里下一个hash值
+func TestConcurrentScanCursor(t *testing.T) {
+	d := MakeConcurrent(16)
+	for i := 0; i < 1000; i++ {
+		d.Put("key"+strconv.Itoa(i), i, STRING)
+	}
+	shardCount := uint64(len(d.table))
+	cursor := uint64(0)
+	lastShard := uint64(0)
+	for {
+		var keys []string
+		cursor = d.Scan(cursor, 5, func(key string, val interface{}) {
+			keys = append(keys, key)
+		})
+		if cursor == 0 {
+			break
+		}
+		shardIndex := cursor >> 32
+		if shardIndex >= shardCount {
+			t.Fatalf("shard index %d out of range", shardIndex)
+		}
+		if shardIndex < lastShard {
+			t.Fatalf("cursor went back from shard %d to %d", lastShard, shardIndex)
+		}
+		lastShard = shardIndex
+		// 返回的key都在cursor之前
+		for _, key := range keys {
+			index := uint64(d.spread(fnv32(key)))
+			if index > shardIndex || index == shardIndex && fnv32(key) >= uint32(cursor) {
+				t.Fatalf("key %s (shard %d, hash %d) is after cursor %x", key, index, fnv32(key), cursor)
+			}
+		}
+	}
+	// 超出范围的cursor直接结束
+	if next := d.Scan(shardCount<<32, 10, func(key string, val interface{}) {}); next != 0 {
+		t.Errorf("expected 0 for an out of range cursor, got %x", next)
+	}
+	if next := MakeSimple().Scan(1<<32, 10, func(key string, val interface{}) {}); next != 0 {
+		t.Errorf("expected 0 for an out of range cursor, got %x", next)
+	}
+}
+
+// 同一个hash值的key总是一起返回, 即使超过了count
+func TestTakeScanBatch(t *testing.T) {
+	entries := []scanEntry{
+		{key: "a", hash: 1},
+		{key: "b", hash: 5},
+		{key: "c", hash: 5},
+		{key: "d", hash: 5},
+		{key: "e", hash: 9},
+	}
+	var keys []string
+	consumer := func(key string, val interface{}) {
+		keys = append(keys, key)
+	}
+	taken, next, more := takeScanBatch(entries, 2, consumer)
+	if taken != 4 || next != 9 || !more {
+		t.Errorf("expected (4, 9, true), got (%d, %d, %v)", taken, next, more)
+	}
+	if len(keys) != 4 || keys[3] != "d" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	keys = nil
+	taken, next, more = takeScanBatch(entries, 10, consumer)
+	if taken != 5 || next != 0 || more {
+		t.Errorf("expected (5, 0, false), got (%d, %d, %v)", taken, next, more)
+	}
+}
@@ -22,7 +22,9 @@ func (dict *SimpleDict) Len() int {
 	return len(dict.m)
 }
 
-func (dict *SimpleDict) Put(key string, val interface{}) (result int) {
+// SimpleDict 没有加锁, 用于hash这类嵌套在key里的小结构, 由key的锁保护
+// types 只是为了实现Dict接口, 这里用不到
+func (dict *SimpleDict) Put(key string, val interface{}, types uint8) (result int) {
 	_, existed := dict.m[key]
 	dict.m[key] = val
 	if existed {
@@ -32,7 +34,7 @@ func (dict *SimpleDict) Put(key string, val interface{}) (result int) {
 	}
 }
 
-func (dict *SimpleDict) PutIfAbsent(key string, val interface{}) (result int) {
+func (dict *SimpleDict) PutIfAbsent(key string, val interface{}, types uint8) (result int) {
 	_, existed := dict.m[key]
 	if existed {
 		return 0
@@ -42,7 +44,7 @@ func (dict *SimpleDict) PutIfAbsent(key string, val interface{}) (result int) {
 	}
 }
 
-func (dict *SimpleDict) PutIfExists(key string, val interface{}) (result int) {
+func (dict *SimpleDict) PutIfExists(key string, val interface{}, types uint8) (result int) {
 	_, existed := dict.m[key]
 	if existed {
 		dict.m[key] = val
@@ -67,6 +69,7 @@ func (dict *SimpleDict) Keys() []string {
 	i := 0
 	for k := range dict.m {
 		result[i] = k
+		i++
 	}
 	return result
 }
@@ -79,7 +82,11 @@ func (dict *SimpleDict) ForEach(consumer Consumer) {
 	}
 }
 
+// 可能重复, 每次range的起点是随机的
 func (dict *SimpleDict) RandomKeys(limit int) []string {
+	if len(dict.m) == 0 {
+		return []string{}
+	}
 	result := make([]string, limit)
 	for i := 0; i < limit; i++ {
 		for k := range dict.m {
@@ -2,7 +2,6 @@ package list
 
 import (
 	"bytes"
-	"reflect"
 )
 
 type LinkedList struct {
@@ -83,18 +82,12 @@ func (list *LinkedList)Lpop() interface{} {
 	if list == nil {
 		panic("list is nil")
 	}
-	var val interface{}
-	if list.first != nil {
-		val = list.first.val
-		if list.last == list.first {
-			list.first, list.last = nil, nil
-		} else {
-			list.first = list.first.next
-		}
-	} else {
-		val = nil
+	n := list.first
+	if n == nil {
+		return nil
 	}
-	return val
+	list.removeNode(n)
+	return n.val
 }
 
 // 返回pop的element
@@ -102,49 +95,62 @@ func (list *LinkedList)Rpop() interface{} {
 	if list == nil {
 		panic("list is nil")
 	}
-	var val interface{}
-	if list.last != nil {
-		val = list.first.val
-		if list.last == list.first {
-			list.first, list.last = nil, nil
-		} else {
-			list.last = list.last.prev
-		}
+	n := list.last
+	if n == nil {
+		return nil
+	}
+	list.removeNode(n)
+	return n.val
+}
+
+// 把节点从链表中摘下来, 维护first, last和size
+func (list *LinkedList)removeNode(n *node) {
+	if n.prev == nil {
+		list.first = n.next
 	} else {
-		val = nil
+		n.prev.next = n.next
 	}
-	return val
+	if n.next == nil {
+		list.last = n.prev
+	} else {
+		n.next.prev = n.prev
+	}
+	n.prev = nil
+	n.next = nil
+	list.size--
 }
 
-// return key and element poped
-// 这里只返回pop的element
-// 这里的的逻辑应该从DB层面写, 这里只做最底层的操作
-// 无逻辑限制
-//func (list *LinkedList)blpop(timeout int, client redis.Client) interface{} {
-//	//c := time.NewTicker(time.Duration(timeout))
-//	//select {
-//	//case <-c.C:
-//	//	return nil
-//	//case client.block
-//	//}
-//	return nil
-//}
+// 阻塞的pop(BLPOP等)要等待client, 是DB层面的逻辑, 见 db/blocking.go
+// 这里只做最底层的操作
 
-func (list *LinkedList)Brpop() interface{} {
-	return nil
+// 按下标找节点, index 由调用者保证在 [0, size) 之内
+// 从离得近的一端开始找
+func (list *LinkedList)find(index int) *node {
+	if index < list.size / 2 {
+		n := list.first
+		for i := 0;i < index;i++ {
+			n = n.next
+		}
+		return n
+	} else {
+		n := list.last
+		for i:=list.size-1;i>index;i-- {
+			n = n.prev
+		}
+		return n
+	}
 }
 
-// 这里要注意验证位置的合理(在DB层面再写验证逻辑，然后调用这里)
+// 返回 [start, stop] 之间的元素, 两端都包含
+// 这里要注意验证位置的合理(在DB层面把负数下标等转换好, 保证 0 <= start <= stop < size)
 func (list *LinkedList)Lrange(start int, stop int) []interface{} {
-	if list.size == 0 {
+	if list.size == 0 || start > stop {
 		return nil
 	}
-	res := make([]interface{}, list.size)
-	i := 0
-	n := list.first
-	for n != nil {
+	res := make([]interface{}, stop - start + 1)
+	n := list.find(start)
+	for i := 0; i < len(res); i++ {
 		res[i] = n.val
-		i++
 		n = n.next
 	}
 	return res
@@ -156,6 +162,7 @@ func (list *LinkedList)Llen() int {
 }
 
 // 返回移除个数
+// 和redis一样: count > 0 从头开始删count个, count < 0 从尾开始删-count个, count == 0 全部删除
 // 大的类型比如list,set这些是在DB层面验证，例如list内部的类型比较在函数内完成
 // 数据都直接按照[]byte存储就好
 func (list *LinkedList)Lrem(count int, val interface{}) int {
@@ -163,100 +170,125 @@ func (list *LinkedList)Lrem(count int, val interface{}) int {
 		return 0
 	}
 	// 值相等的全部删除(将count设置的大一些)
-	if count == -1 {
-		count = list.size
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit == 0 {
+		limit = list.size
 	}
 	relCount := 0
-	n := list.first
-	for n != nil {
-		if relCount >= count {
-			return relCount
+	if count >= 0 {
+		n := list.first
+		for n != nil && relCount < limit {
+			next := n.next // 先记下next, 删除之后就找不到了
+			if equals(n.val, val) {
+				list.removeNode(n)
+				relCount++
+			}
+			n = next
 		}
-		if bytes.Compare(n.val.([]byte), val.([]byte)) == 0 {
-			n.prev.next = n.next
-			n.next.prev = n.prev
-			relCount++
+	} else {
+		n := list.last
+		for n != nil && relCount < limit {
+			prev := n.prev
+			if equals(n.val, val) {
+				list.removeNode(n)
+				relCount++
+			}
+			n = prev
 		}
-		n = n.next  // next就好
 	}
 	return relCount
 }
 
 // 没有返回nil
 func (list *LinkedList)Lindex(index int) interface{} {
-	if index < list.size / 2 {
-		n := list.first
-		for i := 0;i < index;i++ {
-			n = n.next
-		}
-		return n.val
-	} else {
-		n := list.last
-		for i:=list.size-1;i>index;i-- {
-			n = n.prev
-		}
-		return n.val
+	if index < 0 || index >= list.size {
+		return nil
 	}
+	return list.find(index).val
 }
 
-// 返回是否成功
+// 只保留 [start, stop] 之间的元素
+// DB保证 0 <= start <= stop < list.size, 否则DB层直接删掉整个list
 func (list *LinkedList)Ltrim(start, stop int) bool {
-	// assert 0 <= start < end < list.size
-	// DB保证的, 如果不是，那list就变为空
-	i := 0
-	n := list.first
-	for i < start {
-		n = n.next
-	}
-	list.first = n
-	n.prev = nil
-	for i := start; i< stop; i++ {
-		n = n.next
+	if start < 0 || stop >= list.size || start > stop {
+		return false
 	}
-	list.last = n
-	n.next = nil
+	first := list.find(start)
+	last := list.find(stop)
+	first.prev = nil
+	last.next = nil
+	list.first = first
+	list.last = last
+	list.size = stop - start + 1
 	return true
 }
 
 // 是否成功
 func (list *LinkedList)Lset(index int, val interface{}) bool {
 	// DB已保证index不超过范围(0, list.size-1)
-	n := list.first
-	for i := 0; i < index; i++ {
-		n = n.next
+	if index < 0 || index >= list.size {
+		return false
 	}
-	n.val = val
+	list.find(index).val = val
 	return true
 }
 
-// 返回个数
+// 在第一个等于pivot的元素前(后)插入val
+// 返回插入后的个数, 找不到pivot返回-1
 func (list *LinkedList)Linsert(isBefore bool, pivot interface{} , val interface{}) int {
 	n := list.first
 	for n != nil {
-		if n.val == pivot {
+		if equals(n.val, pivot) {
+			newNode := &node{
+				val: val,
+			}
 			if isBefore {
-				newNode := &node{
-					val: val,
-					prev: n.prev,
-					next: n,
+				newNode.prev = n.prev
+				newNode.next = n
+				if n.prev == nil {
+					list.first = newNode
+				} else {
+					n.prev.next = newNode
 				}
 				n.prev = newNode
 			} else {
-
+				newNode.prev = n
+				newNode.next = n.next
+				if n.next == nil {
+					list.last = newNode
+				} else {
+					n.next.prev = newNode
+				}
+				n.next = newNode
 			}
+			list.size++
+			return list.size
 		}
+		n = n.next
 	}
-	return 0 // count
+	return -1
 }
 
+// []byte 按内容比较, 其他的(比如client指针)直接比较
+func equals(a interface{}, b interface{}) bool {
+	aBytes, aOk := a.([]byte)
+	bBytes, bOk := b.([]byte)
+	if aOk && bOk {
+		return bytes.Equal(aBytes, bBytes)
+	}
+	if aOk || bOk {
+		return false
+	}
+	return a == b
+}
 
 func (list *LinkedList)Contains(val interface{}) bool {
 	node := list.first
-	obj_types := reflect.TypeOf(val)
-	obj_value := reflect.ValueOf(val)
 	for node != nil {
-		if reflect.TypeOf(node.val) == obj_types &&
-			reflect.ValueOf(node.val) == obj_value{
+		if equals(node.val, val) {
 			return true
 		}
 		node = node.next
@@ -264,16 +296,32 @@ func (list *LinkedList)Contains(val interface{}) bool {
 	return false
 }
 
+// F 返回false时停止遍历
 func (list *LinkedList)Foreach(F func(i int, c interface{}) bool) {
 	j := 0
 	node := list.first
 	for node != nil {
-		F(j, node.val)
+		if !F(j, node.val) {
+			return
+		}
 		node = node.next
 		j++
 	}
 }
 
+// 从尾部开始遍历, i 仍然是从头开始的下标
+func (list *LinkedList)ReverseForeach(F func(i int, c interface{}) bool) {
+	j := list.size - 1
+	node := list.last
+	for node != nil {
+		if !F(j, node.val) {
+			return
+		}
+		node = node.prev
+		j--
+	}
+}
+
 
 
 
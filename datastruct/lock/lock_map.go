@@ -133,6 +133,42 @@ func (locks *Locks)RUnLocks(keys ...string) {
 	}
 }
 
+// 同时加写锁和读锁, 用于事务: 写的key加写锁, 只读的key加读锁
+// 两类key落在同一个位置时加写锁, 分开调用Locks和RLocks的话同一个位置会锁两次
+func (locks *Locks)RWLocks(writeKeys []string, readKeys []string) {
+	keys := append(append([]string{}, writeKeys...), readKeys...)
+	indices := locks.toLockIndices(keys, false)
+	writeIndices := locks.writeIndexSet(writeKeys)
+	for _, index := range indices {
+		if writeIndices[index] {
+			locks.table[index].Lock()
+		} else {
+			locks.table[index].RLock()
+		}
+	}
+}
+
+func (locks *Locks)RWUnLocks(writeKeys []string, readKeys []string) {
+	keys := append(append([]string{}, writeKeys...), readKeys...)
+	indices := locks.toLockIndices(keys, true)
+	writeIndices := locks.writeIndexSet(writeKeys)
+	for _, index := range indices {
+		if writeIndices[index] {
+			locks.table[index].Unlock()
+		} else {
+			locks.table[index].RUnlock()
+		}
+	}
+}
+
+func (locks *Locks)writeIndexSet(writeKeys []string) map[uint32]bool {
+	set := make(map[uint32]bool, len(writeKeys))
+	for _, key := range writeKeys {
+		set[locks.spread(fnv32(key))] = true
+	}
+	return set
+}
+
 func GoID() int {
 	var buf [64]byte
 	n := runtime.Stack(buf[:], false)
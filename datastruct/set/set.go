@@ -53,7 +53,7 @@ func (set *Set)ToSlice() []string {
 	slice := make([]string, set.Len())
 	i := 0
 	set.dict.ForEach(func(key string, val interface{}) bool {
-		if i > len(slice) {
+		if i < len(slice) {
 			slice[i] = key
 		} else {
 			slice = append(slice, key)
@@ -145,4 +145,11 @@ func (set *Set)Move(dst *Set, val string) int {
 	}
 	// 说明不存在 只要source存在并成功删除就可以返回1
 	return 0
-}
\ No newline at end of file
+}
+
+// 用于 SSCAN 命令, cursor 的含义见 dict.Dict.Scan
+func (set *Set)Scan(cursor uint64, count int, consumer func(member string)) uint64 {
+	return set.dict.Scan(cursor, count, func(key string, val interface{}) {
+		consumer(key)
+	})
+}
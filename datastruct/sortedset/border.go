@@ -2,6 +2,7 @@ package sortedset
 
 import (
 	"errors"
+	"math"
 	"strconv"
 )
 
@@ -10,6 +11,7 @@ const (
 	positiveInf int8 = 1
 )
 
+// 无穷的边界也按Value(±Inf)比较, 和redis一样 -inf/+inf 包含score正好是无穷的member, 只有 (-inf/(+inf 不包含
 type ScoreBorder struct {
 	Inf int8		// 是否是无穷
 	Value float64	// 正常值
@@ -18,12 +20,6 @@ type ScoreBorder struct {
 
 
 func (border *ScoreBorder)greater(value float64) bool {
-	if border.Inf == negativeInf {
-		return false
-	}
-	if border.Inf == positiveInf {
-		return true
-	}
 	if border.Exclude {
 		return border.Value > value
 	} else {
@@ -32,12 +28,6 @@ func (border *ScoreBorder)greater(value float64) bool {
 }
 
 func (border *ScoreBorder)less(value float64) bool {
-	if border.Inf == negativeInf {
-		return true
-	}
-	if border.Inf == positiveInf {
-		return false
-	}
 	if border.Exclude {
 		return border.Value < value
 	} else {
@@ -47,13 +37,25 @@ func (border *ScoreBorder)less(value float64) bool {
 
 var positiveInfBorder = &ScoreBorder{
 	Inf: positiveInf,
+	Value: math.Inf(1),
+	Exclude: false,
 }
 
 var negativeInfBorder = &ScoreBorder{
-	Inf: positiveInf,
+	Inf: negativeInf,
+	Value: math.Inf(-1),
+	Exclude: false,
+}
+
+// min..max 是不是一个空区间, 比如 [10, 1] 或者 (3, 3], -inf -inf 不是空的
+func (border *ScoreBorder)isEmptyRange(max *ScoreBorder) bool {
+	return border.Value > max.Value || (border.Value == max.Value && (border.Exclude || max.Exclude))
 }
 
 func ParseScoreBorder(s string) (*ScoreBorder, error) {
+	if s == "" {
+		return nil, errors.New("ERR min or max is not a float")
+	}
 	if s == "inf" || s == "+inf" {
 		return positiveInfBorder, nil
 	}
@@ -62,7 +64,7 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 	}
 	if s[0] == '(' {
 		value, err := strconv.ParseFloat(s[1:], 64)
-		if err != nil {
+		if err != nil || math.IsNaN(value) {
 			return nil, errors.New("ERR min or max is not a float")
 		}
 		return &ScoreBorder{
@@ -72,7 +74,7 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 		}, nil
 	} else {
 		value, err := strconv.ParseFloat(s, 64)
-		if err != nil {
+		if err != nil || math.IsNaN(value) {
 			return nil, errors.New("ERR min or max is not a float")
 		}
 		return &ScoreBorder{
@@ -81,4 +83,85 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 			Exclude: false,
 		}, nil
 	}
-}
\ No newline at end of file
+}
+
+// 字典序的区间, 用于 ZRANGE BYLEX, 只有所有member的score相同时才有意义
+// "-" 和 "+" 表示负无穷和正无穷, "[a" 包含a, "(a" 不包含a
+type LexBorder struct {
+	Inf int8
+	Value string
+	Exclude bool
+}
+
+// 和ScoreBorder一样, greater表示value没有超过这个上界
+func (border *LexBorder)greater(value string) bool {
+	if border.Inf == negativeInf {
+		return false
+	}
+	if border.Inf == positiveInf {
+		return true
+	}
+	if border.Exclude {
+		return border.Value > value
+	} else {
+		return border.Value >= value
+	}
+}
+
+// less表示value没有低于这个下界
+func (border *LexBorder)less(value string) bool {
+	if border.Inf == negativeInf {
+		return true
+	}
+	if border.Inf == positiveInf {
+		return false
+	}
+	if border.Exclude {
+		return border.Value < value
+	} else {
+		return border.Value <= value
+	}
+}
+
+func (border *LexBorder)isEmptyRange(max *LexBorder) bool {
+	if border.Inf == positiveInf || max.Inf == negativeInf {
+		return true
+	}
+	if border.Inf == negativeInf || max.Inf == positiveInf {
+		return false
+	}
+	return border.Value > max.Value || (border.Value == max.Value && (border.Exclude || max.Exclude))
+}
+
+var positiveInfLexBorder = &LexBorder{
+	Inf: positiveInf,
+}
+
+var negativeInfLexBorder = &LexBorder{
+	Inf: negativeInf,
+}
+
+func ParseLexBorder(s string) (*LexBorder, error) {
+	if s == "+" {
+		return positiveInfLexBorder, nil
+	}
+	if s == "-" {
+		return negativeInfLexBorder, nil
+	}
+	if s == "" {
+		return nil, errors.New("ERR min or max not valid string range item")
+	}
+	switch s[0] {
+	case '(':
+		return &LexBorder{
+			Value: s[1:],
+			Exclude: true,
+		}, nil
+	case '[':
+		return &LexBorder{
+			Value: s[1:],
+			Exclude: false,
+		}, nil
+	}
+	return nil, errors.New("ERR min or max not valid string range item")
+}
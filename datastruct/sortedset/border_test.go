@@ -0,0 +1,56 @@
+package sortedset
+
+import (
+	"math"
+	"testing"
+)
+
+// -inf/+inf 包含score正好是无穷的member, (-inf/(+inf 不包含
+func TestInfBorder(t *testing.T) {
+	set := Make()
+	set.Add("neg", math.Inf(-1))
+	set.Add("one", 1)
+	set.Add("pos", math.Inf(1))
+
+	cases := []struct {
+		min, max string
+		expected int64
+	}{
+		{"-inf", "-inf", 1},
+		{"+inf", "+inf", 1},
+		{"inf", "inf", 1},
+		{"-inf", "+inf", 3},
+		{"(-inf", "+inf", 2},
+		{"-inf", "(+inf", 2},
+		{"(-inf", "(+inf", 1},
+		{"(-inf", "-inf", 0},
+		{"+inf", "(+inf", 0},
+		{"+inf", "-inf", 0},
+		{"1", "+inf", 2},
+		{"-inf", "(1", 1},
+	}
+	for _, c := range cases {
+		min, err := ParseScoreBorder(c.min)
+		if err != nil {
+			t.Fatal(err)
+		}
+		max, err := ParseScoreBorder(c.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := set.Count(min, max); count != c.expected {
+			t.Errorf("Count(%s, %s): expected %d, got %d", c.min, c.max, c.expected, count)
+		}
+		if elements := set.RangeByScore(min, max, 0, -1, false); int64(len(elements)) != c.expected {
+			t.Errorf("RangeByScore(%s, %s): expected %d, got %d", c.min, c.max, c.expected, len(elements))
+		}
+	}
+
+	min, _ := ParseScoreBorder("-inf")
+	if removed := set.RemoveByScore(min, min); removed != 1 {
+		t.Errorf("RemoveByScore(-inf, -inf): expected 1, got %d", removed)
+	}
+	if _, ok := set.Get("neg"); ok {
+		t.Error("neg should be removed")
+	}
+}
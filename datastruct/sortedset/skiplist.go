@@ -191,7 +191,8 @@ func (skiplist *skiplist)getRank(member string, score float64) int64 {
 			n = n.level[i].forward
 		}
 
-		if n.Member == member {
+		// header的Member也是"", 不能算作找到了
+		if n != skiplist.header && n.Member == member {
 			return rank
 		}
 	}
@@ -223,7 +224,7 @@ func (skiplist *skiplist)getByRank(rank int64) *Node {
 func (skiplist *skiplist)HasInRange(min *ScoreBorder, max *ScoreBorder) bool {
 	// First pass the condition of
 	// [10, 1] or (3, 3]
-	if min.Value > max.Value || (min.Value == max.Value && (max.Exclude || min.Exclude)) {
+	if min.isEmptyRange(max) {
 		return false
 	}
 	// min > tail
@@ -255,7 +256,7 @@ func (skiplist *skiplist)getFirstInScoreRange(min *ScoreBorder, max *ScoreBorder
 	}
 
 	n = n.level[0].forward
-	if !max.greater(n.Score) {
+	if n == nil || !max.greater(n.Score) {
 		return nil
 	}
 	return n
@@ -272,7 +273,7 @@ func (skiplist *skiplist)getLastInScoreRange(min *ScoreBorder, max *ScoreBorder)
 			n = n.level[level].forward
 		}
 	}
-	if !min.less(n.Score) {
+	if n == skiplist.header || !min.less(n.Score) {
 		return nil
 	}
 	return n
@@ -280,12 +281,12 @@ func (skiplist *skiplist)getLastInScoreRange(min *ScoreBorder, max *ScoreBorder)
 
 func (skiplist *skiplist)RemoveRangeByScore(min *ScoreBorder, max *ScoreBorder) (removed []*Element) {
 	update := make([]*Node, maxLevel)
-	removed = make([]*Element, maxLevel)
+	removed = make([]*Element, 0)
 
 	// find backward nodes of each level
 	n := skiplist.header
 	for i := skiplist.level - 1; i >=0 ;i-- {
-		for n.level[i].forward != nil && min.less(n.level[i].forward.Score) {
+		for n.level[i].forward != nil && !min.less(n.level[i].forward.Score) {
 			n = n.level[i].forward
 		}
 		update[i] = n
@@ -307,12 +308,39 @@ func (skiplist *skiplist)RemoveRangeByScore(min *ScoreBorder, max *ScoreBorder)
 }
 
 
+// 和RemoveRangeByScore一样, 只是按member比较
+func (skiplist *skiplist)RemoveRangeByLex(min *LexBorder, max *LexBorder) (removed []*Element) {
+	update := make([]*Node, maxLevel)
+	removed = make([]*Element, 0)
+
+	n := skiplist.header
+	for i := skiplist.level - 1; i >= 0; i-- {
+		for n.level[i].forward != nil && !min.less(n.level[i].forward.Member) {
+			n = n.level[i].forward
+		}
+		update[i] = n
+	}
+
+	n = n.level[0].forward
+	for n != nil {
+		if !max.greater(n.Member) {
+			return
+		}
+		next := n.level[0].forward
+		removeElement := n.Element
+		removed = append(removed, &removeElement)
+		skiplist.removeNode(n, update)
+		n = next
+	}
+	return
+}
+
+// rank 从1开始, 删除 [start, stop) 之间的元素
 func (skiplist *skiplist)RemoveRangeByRank(start int64, stop int64) (removed []*Element) {
 	var i int64 = 0
 	update := make([]*Node, maxLevel)
-	removed = make([]*Element, maxLevel)
+	removed = make([]*Element, 0)
 
-	n := skiplist.header
 	// scan from top level
 	node := skiplist.header
 	for level := skiplist.level - 1; level >= 0; level-- {
@@ -324,15 +352,65 @@ func (skiplist *skiplist)RemoveRangeByRank(start int64, stop int64) (removed []*
 	}
 
 	i++		// start position
-	n = node.level[0].forward
+	n := node.level[0].forward
 
 	for n != nil && i < stop {
 		next := n.level[0].forward
 		removeElement := n.Element
 		removed = append(removed, &removeElement)
-		skiplist.removeNode(node, update)
+		skiplist.removeNode(n, update)
 		n = next
 		i++
 	}
 	return
-}
\ No newline at end of file
+}
+
+func (skiplist *skiplist)hasInLexRange(min *LexBorder, max *LexBorder) bool {
+	if min.isEmptyRange(max) {
+		return false
+	}
+	n := skiplist.tail
+	if n == nil || !min.less(n.Member) {
+		return false
+	}
+	n = skiplist.header.level[0].forward
+	if n == nil || !max.greater(n.Member) {
+		return false
+	}
+	return true
+}
+
+// 和getFirstInScoreRange一样, 只是按member比较
+// 所有元素score相同时skiplist里的顺序就是member的字典序
+func (skiplist *skiplist)getFirstInLexRange(min *LexBorder, max *LexBorder) *Node {
+	if !skiplist.hasInLexRange(min, max) {
+		return nil
+	}
+	n := skiplist.header
+	for level := skiplist.level - 1; level >= 0; level-- {
+		for n.level[level].forward != nil && !min.less(n.level[level].forward.Member) {
+			n = n.level[level].forward
+		}
+	}
+	n = n.level[0].forward
+	if n == nil || !max.greater(n.Member) {
+		return nil
+	}
+	return n
+}
+
+func (skiplist *skiplist)getLastInLexRange(min *LexBorder, max *LexBorder) *Node {
+	if !skiplist.hasInLexRange(min, max) {
+		return nil
+	}
+	n := skiplist.header
+	for level := skiplist.level - 1; level >= 0; level-- {
+		for n.level[level].forward != nil && max.greater(n.level[level].forward.Member) {
+			n = n.level[level].forward
+		}
+	}
+	if n == skiplist.header || !min.less(n.Member) {
+		return nil
+	}
+	return n
+}
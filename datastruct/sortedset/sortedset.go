@@ -0,0 +1,265 @@
+package sortedset
+
+import "redis.simple/datastruct/dict"
+
+// 和redis的zset一样, dict 用来 O(1) 地按member查score
+// skiplist 按 (score, member) 排序, 用来做排名和范围查询
+// 两个结构里的数据始终保持一致
+type SortedSet struct {
+	dict     dict.Dict // member => *Element
+	skiplist *skiplist
+}
+
+func Make() *SortedSet {
+	return &SortedSet{
+		// 和hash一样由key的锁保护, 不需要ConcurrentDict
+		dict:     dict.MakeSimple(),
+		skiplist: makeSkiplist(),
+	}
+}
+
+// 添加或者更新member的score, 返回是不是新加的
+func (sortedSet *SortedSet) Add(member string, score float64) bool {
+	raw, exists := sortedSet.dict.Get(member)
+	sortedSet.dict.Put(member, &Element{
+		Member: member,
+		Score:  score,
+	}, dict.STRING)
+	if exists {
+		old := raw.(*Element)
+		if old.Score != score {
+			sortedSet.skiplist.remove(member, old.Score)
+			sortedSet.skiplist.insert(member, score)
+		}
+		return false
+	}
+	sortedSet.skiplist.insert(member, score)
+	return true
+}
+
+func (sortedSet *SortedSet) Len() int64 {
+	return int64(sortedSet.dict.Len())
+}
+
+func (sortedSet *SortedSet) Get(member string) (element *Element, ok bool) {
+	raw, exists := sortedSet.dict.Get(member)
+	if !exists {
+		return nil, false
+	}
+	return raw.(*Element), true
+}
+
+func (sortedSet *SortedSet) Remove(member string) bool {
+	raw, exists := sortedSet.dict.Get(member)
+	if !exists {
+		return false
+	}
+	sortedSet.skiplist.remove(member, raw.(*Element).Score)
+	sortedSet.dict.Remove(member)
+	return true
+}
+
+// 返回从0开始的排名, desc 为true时从大到小排, member不存在时返回-1
+func (sortedSet *SortedSet) GetRank(member string, desc bool) int64 {
+	element, ok := sortedSet.Get(member)
+	if !ok {
+		return -1
+	}
+	rank := sortedSet.skiplist.getRank(member, element.Score) - 1
+	if desc {
+		rank = sortedSet.Len() - 1 - rank
+	}
+	return rank
+}
+
+// 遍历排名在 [start, stop) 之间的元素, 排名从0开始
+func (sortedSet *SortedSet) ForEach(start int64, stop int64, desc bool, consumer func(element *Element) bool) {
+	size := sortedSet.Len()
+	if start < 0 {
+		start = 0
+	}
+	if stop > size {
+		stop = size
+	}
+	if start >= stop {
+		return
+	}
+
+	var node *Node
+	if desc {
+		node = sortedSet.skiplist.getByRank(size - start)
+	} else {
+		node = sortedSet.skiplist.getByRank(start + 1)
+	}
+	for i := start; i < stop && node != nil; i++ {
+		if !consumer(&node.Element) {
+			break
+		}
+		if desc {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+	}
+}
+
+// 返回排名在 [start, stop) 之间的元素
+func (sortedSet *SortedSet) Range(start int64, stop int64, desc bool) []*Element {
+	elements := make([]*Element, 0)
+	sortedSet.ForEach(start, stop, desc, func(element *Element) bool {
+		elements = append(elements, element)
+		return true
+	})
+	return elements
+}
+
+// score 在 [min, max] 之间的元素个数
+func (sortedSet *SortedSet) Count(min *ScoreBorder, max *ScoreBorder) int64 {
+	var count int64
+	sortedSet.ForEachByScore(min, max, 0, -1, false, func(element *Element) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// 遍历score在 [min, max] 之间的元素, 跳过前offset个, limit 小于0表示不限制个数
+func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64,
+	desc bool, consumer func(element *Element) bool) {
+	var node *Node
+	if desc {
+		node = sortedSet.skiplist.getLastInScoreRange(min, max)
+	} else {
+		node = sortedSet.skiplist.getFirstInScoreRange(min, max)
+	}
+
+	for node != nil && offset > 0 {
+		if desc {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+		offset--
+	}
+
+	for i := int64(0); (i < limit || limit < 0) && node != nil; i++ {
+		if desc && !min.less(node.Score) || !desc && !max.greater(node.Score) {
+			break
+		}
+		if !consumer(&node.Element) {
+			break
+		}
+		if desc {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+	}
+}
+
+func (sortedSet *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64,
+	desc bool) []*Element {
+	elements := make([]*Element, 0)
+	sortedSet.ForEachByScore(min, max, offset, limit, desc, func(element *Element) bool {
+		elements = append(elements, element)
+		return true
+	})
+	return elements
+}
+
+// 和ForEachByScore一样, 只是按member的字典序
+func (sortedSet *SortedSet) ForEachByLex(min *LexBorder, max *LexBorder, offset int64, limit int64,
+	desc bool, consumer func(element *Element) bool) {
+	var node *Node
+	if desc {
+		node = sortedSet.skiplist.getLastInLexRange(min, max)
+	} else {
+		node = sortedSet.skiplist.getFirstInLexRange(min, max)
+	}
+
+	for node != nil && offset > 0 {
+		if desc {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+		offset--
+	}
+
+	for i := int64(0); (i < limit || limit < 0) && node != nil; i++ {
+		if desc && !min.less(node.Member) || !desc && !max.greater(node.Member) {
+			break
+		}
+		if !consumer(&node.Element) {
+			break
+		}
+		if desc {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+	}
+}
+
+func (sortedSet *SortedSet) RangeByLex(min *LexBorder, max *LexBorder, offset int64, limit int64,
+	desc bool) []*Element {
+	elements := make([]*Element, 0)
+	sortedSet.ForEachByLex(min, max, offset, limit, desc, func(element *Element) bool {
+		elements = append(elements, element)
+		return true
+	})
+	return elements
+}
+
+// 删除score在 [min, max] 之间的元素, 返回删除的个数
+func (sortedSet *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) int64 {
+	removed := sortedSet.skiplist.RemoveRangeByScore(min, max)
+	for _, element := range removed {
+		sortedSet.dict.Remove(element.Member)
+	}
+	return int64(len(removed))
+}
+
+// member 在 [min, max] 之间的元素个数
+func (sortedSet *SortedSet) LexCount(min *LexBorder, max *LexBorder) int64 {
+	var count int64
+	sortedSet.ForEachByLex(min, max, 0, -1, false, func(element *Element) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// 删除member在 [min, max] 之间的元素, 返回删除的个数
+func (sortedSet *SortedSet) RemoveByLex(min *LexBorder, max *LexBorder) int64 {
+	removed := sortedSet.skiplist.RemoveRangeByLex(min, max)
+	for _, element := range removed {
+		sortedSet.dict.Remove(element.Member)
+	}
+	return int64(len(removed))
+}
+
+// 删除排名在 [start, stop) 之间的元素, 排名从0开始
+func (sortedSet *SortedSet) RemoveByRank(start int64, stop int64) int64 {
+	removed := sortedSet.skiplist.RemoveRangeByRank(start+1, stop+1)
+	for _, element := range removed {
+		sortedSet.dict.Remove(element.Member)
+	}
+	return int64(len(removed))
+}
+
+// 弹出score最小(desc为true时最大)的count个元素
+func (sortedSet *SortedSet) Pop(count int64, desc bool) []*Element {
+	elements := sortedSet.Range(0, count, desc)
+	for _, element := range elements {
+		sortedSet.Remove(element.Member)
+	}
+	return elements
+}
+
+// 按member遍历, cursor 的含义见 dict.Dict.Scan
+func (sortedSet *SortedSet) Scan(cursor uint64, count int, consumer func(element *Element)) uint64 {
+	return sortedSet.dict.Scan(cursor, count, func(member string, val interface{}) {
+		consumer(val.(*Element))
+	})
+}
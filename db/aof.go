@@ -2,17 +2,51 @@ package db
 
 import (
 	"bufio"
-	"datastruct/lock"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"redis.simple/config"
+	"redis.simple/datastruct/bitmap"
+	"redis.simple/datastruct/dict"
+	List "redis.simple/datastruct/list"
+	"redis.simple/datastruct/set"
+	SortedSet "redis.simple/datastruct/sortedset"
+	"redis.simple/interface/redis"
+	"redis.simple/lib/aof"
+	"redis.simple/lib/logger"
+	"redis.simple/redis/reply"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var pExpireAtCmd = []byte("PEXPIREAT")
 
+// 发送给handleAof的命令, 带上它所在的数据库
+type payload struct {
+	dbIndex int
+	cmdLine *reply.MultiBulkReply
+	// 不为nil时是一个事务里的所有命令, 写成 MULTI ... EXEC
+	tx []*payload
+	// appendfsync always 时不为nil, 写入并fsync成功之后关闭, 命令等它关闭之后才回复
+	// 写入或者fsync失败时不会关闭, handleAof直接退出进程
+	done chan struct{}
+}
+
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+
+	// 连续写入失败这么多次之后拒绝写命令, 偶尔一次失败重试就好了
+	aofWriteErrorsToRefuse = 3
+)
+
 
 /*
 	以下的函数将命令封装为aof命令以便持久化
@@ -26,8 +60,18 @@ func makeExpireCmd(key string, expireAt time.Time) *reply.MultiBulkReply {
 	return reply.MakeMultiBulkReply(args)
 }
 
+var (
+	selectCmd = []byte("SELECT")
+	multiCmd  = reply.MakeMultiBulkReply([][]byte{[]byte("MULTI")})
+	execCmd   = reply.MakeMultiBulkReply([][]byte{[]byte("EXEC")})
+)
+
+func makeSelectCmd(dbIndex int) *reply.MultiBulkReply {
+	return reply.MakeMultiBulkReply([][]byte{selectCmd, []byte(strconv.Itoa(dbIndex))})
+}
+
 func makeAofCmd(cmd string, args [][]byte) *reply.MultiBulkReply {
-	params := make([][]byte, len(args) - 1)
+	params := make([][]byte, len(args) + 1)
 	copy(params[1:], args)
 	params[0] = []byte(cmd)
 	return reply.MakeMultiBulkReply(params)
@@ -35,174 +79,409 @@ func makeAofCmd(cmd string, args [][]byte) *reply.MultiBulkReply {
 
 // send to chan to aof
 func (db *DB)AddAof(args *reply.MultiBulkReply) {
-	if config.Propertites.AppendOnly && db.aofChan != nil {
-		db.aofChan <- args
+	if db.addAof != nil {
+		db.addAof(args)
+	}
+}
+
+// 写命令执行之后按extra写AOF, 调用者持有key的锁
+func (db *DB)persist(cmdLine [][]byte, ex *extra) {
+	if ex == nil || !ex.toPersist {
+		return
+	}
+	if len(ex.specialAof) == 0 {
+		db.AddAof(reply.MakeMultiBulkReply(cmdLine))
+		return
+	}
+	for _, cmd := range ex.specialAof {
+		db.AddAof(cmd)
+	}
+}
+
+// 原样记录命令, 只读不改, 所有写命令共用一个
+var persistAsIs = &extra{toPersist: true}
+
+// 换成别的命令记录, 比如 SPOP 记为 SREM, 相对的过期时间记为 PEXPIREAT
+func persistAs(cmdLines ...*reply.MultiBulkReply) *extra {
+	return &extra{
+		toPersist:  true,
+		specialAof: cmdLines,
 	}
 }
 
+func (mdb *MultiDB)addAof(dbIndex int, args *reply.MultiBulkReply) {
+	if !config.Properties.AppendOnly || mdb.aofChan == nil {
+		return
+	}
+	p := &payload{
+		dbIndex: dbIndex,
+		cmdLine: args,
+	}
+	// 事务执行中, 等EXEC结束一起写
+	if mdb.aofTx != nil {
+		mdb.aofTx = append(mdb.aofTx, p)
+		return
+	}
+	mdb.sendAof(p)
+}
+
+// 把事务攒下的AOF作为一个整体发给handleAof, 调用者持有txMu的写锁
+func (mdb *MultiDB)flushAofTx() {
+	tx := mdb.aofTx
+	mdb.aofTx = nil
+	if len(tx) > 0 {
+		mdb.sendAof(&payload{tx: tx})
+	}
+}
+
+// appendfsync always 时等handleAof写入并fsync之后再返回, 这样命令回复的时候已经落盘了
+func (mdb *MultiDB)sendAof(p *payload) {
+	if mdb.aofFsync != fsyncAlways {
+		mdb.aofChan <- p
+		return
+	}
+	p.done = make(chan struct{})
+	mdb.aofChan <- p
+	<-p.done
+}
+
+// 写入一个payload, 和上一条命令不在同一个数据库时先写SELECT
+// currentDB 是文件里最后一条SELECT的下标
+func writePayload(w io.Writer, p *payload, currentDB *int) error {
+	if p.tx != nil {
+		if _, err := w.Write(multiCmd.ToBytes()); err != nil {
+			return err
+		}
+		for _, sub := range p.tx {
+			if err := writePayload(w, sub, currentDB); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(execCmd.ToBytes())
+		return err
+	}
+	if p.dbIndex != *currentDB {
+		if _, err := w.Write(makeSelectCmd(p.dbIndex).ToBytes()); err != nil {
+			return err
+		}
+		*currentDB = p.dbIndex
+	}
+	_, err := w.Write(p.cmdLine.ToBytes())
+	return err
+}
+
 // 执行完后makeAofCmd 然后放入aofChan里，HandleAof协程自然会继续处理
 /*
 	下面的加锁告诉我们要注意好各种意外和退出, 防止某过程中的退出
  */
-func (db *DB)handleAof() {	// 在初始化db是时候就卡开启了这个协程,所以不会阻塞
-	for cmd := range db.aofChan {
-		db.pausingAof.RLock() // 这个锁干嘛,防止写入时被别的协程阻塞
-		// 判断是否是aofRewritten 状态
-		if db.aofRewriteChan != nil {
-			// 不仅要写入aof文件， 还要写入aof冲了重写缓存
-			db.aofRewriteChan <- cmd
+func (mdb *MultiDB)handleAof() {	// 在初始化db是时候就卡开启了这个协程,所以不会阻塞
+	// 写入失败之后每秒重试一次, 不用等下一条命令
+	retryTicker := time.NewTicker(time.Second)
+	defer retryTicker.Stop()
+	for {
+		select {
+		case p, ok := <-mdb.aofChan:
+			if !ok {
+				return
+			}
+			mdb.pausingAof.RLock() // 这个锁干嘛,防止写入时被别的协程阻塞
+			// 判断是否是aofRewritten 状态
+			if mdb.aofRewriteBuf != nil {
+				// 不仅要写入aof文件， 还要写入aof冲了重写缓存
+				mdb.aofRewriteBuf = append(mdb.aofRewriteBuf, p)
+			}
+			// 先编码到缓冲里, 写入失败时留着下次重试
+			var buf bytes.Buffer
+			_ = writePayload(&buf, p, &mdb.aofCurrentDB)
+			mdb.aofPending = append(mdb.aofPending, buf.Bytes()...)
+			err := mdb.flushAofPending()
+			mdb.pausingAof.RUnlock()
+			if p.done != nil {
+				// 命令已经执行了, 回复失败也撤销不了, 和redis一样直接退出, 不能让client以为已经落盘了
+				if err != nil {
+					logger.Fatal("can't recover from AOF write error when the AOF fsync policy is 'always': " +
+						err.Error() + ", exiting...")
+				}
+				close(p.done)
+			}
+		case <-retryTicker.C:
+			mdb.pausingAof.RLock()
+			if len(mdb.aofPending) > 0 {
+				mdb.flushAofPending()
+			} else if mdb.aofWriteErrors() > 0 && mdb.aofFsync != fsyncNo {
+				// 之前失败的是fsync
+				mdb.aofWriteDone(mdb.aofFile.Sync())
+			}
+			mdb.pausingAof.RUnlock()
 		}
-		_, err := db.aofFile.Write(cmd.toBytes())
-		if err != nil {
-			logger.Warn("Rewritten err: " + err.Error())
+	}
+}
+
+// 把aofPending写入文件, 只有handleAof协程调用, 调用者持有pausingAof的读锁
+// 只写进去一部分时把这部分截掉, 保证文件里都是完整的命令, 截不掉的话就当作写进去了
+// 返回写入(appendfsync always 时还有fsync)的错误
+func (mdb *MultiDB)flushAofPending() error {
+	n, err := mdb.aofFile.Write(mdb.aofPending)
+	if err != nil && n > 0 {
+		if truncErr := mdb.aofFile.Truncate(mdb.aofSize()); truncErr != nil {
+			logger.Warn("could not remove short write from the append-only file: " + truncErr.Error())
+			mdb.aofPending = mdb.aofPending[n:]
+			atomic.AddInt64(&mdb.aofFileSize, int64(n))
+		}
+	}
+	if err == nil {
+		atomic.AddInt64(&mdb.aofFileSize, int64(n))
+		mdb.aofPending = nil
+		if mdb.aofFsync == fsyncAlways {
+			err = mdb.aofFile.Sync()
 		}
-		db.pausingAof.RUnlock()
 	}
+	mdb.aofWriteDone(err)
+	return err
 }
 
-// ----
+// appendfsync everysec 的后台协程, fsync可能很慢, 不能放在handleAof里挡住写入
+func (mdb *MultiDB)syncAofEverySec() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// 持有读锁, 重写替换文件的时候不会fsync到关闭了的文件
+			mdb.pausingAof.RLock()
+			if mdb.aofFile != nil {
+				mdb.aofWriteDone(mdb.aofFile.Sync())
+			}
+			mdb.pausingAof.RUnlock()
+		case <-mdb.aofSyncStop:
+			return
+		}
+	}
+}
 
-func trim(msg []byte) string {
-	// 为什么从后边trim的
-	for i := len(msg) - 2;i >= 0;i-- {
-		if msg[i] == '\r' || msg[i] == '\n' {
-			continue
+// 记录一次写入或者fsync的结果
+func (mdb *MultiDB)aofWriteDone(err error) {
+	if err != nil {
+		mdb.aofLastError.Store(err.Error())
+		if atomic.AddInt32(&mdb.aofWriteErrCount, 1) == 1 {
+			logger.Warn("error writing to the AOF file: " + err.Error())
 		}
-		return string(msg[:i+1])
+		return
+	}
+	if atomic.SwapInt32(&mdb.aofWriteErrCount, 0) > 0 {
+		logger.Info("AOF write error looks solved, can write again.")
+	}
+}
+
+// 连续写入失败的次数
+func (mdb *MultiDB)aofWriteErrors() int32 {
+	return atomic.LoadInt32(&mdb.aofWriteErrCount)
+}
+
+func (mdb *MultiDB)aofSize() int64 {
+	return atomic.LoadInt64(&mdb.aofFileSize)
+}
+
+// AOF连续写入失败时拒绝写命令, 直到写入恢复
+func (mdb *MultiDB)checkAofStatus(command *command) reply.ErrorReply {
+	if mdb.aofFile == nil || !command.isWrite() || mdb.aofWriteErrors() < aofWriteErrorsToRefuse {
+		return nil
 	}
-	return ""
+	lastError, _ := mdb.aofLastError.Load().(string)
+	return reply.MakeErrReply("MISCONF Errors writing to the AOF file: " + lastError)
 }
 
+// ----
 
 // 写完之后该读取了
 // 还有将aofRewrittenChan里的呢
-func (db *DB)loadAof(maxBytes int) {
+func (mdb *MultiDB)loadAof(maxBytes int) error {
 	// delete aofChan to prevent write again
-	aofChan := db.aofChan
-	db.aofChan = nil
-	defer func(aofChan chan *reply.MultiBulkReply) {
-		db.aofChan = aofChan
+	aofChan := mdb.aofChan
+	mdb.aofChan = nil
+	defer func(aofChan chan *payload) {
+		mdb.aofChan = aofChan
 	}(aofChan)
 
-	file, err := os.Open(db.aofFilename)
+	file, err := os.Open(mdb.aofFilename)
 	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
+		if os.IsNotExist(err) {
+			return nil
 		}
-		logger.Warn(err)
-		return
+		return err
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	var fixedLen int64 = 0
-	var expectedArgsCount uint32
-	var receivedCount uint32
-	var args [][]byte
-	processing := false
-	var msg []byte
-	readBytes := 0
-	for {
-		if maxBytes != 0 && readBytes >= maxBytes {
-			break
+	reader := aof.NewReader(file)
+	// 文件开头(没有SELECT之前)的命令属于0号数据库
+	dbIndex := 0
+	// 事务读到EXEC才一起重放, 文件在事务中间结束或者坏掉时整个事务都不算, 错误的Offset是MULTI开始的位置
+	for maxBytes == 0 || reader.Offset() < int64(maxBytes) {
+		block, err := reader.ReadBlock()
+		if err == io.EOF {
+			return nil
 		}
-		if fixedLen == 0 {
-			msg, err = reader.ReadBytes('\n')
-			if err != nil {
-				if err != io.EOF {
-					logger.Warn(err)
-				}
-				return
-			}
-			readBytes += len(msg)
-		} else {
-			msg = make([]byte, fixedLen+2)
-			n, err := io.ReadFull(reader, msg)
-			if err != nil {
-				if err != io.EOF {
-					logger.Warn("invalid multibulk length")
-				}
-				return
-			}
-			fixedLen = 0
-			readBytes += n
+		if err != nil {
+			return err
 		}
+		for _, cmdLine := range block {
+			dbIndex = mdb.replay(dbIndex, cmdLine)
+		}
+	}
+	return nil
+}
 
-		if !processing {
-			// new request
-			if msg[0] == '*' {
-				// bulk multi msg
-				expectedLine, err := strconv.ParseUint(trim(msg[1:]), 10, 32)
-				if err != nil {
-					logger.Warn(err)
-					return
-				}
-				expectedArgsCount = uint32(expectedLine)
-				receivedCount = 0
-				processing = true
-				args = make([][]byte, expectedLine)
-			} else {
-				logger.Warn("msg should start with '*'")
-				return
-			}
-		} else {
-			// receive following part of a request
-			line := msg[0 : len(msg)-2]
-			if line[0] == '$' {
-				fixedLen, err = strconv.ParseInt(trim(line[1:]), 10, 64)
-				if err != nil {
-					logger.Warn(err)
-					return
-				}
-				if fixedLen <= 0 {
-					logger.Warn("invalid multibulk length")
-					return
-				}
-			} else {
-				args[receivedCount] = line
-				receivedCount++
-			}
-
-			// if sending finished
-			if receivedCount == expectedArgsCount {
-				processing = false
+// 启动时加载AOF出错
+// 只是文件末尾不完整并且开启了 aof-load-truncated 时, 截掉不完整的部分继续启动, 其他情况拒绝启动
+func (mdb *MultiDB)handleAofLoadError(err error) {
+	var aofErr *aof.Error
+	if !errors.As(err, &aofErr) {
+		logger.Fatal(fmt.Sprintf("can't load the AOF file %s: %v", mdb.aofFilename, err))
+		return
+	}
+	if !aofErr.Truncated() {
+		logger.Fatal(fmt.Sprintf("bad file format reading the AOF file %s: %v, "+
+			"make a backup of it and run aof-check --fix", mdb.aofFilename, aofErr))
+		return
+	}
+	if !config.Properties.AofLoadTruncated {
+		logger.Fatal(fmt.Sprintf("unexpected end of file reading the AOF file %s at offset %d, "+
+			"set aof-load-truncated to yes or run aof-check --fix", mdb.aofFilename, aofErr.Offset))
+		return
+	}
+	logger.Warn(fmt.Sprintf("short read while loading the AOF file %s at offset %d", mdb.aofFilename, aofErr.Offset))
+	if truncErr := os.Truncate(mdb.aofFilename, aofErr.Offset); truncErr != nil {
+		logger.Fatal(fmt.Sprintf("can't truncate the AOF file %s: %v", mdb.aofFilename, truncErr))
+		return
+	}
+	logger.Warn(fmt.Sprintf("AOF loaded anyway because aof-load-truncated is enabled, truncated to %d bytes", aofErr.Offset))
+}
 
-				cmd := strings.ToLower(string(args[0]))
-				cmdFunc, ok := router[cmd]
-				if ok {
-					cmdFunc(db, args[1:])
-				}
 
-				// finish
-				expectedArgsCount = 0
-				receivedCount = 0
-				args = nil
+// 重放一条命令, 返回之后的命令所在的数据库
+// MULTI/EXEC 不在命令表里, 会被跳过, 事务里的命令逐条重放
+// 和事务里的命令一样由execLockedCommand执行, 被原地修改的value(RPUSH、SADD等)也会重新估计内存
+func (mdb *MultiDB)replay(dbIndex int, args [][]byte) int {
+	cmd := strings.ToLower(string(args[0]))
+	if cmd == "select" {
+		if len(args) == 2 {
+			if index, errReply := mdb.parseDBIndex(args[1]); errReply == nil {
+				return index
 			}
 		}
+		logger.Warn("invalid select in aof")
+		return dbIndex
+	}
+	command, ok := router[cmd]
+	if !ok || !command.validateArity(args) {
+		return dbIndex
+	}
+	mdb.execLockedCommand(dbIndex, command, args)
+	return dbIndex
+}
+
+// BGREWRITEAOF
+// 重写在后台协程里进行, 命令马上返回, 同时只能有一个重写
+func BGRewriteAOF(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return &reply.ArgNumErrReply{Cmd: "bgrewriteaof"}
+	}
+	if errReply := mdb.bgRewriteAof(); errReply != nil {
+		return errReply
+	}
+	return reply.MakeStatusReply("Background append only file rewriting started")
+}
+
+// 开始一次后台重写, 已经在重写时返回错误
+func (mdb *MultiDB)bgRewriteAof() reply.ErrorReply {
+	if mdb.aofFile == nil {
+		return reply.MakeErrReply("ERR Background append only file rewriting needs appendonly enabled")
+	}
+	if !atomic.CompareAndSwapInt32(&mdb.aofRewriting, 0, 1) {
+		return reply.MakeErrReply("ERR Background append only file rewriting already in progress")
 	}
+	atomic.StoreInt64(&mdb.aofRewriteStart, time.Now().UnixNano())
+	go mdb.aofWrite()
+	return nil
 }
 
+// 自动重写失败之后至少等这么久再试, 免得每次定时任务都重写一次
+const aofRewriteRetryDelay = 10 * time.Second
+
+// 定时任务调用, AOF文件比上一次重写之后增长超过 auto-aof-rewrite-percentage
+// 并且不小于 auto-aof-rewrite-min-size 时开始后台重写
+func (mdb *MultiDB)rewriteAofIfNeeded() {
+	percentage := config.Properties.AutoAofRewritePercentage
+	if mdb.aofFile == nil || percentage <= 0 || mdb.isAofRewriting() {
+		return
+	}
+	size := mdb.aofSize()
+	if size < config.Properties.AutoAofRewriteMinSize {
+		return
+	}
+	base := atomic.LoadInt64(&mdb.aofRewriteBaseSize)
+	if base <= 0 {
+		base = 1
+	}
+	growth := (size - base) * 100 / base
+	if growth < int64(percentage) {
+		return
+	}
+	if mdb.aofRewriteStatus() != "ok" &&
+		time.Since(time.Unix(0, atomic.LoadInt64(&mdb.aofRewriteStart))) < aofRewriteRetryDelay {
+		return
+	}
+	logger.Info(fmt.Sprintf("starting automatic rewriting of AOF on %d%% growth", growth))
+	if errReply := mdb.bgRewriteAof(); errReply != nil {
+		logger.Warn("automatic AOF rewrite: " + errReply.Error())
+	}
+}
+
+func (mdb *MultiDB)isAofRewriting() bool {
+	return atomic.LoadInt32(&mdb.aofRewriting) == 1
+}
+
+// 上一次重写的结果, 还没有重写过时是ok
+func (mdb *MultiDB)aofRewriteStatus() string {
+	status, ok := mdb.aofLastRewriteStatus.Load().(string)
+	if !ok {
+		return "ok"
+	}
+	return status
+}
+
+// 正在进行的重写已经用了多少秒, 没有在重写时返回-1
+func (mdb *MultiDB)aofCurrentRewriteSec() int64 {
+	if !mdb.isAofRewriting() {
+		return -1
+	}
+	return (time.Now().UnixNano() - atomic.LoadInt64(&mdb.aofRewriteStart)) / int64(time.Second)
+}
 
 // aofRewrite
 // 重写过程:
 // 1. 因为要拿到旧的aof文件副本，这里不需要副本，(所以要取文件大小，当然要锁住了)
 // 只需要记录开始重写时的文件大小就可以，读到那个位置就停下
 // 2.然后读取aof重写缓冲区即可(这里也要锁住)
-func (db *DB)startRewrite() (*os.File, int64, error) {
-	db.pausingAof.Lock()
-	defer db.pausingAof.Unlock()
-
-	db.aofRewriteChan = make(chan *reply.MultiBulkReply, aofQueueSize)
-
-	fileInfo, _ := os.Stat(db.aofFilename)
-	fileSize := fileInfo.Size()
+func (mdb *MultiDB)startRewrite() (*os.File, int64, error) {
+	mdb.pausingAof.Lock()
+	defer mdb.pausingAof.Unlock()
+
+	// 没写进文件的命令既不在要重放的那部分里, 也不会进重写缓冲, 先写进去
+	if len(mdb.aofPending) > 0 {
+		mdb.flushAofPending()
+		if len(mdb.aofPending) > 0 {
+			return nil, 0, errors.New("can't rewrite while writes to the AOF file are failing")
+		}
+	}
 
-	file, err := ioutil.TempFile("", "aof")
+	// 和AOF文件放在同一个目录下, 不同的文件系统之间不能rename
+	file, err := ioutil.TempFile(filepath.Dir(mdb.aofFilename), "temp-rewriteaof-*.aof")
 	if err != nil {
-		logger.Warn("tmp file create failed")
 		return nil, 0, err
 	}
-	return file, fileSize, nil
+	mdb.aofRewriteBuf = make([]*payload, 0)
+	return file, mdb.aofSize(), nil
 }
 
 
@@ -213,33 +492,82 @@ func (db *DB)startRewrite() (*os.File, int64, error) {
 // 进行反推指令，比如<key, val<set>> 那就是使用persistSet重新构造出指令cmd
 // 这样每个<key, val>一定只对应一条指令，可达到简化目的(看看官方怎么做?)
 // adb是异步的，会有不足，所以要靠aof的同步刷新,这些指令的结果可能adb里还没有
-func (db *DB)aofWrite() {
+func (mdb *MultiDB)aofWrite() {
+	start := time.Now()
+	status := "ok"
+	if err := mdb.rewriteAof(); err != nil {
+		logger.Warn("background AOF rewrite failed: " + err.Error())
+		status = "err"
+	} else {
+		logger.Info("background AOF rewrite finished successfully")
+	}
+	mdb.aofLastRewriteStatus.Store(status)
+	atomic.StoreInt64(&mdb.aofLastRewriteSec, int64(time.Since(start)/time.Second))
+	atomic.StoreInt32(&mdb.aofRewriting, 0)
+}
+
+func (mdb *MultiDB)rewriteAof() error {
 	// 三大步
 	// 1. 加锁，获取aof文件状态(大小，知道rewriteBuff是哪个位置之后的)
 	// 2. loadAof刷入simpleDB, 对每个key反推指令，指令写入new aodFile
 	// 3. rewriteBuff 写入new aofFile
-	file, fileSize, err := db.startRewrite()
+	file, fileSize, err := mdb.startRewrite()
 	if err != nil {
-		logger.Warn(err)
-		return
+		return err
 	}
 
-	tmpDB := &DB{
-		Data: dict.MakeSimple(),
-		TTLMap:   dict.MakeSimple(),
-		Locker:   lock.Make(lockerSize),
-		interval: 5 * time.Second,
+	tmpDB := &MultiDB{
+		dbSet: make([]*DB, len(mdb.dbSet)),
+		functions: makeFunctionLibs(),
+		aofFilename: mdb.aofFilename,
+	}
+	for i := range tmpDB.dbSet {
+		tmpDB.dbSet[i] = makeTmpDB(i)
+	}
+	// 将现有状态导入tmpDB
+	if err := tmpDB.loadAof(int(fileSize)); err != nil {
+		mdb.abortRewrite(file)
+		return err
+	}
 
-		aofFilename: db.aofFilename,
+	// bufio.Writer 出错之后不再写, 最后Flush的时候统一检查
+	writer := bufio.NewWriter(file)
+	// 函数库不属于哪个数据库, 写在最前面
+	for _, lib := range tmpDB.functions.list() {
+		_, _ = writer.Write(persistFunction(lib).ToBytes())
 	}
-	tmpDB.loadAof(int(fileSize))  // 将现有状态导入tmpDB
 
-	tmpDB.Data.ForEach(func(key string, raw interface{}) bool {
+	for i, db := range tmpDB.dbSet {
+		if db.Data.Len() == 0 {
+			continue
+		}
+		_, _ = writer.Write(makeSelectCmd(i).ToBytes())
+		db.rewriteTo(writer)
+	}
+	if err := writer.Flush(); err != nil {
+		mdb.abortRewrite(file)
+		return err
+	}
+
+	// aofRewriteBuff的写入
+	if err := mdb.finishRewrite(file); err != nil {
+		mdb.abortRewrite(file)
+		return err
+	}
+	return nil
+}
+
+// 把一个数据库里的每个key反推成一条命令, 再加上过期时间
+func (db *DB)rewriteTo(w io.Writer) {
+	db.Data.ForEach(func(key string, raw interface{}) bool {
 		var cmd *reply.MultiBulkReply
 		entity, _ := raw.(*DataEntity)
 		switch val := entity.Data.(type) { // 为什么不直接raw.(type)
 		case []byte:
 			cmd = persistString(key, val)	// 重点在这里(变为指令?)
+		case bitmap.BitMap:
+			// bitmap就是字符串, 直接SET回去
+			cmd = persistString(key, val)
 		case *List.LinkedList:
 			cmd = persistList(key, val)
 		case *set.Set:
@@ -250,21 +578,18 @@ func (db *DB)aofWrite() {
 			cmd = persistZSet(key, val)
 		}
 		if cmd != nil {
-			_, _ = file.Write(cmd.ToBytes())
+			_, _ = w.Write(cmd.ToBytes())
 		}
 		return true
 	})
-	tmpDB.TTLMap.ForEach(func(key string, raw interface{}) bool {
+	db.TTLMap.ForEach(func(key string, raw interface{}) bool {
 		expireTime, _ := raw.(time.Time)
 		cmd := makeExpireCmd(key, expireTime)
 		if cmd != nil {
-			_, _ = file.Write(cmd.ToBytes())
+			_, _ = w.Write(cmd.ToBytes())
 		}
 		return true
 	})
-
-	// aofRewriteBuff的写入
-	db.finishRewrite(file)
 }
 
 var setCmd = []byte("SET")
@@ -277,13 +602,13 @@ func persistString(key string, bytes []byte) *reply.MultiBulkReply {
 	return reply.MakeMultiBulkReply(args)
 }
 
-var rPushAllCmd = []byte("RPUSHALL")
+var rPushCmd = []byte("RPUSH")
 
 func persistList(key string, list *List.LinkedList) *reply.MultiBulkReply {
-	args := make([][]byte, 2 + list.Len())  // 参数个数未知
-	args[0] = rPushAllCmd
+	args := make([][]byte, 2 + list.Llen())  // 参数个数未知
+	args[0] = rPushCmd
 	args[1] = []byte(key)
-	list.ForEach(func(i int, val interface{}) bool {
+	list.Foreach(func(i int, val interface{}) bool {
 		bytes, _ := val.([]byte)
 		args[i+2] = bytes
 		return true
@@ -298,9 +623,8 @@ func persistSet(key string, set *set.Set) *reply.MultiBulkReply {
 	args[0] = sAddCmd
 	args[1] = []byte(key)
 	i := 0
-	set.ForEach(func(val interface{}) bool {
-		bytes, _ := val.([]byte)
-		args[2+i] = bytes
+	set.ForEach(func(member string) bool {
+		args[2+i] = []byte(member)
 		i++
 		return true
 	})
@@ -328,7 +652,7 @@ func persistHash(key string, hash dict.Dict) *reply.MultiBulkReply {
 var zAddCmd = []byte("ZADD")
 
 func persistZSet(key string, zset *SortedSet.SortedSet) *reply.MultiBulkReply {
-	args := make([][]byte, 2 + zet.Len() * 2)
+	args := make([][]byte, 2 + zset.Len() * 2)
 	args[0] = zAddCmd
 	args[1] = []byte(key)
 	i := 0
@@ -344,34 +668,87 @@ func persistZSet(key string, zset *SortedSet.SortedSet) *reply.MultiBulkReply {
 
 
 
-func (db *DB)finishRewrite(tmpFile *os.File) {
+// 把重写缓冲写进新文件然后替换旧文件, 整个过程持有pausingAof的写锁, 这期间handleAof不会写入
+// 出错时旧文件不变, 由调用者删掉临时文件
+func (mdb *MultiDB)finishRewrite(tmpFile *os.File) error {
 	// 开头结尾都要lock, 这里是结尾
-	db.pausingAof.Lock()
-	defer db.pausingAof.Unlock()
-
-loop:
-	for {
-		select {
-		case cmd <-db.aofRewriteChan:
-			_, err := tmpFile.Write(cmd.ToBytes())
-			if err != nil {
-				logger.Warn(err)
-			}
-		default:
-			break loop// 跳出两层循环
+	mdb.pausingAof.Lock()
+	defer mdb.pausingAof.Unlock()
+
+	// 重写缓冲里的命令也要按数据库写SELECT
+	buf := mdb.aofRewriteBuf
+	mdb.aofRewriteBuf = nil
+	writer := bufio.NewWriter(tmpFile)
+	currentDB := -1
+	for _, p := range buf {
+		if err := writePayload(writer, p, &currentDB); err != nil {
+			return err
 		}
 	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
 
-	close(db.aofRewriteChan)
-	db.aofRewriteChan = nil
-
+	// 新文件在替换之前fsync, 免得替换之后宕机丢了重写的内容
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	// 替换之前先用追加的方式打开, 打不开时还可以放弃重写, 继续用旧文件
+	aofFile, err := os.OpenFile(tmpFile.Name(), os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	// 临时文件的目录项也要落盘, rename 之后再fsync一次目录, 替换才算落盘
+	dir := filepath.Dir(mdb.aofFilename)
+	if err := fsyncDir(dir); err != nil {
+		_ = aofFile.Close()
+		return err
+	}
 	// start to replace
-	_ = db.aofFile.Close()
-	_ = os.Rename(tmpFile.Name(), db.aofFilename)
-	// 重新打开
-	aofFile, err := os.OpenFile(db.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err := os.Rename(tmpFile.Name(), mdb.aofFilename); err != nil {
+		_ = aofFile.Close()
+		return err
+	}
+	_ = tmpFile.Close()
+	if err := fsyncDir(dir); err != nil {
+		logger.Warn("fsync the AOF directory after rewrite: " + err.Error())
+	}
+
+	_ = mdb.aofFile.Close()
+	mdb.aofFile = aofFile
+	mdb.initAofSize()
+	atomic.StoreInt64(&mdb.aofRewriteBaseSize, mdb.aofSize())
+	// 没写进旧文件的命令也进了重写缓冲, 已经在新文件里了
+	mdb.aofPending = nil
+	// 不知道新文件最后是哪个数据库, 下一条命令前重新写SELECT
+	mdb.aofCurrentDB = -1
+	return nil
+}
+
+// 重写失败, 不再收集重写缓冲, 删掉临时文件
+func (mdb *MultiDB)abortRewrite(tmpFile *os.File) {
+	mdb.pausingAof.Lock()
+	mdb.aofRewriteBuf = nil
+	mdb.pausingAof.Unlock()
+	_ = tmpFile.Close()
+	_ = os.Remove(tmpFile.Name())
+}
+
+func fsyncDir(dir string) error {
+	file, err := os.Open(dir)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (mdb *MultiDB)initAofSize() {
+	size := int64(0)
+	if info, err := mdb.aofFile.Stat(); err == nil {
+		size = info.Size()
+	} else {
+		logger.Warn(err)
 	}
-	db.aofFile = aofFile
+	atomic.StoreInt64(&mdb.aofFileSize, size)
 }
\ No newline at end of file
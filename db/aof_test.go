@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"redis.simple/lib/aof"
+	"redis.simple/redis/reply"
+	"testing"
+)
+
+func makeTestMultiDB(filename string) *MultiDB {
+	mdb := &MultiDB{
+		dbSet:       make([]*DB, 2),
+		functions:   makeFunctionLibs(),
+		aofFilename: filename,
+	}
+	for i := range mdb.dbSet {
+		mdb.dbSet[i] = makeTmpDB(i)
+	}
+	return mdb
+}
+
+func aofBytes(cmds ...[]string) []byte {
+	var data []byte
+	for _, cmd := range cmds {
+		args := make([][]byte, len(cmd))
+		for i, arg := range cmd {
+			args[i] = []byte(arg)
+		}
+		data = append(data, reply.MakeMultiBulkReply(args).ToBytes()...)
+	}
+	return data
+}
+
+// 文件在事务里的一条命令中间结束: 加载时报告截断在MULTI, 截掉之后文件里没有MULTI, 可以正常加载
+func TestLoadAofTruncatedTx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "appendonly.aof")
+
+	head := aofBytes([]string{"SET", "a", "1"}, []string{"SELECT", "1"}, []string{"SET", "b", "1"})
+	tx := aofBytes([]string{"MULTI"}, []string{"SET", "c", "1"})
+	last := aofBytes([]string{"SET", "d", "1"})
+	data := append(append(append([]byte{}, head...), tx...), last[:len(last)-3]...)
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = makeTestMultiDB(filename).loadAof(0)
+	var aofErr *aof.Error
+	if !errors.As(err, &aofErr) || !aofErr.Truncated() {
+		t.Fatalf("expected truncated error, got %v", err)
+	}
+	if aofErr.Offset != int64(len(head)) {
+		t.Fatalf("expected offset %d (MULTI), got %d", len(head), aofErr.Offset)
+	}
+
+	if err := os.Truncate(filename, aofErr.Offset); err != nil {
+		t.Fatal(err)
+	}
+	mdb := makeTestMultiDB(filename)
+	if err := mdb.loadAof(0); err != nil {
+		t.Fatalf("truncated file is still invalid: %v", err)
+	}
+	if _, ok := mdb.dbSet[0].GET("a"); !ok {
+		t.Error("expected a in db 0")
+	}
+	if _, ok := mdb.dbSet[1].GET("b"); !ok {
+		t.Error("expected b in db 1")
+	}
+	if _, ok := mdb.dbSet[1].GET("c"); ok {
+		t.Error("c is in the incomplete transaction and should not be loaded")
+	}
+}
@@ -0,0 +1,476 @@
+package db
+
+import (
+	"math/big"
+	"redis.simple/datastruct/bitmap"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+	bitmap 以 bitmap.BitMap 存放, 和字符串一样可以 GET/APPEND
+	bit命令直接原地修改BitMap, 第一次对普通字符串做bit操作时先拷贝一份,
+	因为字符串的[]byte可能还被AOF队列等别处引用着
+ */
+
+// 和redis一样, bitmap最大 512MB
+const maxBitOffset = maxStringLength*8 - 1
+
+// 返回的BitMap可以原地修改, 不存在时返回nil
+func (db *DB) getAsBitMap(key string) (bitmap.BitMap, reply.ErrorReply) {
+	entity, ok := db.GET(key)
+	if !ok {
+		return nil, nil
+	}
+	switch val := entity.Data.(type) {
+	case bitmap.BitMap:
+		return val, nil
+	case []byte:
+		bm := make(bitmap.BitMap, len(val))
+		copy(bm, val)
+		return bm, nil
+	}
+	return nil, &reply.WrongTypeErrReply{}
+}
+
+func parseBitOffset(raw []byte) (int64, reply.ErrorReply) {
+	offset, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || offset < 0 || offset > maxBitOffset {
+		return 0, reply.MakeErrReply("ERR bit offset is not an integer or out of range")
+	}
+	return offset, nil
+}
+
+func SetBit(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	offset, errReply := parseBitOffset(args[1])
+	if errReply != nil {
+		return errReply, nil
+	}
+	val := string(args[2])
+	if val != "0" && val != "1" {
+		return reply.MakeErrReply("ERR bit is not an integer or out of range"), nil
+	}
+	bm, errReply := db.getAsBitMap(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	old := bm.SetBit(offset, val[0]-'0')
+	// 扩容之后slice可能变了, 每次都重新放一次
+	db.PUT(key, &DataEntity{
+		Data: bm,
+	})
+	return reply.MakeIntReply(int64(old)), persistAsIs
+}
+
+func GetBit(db *DB, args [][]byte) redis.Reply {
+	offset, errReply := parseBitOffset(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	bm, errReply := db.getAsBitMap(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	return reply.MakeIntReply(int64(bm.GetBit(offset)))
+}
+
+// 解析 start end [BYTE|BIT], 返回按bit计算的闭区间, 区间为空时 ok 为false
+// size 是bitmap的字节数, 下标可以是负数
+func parseBitRange(args [][]byte, size int64) (start int64, end int64, ok bool, errReply reply.ErrorReply) {
+	start, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return 0, 0, false, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	end, err = strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, 0, false, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	isBit := false
+	if len(args) == 3 {
+		switch strings.ToUpper(string(args[2])) {
+		case "BIT":
+			isBit = true
+		case "BYTE":
+		default:
+			return 0, 0, false, &reply.SyntaxErrReply{}
+		}
+	} else if len(args) > 3 {
+		return 0, 0, false, &reply.SyntaxErrReply{}
+	}
+
+	total := size
+	if isBit {
+		total = size * 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, 0, false, nil
+	}
+	if !isBit {
+		start, end = start*8, end*8+7
+	}
+	return start, end, true, nil
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func BitCount(db *DB, args [][]byte) redis.Reply {
+	if len(args) == 2 {
+		return &reply.SyntaxErrReply{}
+	}
+	bm, errReply := db.getAsBitMap(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	start, end := int64(0), int64(len(bm))*8-1
+	if len(args) > 1 {
+		var ok bool
+		start, end, ok, errReply = parseBitRange(args[1:], int64(len(bm)))
+		if errReply != nil {
+			return errReply
+		}
+		if !ok {
+			return reply.MakeIntReply(0)
+		}
+	}
+	return reply.MakeIntReply(bm.BitCount(start, end))
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]
+func BitPos(db *DB, args [][]byte) redis.Reply {
+	bitArg := string(args[1])
+	if bitArg != "0" && bitArg != "1" {
+		return reply.MakeErrReply("ERR The bit argument must be 1 or 0.")
+	}
+	bit := bitArg[0] - '0'
+	bm, errReply := db.getAsBitMap(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if bm == nil {
+		if bit == 0 {
+			return reply.MakeIntReply(0)
+		}
+		return reply.MakeIntReply(-1)
+	}
+
+	size := int64(len(bm))
+	start, end := int64(0), size*8-1
+	endGiven := len(args) > 3
+	if len(args) > 2 {
+		rangeArgs := [][]byte{args[2], []byte("-1")}
+		if endGiven {
+			rangeArgs = args[2:]
+		}
+		var ok bool
+		start, end, ok, errReply = parseBitRange(rangeArgs, size)
+		if errReply != nil {
+			return errReply
+		}
+		if !ok {
+			return reply.MakeIntReply(-1)
+		}
+	}
+	pos := bm.BitPos(bit, start, end)
+	// 找0但是没有指定end时, 和redis一样认为右边是无限个0
+	if pos < 0 && bit == 0 && !endGiven {
+		return reply.MakeIntReply(end + 1)
+	}
+	return reply.MakeIntReply(pos)
+}
+
+// BITOP AND|OR|XOR|NOT destkey key [key ...]
+// 不存在的key和较短的字符串都当作右边补0
+func BitOp(db *DB, args [][]byte) (redis.Reply, *extra) {
+	op := strings.ToUpper(string(args[0]))
+	dest := string(args[1])
+	keys := args[2:]
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return reply.MakeErrReply("ERR BITOP NOT must be called with a single source key."), nil
+		}
+	default:
+		return &reply.SyntaxErrReply{}, nil
+	}
+
+	sources := make([]bitmap.BitMap, len(keys))
+	maxLen := 0
+	for i, key := range keys {
+		bm, errReply := db.getAsBitMap(string(key))
+		if errReply != nil {
+			return errReply, nil
+		}
+		sources[i] = bm
+		if len(bm) > maxLen {
+			maxLen = len(bm)
+		}
+	}
+
+	result := make(bitmap.BitMap, maxLen)
+	for i := 0; i < maxLen; i++ {
+		var b byte
+		for j, src := range sources {
+			var srcByte byte
+			if i < len(src) {
+				srcByte = src[i]
+			}
+			if j == 0 {
+				b = srcByte
+				continue
+			}
+			switch op {
+			case "AND":
+				b &= srcByte
+			case "OR":
+				b |= srcByte
+			case "XOR":
+				b ^= srcByte
+			}
+		}
+		if op == "NOT" {
+			b = ^b
+		}
+		result[i] = b
+	}
+
+	if maxLen == 0 {
+		db.Remove(dest)
+	} else {
+		db.PUT(dest, &DataEntity{
+			Data: result,
+		})
+		db.Persist(dest)
+	}
+	return reply.MakeIntReply(int64(maxLen)), persistAsIs
+}
+
+// BITFIELD 的 type, 比如 i8 u16
+type bitfieldType struct {
+	signed bool
+	width  uint
+}
+
+func parseBitfieldType(raw []byte) (*bitfieldType, reply.ErrorReply) {
+	errReply := reply.MakeErrReply("ERR Invalid bitfield type. Use something like i16 u8. " +
+		"Note that u64 is not supported but i64 is.")
+	s := strings.ToLower(string(raw))
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u') {
+		return nil, errReply
+	}
+	width, err := strconv.ParseUint(s[1:], 10, 8)
+	if err != nil || width < 1 || width > 64 || (s[0] == 'u' && width > 63) {
+		return nil, errReply
+	}
+	return &bitfieldType{
+		signed: s[0] == 'i',
+		width:  uint(width),
+	}, nil
+}
+
+// offset 可以写成 #N, 表示第N个该类型的整数
+func parseBitfieldOffset(raw []byte, t *bitfieldType) (int64, reply.ErrorReply) {
+	s := string(raw)
+	multiply := false
+	if strings.HasPrefix(s, "#") {
+		multiply = true
+		s = s[1:]
+	}
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, reply.MakeErrReply("ERR bit offset is not an integer or out of range")
+	}
+	if multiply {
+		if offset > maxBitOffset/int64(t.width) {
+			return 0, reply.MakeErrReply("ERR bit offset is not an integer or out of range")
+		}
+		offset *= int64(t.width)
+	}
+	if offset+int64(t.width)-1 > maxBitOffset {
+		return 0, reply.MakeErrReply("ERR bit offset is not an integer or out of range")
+	}
+	return offset, nil
+}
+
+func (t *bitfieldType) get(bm bitmap.BitMap, offset int64) int64 {
+	raw := bm.GetBits(offset, t.width)
+	if t.signed {
+		// 符号扩展
+		shift := 64 - t.width
+		return int64(raw<<shift) >> shift
+	}
+	return int64(raw)
+}
+
+func (t *bitfieldType) bounds() (min *big.Int, max *big.Int) {
+	if t.signed {
+		max = new(big.Int).Lsh(big.NewInt(1), t.width-1)
+		min = new(big.Int).Neg(max)
+		max.Sub(max, big.NewInt(1))
+		return min, max
+	}
+	max = new(big.Int).Lsh(big.NewInt(1), t.width)
+	max.Sub(max, big.NewInt(1))
+	return big.NewInt(0), max
+}
+
+// 按OVERFLOW的策略处理超出范围的值, FAIL时返回false
+func (t *bitfieldType) handleOverflow(val *big.Int, overflow string) (int64, bool) {
+	min, max := t.bounds()
+	if val.Cmp(min) >= 0 && val.Cmp(max) <= 0 {
+		return val.Int64(), true
+	}
+	switch overflow {
+	case "SAT":
+		if val.Cmp(min) < 0 {
+			return min.Int64(), true
+		}
+		return max.Int64(), true
+	case "FAIL":
+		return 0, false
+	}
+	// WRAP: 对 2^width 取模, 有符号数再映射回 [min, max]
+	modulus := new(big.Int).Lsh(big.NewInt(1), t.width)
+	wrapped := new(big.Int).Mod(val, modulus)
+	if t.signed && wrapped.Cmp(max) > 0 {
+		wrapped.Sub(wrapped, modulus)
+	}
+	return wrapped.Int64(), true
+}
+
+func (t *bitfieldType) set(bm *bitmap.BitMap, offset int64, val int64) {
+	bm.SetBits(offset, t.width, uint64(val))
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment]
+//   [OVERFLOW WRAP|SAT|FAIL] ...
+// 先解析完所有子命令再执行, 有语法错误时什么都不改
+func bitfield(db *DB, args [][]byte, readOnly bool) (redis.Reply, *extra) {
+	key := string(args[0])
+	type subCommand struct {
+		op       string
+		t        *bitfieldType
+		offset   int64
+		value    int64
+		overflow string
+	}
+	subCommands := make([]*subCommand, 0)
+	overflow := "WRAP"
+	for i := 1; i < len(args); {
+		op := strings.ToUpper(string(args[i]))
+		switch op {
+		case "OVERFLOW":
+			if readOnly {
+				return reply.MakeErrReply("ERR BITFIELD_RO only supports the GET subcommand"), nil
+			}
+			if i+1 >= len(args) {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			overflow = strings.ToUpper(string(args[i+1]))
+			if overflow != "WRAP" && overflow != "SAT" && overflow != "FAIL" {
+				return reply.MakeErrReply("ERR Invalid OVERFLOW type specified"), nil
+			}
+			i += 2
+		case "GET", "SET", "INCRBY":
+			if readOnly && op != "GET" {
+				return reply.MakeErrReply("ERR BITFIELD_RO only supports the GET subcommand"), nil
+			}
+			argNum := 3
+			if op != "GET" {
+				argNum = 4
+			}
+			if i+argNum > len(args) {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			t, errReply := parseBitfieldType(args[i+1])
+			if errReply != nil {
+				return errReply, nil
+			}
+			offset, errReply := parseBitfieldOffset(args[i+2], t)
+			if errReply != nil {
+				return errReply, nil
+			}
+			sub := &subCommand{
+				op:       op,
+				t:        t,
+				offset:   offset,
+				overflow: overflow,
+			}
+			if op != "GET" {
+				value, err := strconv.ParseInt(string(args[i+3]), 10, 64)
+				if err != nil {
+					return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+				}
+				sub.value = value
+			}
+			subCommands = append(subCommands, sub)
+			i += argNum
+		default:
+			return &reply.SyntaxErrReply{}, nil
+		}
+	}
+
+	bm, errReply := db.getAsBitMap(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	results := make([]redis.Reply, len(subCommands))
+	changed := false
+	for i, sub := range subCommands {
+		old := sub.t.get(bm, sub.offset)
+		switch sub.op {
+		case "GET":
+			results[i] = reply.MakeIntReply(old)
+		case "SET":
+			val, ok := sub.t.handleOverflow(big.NewInt(sub.value), sub.overflow)
+			if !ok {
+				results[i] = &reply.NullBulkReply{}
+				continue
+			}
+			sub.t.set(&bm, sub.offset, val)
+			changed = true
+			results[i] = reply.MakeIntReply(old)
+		case "INCRBY":
+			sum := new(big.Int).Add(big.NewInt(old), big.NewInt(sub.value))
+			val, ok := sub.t.handleOverflow(sum, sub.overflow)
+			if !ok {
+				results[i] = &reply.NullBulkReply{}
+				continue
+			}
+			sub.t.set(&bm, sub.offset, val)
+			changed = true
+			results[i] = reply.MakeIntReply(val)
+		}
+	}
+	if !changed {
+		return reply.MakeMultiRawReply(results), nil
+	}
+	db.PUT(key, &DataEntity{
+		Data: bm,
+	})
+	return reply.MakeMultiRawReply(results), persistAsIs
+}
+
+func BitField(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return bitfield(db, args, false)
+}
+
+// 只有GET, 不会修改
+func BitFieldRO(db *DB, args [][]byte) redis.Reply {
+	result, _ := bitfield(db, args, true)
+	return result
+}
@@ -0,0 +1,359 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	BLPOP/BRPOP/BLMOVE/BRPOPLPUSH
+	list为空时client挂在 db.blockKeys 里每个key的队列上, 同时 client.blockKeys 记下这些key,
+	一但某个key被push, 按先来后到服务队列里的client, 然后通过client.blockKeys把它从其余key的队列里删掉
+	阻塞期间Exec直接返回NoReply, 结果之后由服务它的协程(或超时)写回client
+ */
+
+type blockRequest struct {
+	conn    redis.Connection
+	cmdName string
+	keys    []string
+	// 从哪一端pop
+	fromLeft bool
+	// BLMOVE/BRPOPLPUSH 要把元素push到destination
+	isMove      bool
+	destination string
+	toLeft      bool
+
+	// 超时任务在时间轮里的key, 没有超时时间时为空
+	timeoutTask string
+	// 已经被服务或者超时了, 由blockMu保护
+	done bool
+}
+
+// 解析阻塞命令的参数, args 包含命令名
+func parseBlockRequest(args [][]byte) (*blockRequest, time.Duration, reply.ErrorReply) {
+	cmdName := strings.ToLower(string(args[0]))
+	req := &blockRequest{
+		cmdName: cmdName,
+	}
+	switch cmdName {
+	case "blpop", "brpop":
+		req.fromLeft = cmdName == "blpop"
+		req.keys = make([]string, len(args)-2)
+		for i := 1; i < len(args)-1; i++ {
+			req.keys[i-1] = string(args[i])
+		}
+	case "blmove":
+		var ok bool
+		if req.fromLeft, ok = parseDirection(args[3]); !ok {
+			return nil, 0, &reply.SyntaxErrReply{}
+		}
+		if req.toLeft, ok = parseDirection(args[4]); !ok {
+			return nil, 0, &reply.SyntaxErrReply{}
+		}
+		req.isMove = true
+		req.keys = []string{string(args[1])}
+		req.destination = string(args[2])
+	case "brpoplpush":
+		req.isMove = true
+		req.fromLeft = false
+		req.toLeft = true
+		req.keys = []string{string(args[1])}
+		req.destination = string(args[2])
+	}
+
+	seconds, err := strconv.ParseFloat(string(args[len(args)-1]), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return nil, 0, reply.MakeErrReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return nil, 0, reply.MakeErrReply("ERR timeout is negative")
+	}
+	return req, time.Duration(seconds * float64(time.Second)), nil
+}
+
+// 超时或者不能阻塞时的返回值
+func (req *blockRequest) nullReply() redis.Reply {
+	if req.isMove {
+		return &reply.NullBulkReply{}
+	}
+	return &reply.NullMultiBulkReply{}
+}
+
+// 按key的顺序尝试一次, 调用者要锁住相关的key
+// 所有list都为空时返回false, 成功时extra是AOF里记录的LMOVE/LPOP/RPOP
+func (db *DB) tryServe(req *blockRequest) (redis.Reply, *extra, bool) {
+	for _, key := range req.keys {
+		list, errReply := db.getList(key)
+		if errReply != nil {
+			return errReply, nil, true
+		}
+		if list == nil {
+			continue
+		}
+
+		if req.isMove {
+			val, errReply := db.move(key, req.destination, req.fromLeft, req.toLeft)
+			if errReply != nil {
+				return errReply, nil, true
+			}
+			return reply.MakeBulkReply(val), persistAs(makeAofCmd("lmove", [][]byte{[]byte(key),
+				[]byte(req.destination), directionBytes(req.fromLeft), directionBytes(req.toLeft)})), true
+		}
+
+		var val interface{}
+		cmdName := "lpop"
+		if req.fromLeft {
+			val = list.Lpop()
+		} else {
+			val = list.Rpop()
+			cmdName = "rpop"
+		}
+		db.removeIfEmptyList(key, list)
+		return reply.MakeMultiBulkReply([][]byte{[]byte(key), val.([]byte)}),
+			persistAs(makeAofCmd(cmdName, [][]byte{[]byte(key)})), true
+	}
+	return nil, nil, false
+}
+
+func directionBytes(left bool) []byte {
+	if left {
+		return []byte("LEFT")
+	}
+	return []byte("RIGHT")
+}
+
+// 没有连接时(AOF重放, 以后的事务和脚本里)阻塞命令只尝试一次, 和超时一样返回nil
+func execBlockingOnce(db *DB, cmdName string, args [][]byte) (redis.Reply, *extra) {
+	cmdLine := append([][]byte{[]byte(cmdName)}, args...)
+	req, _, errReply := parseBlockRequest(cmdLine)
+	if errReply != nil {
+		return errReply, nil
+	}
+	result, ex, ok := db.tryServe(req)
+	if !ok {
+		return req.nullReply(), nil
+	}
+	return result, ex
+}
+
+func BLPop(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return execBlockingOnce(db, "blpop", args)
+}
+
+func BRPop(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return execBlockingOnce(db, "brpop", args)
+}
+
+func BLMove(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return execBlockingOnce(db, "blmove", args)
+}
+
+func BRPopLPush(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return execBlockingOnce(db, "brpoplpush", args)
+}
+
+// 有连接时的阻塞命令
+// 先尝试一次, 不成功就挂起, 挂起要在key的锁里完成, 否则可能错过中间的push
+func (db *DB) execBlocking(c redis.Connection, command *command, args [][]byte) redis.Reply {
+	req, timeout, errReply := parseBlockRequest(args)
+	if errReply != nil {
+		return errReply
+	}
+	keys := command.keys(args)
+	db.Locks(keys...)
+	defer db.UnLocks(keys...)
+
+	result, ex, ok := db.tryServe(req)
+	if ok {
+		db.persist(args, ex)
+		db.touchKeys(keys...)
+		return result
+	}
+	db.block(c, req, timeout)
+	return &reply.NoReply{}
+}
+
+func (db *DB) block(c redis.Connection, req *blockRequest, timeout time.Duration) {
+	db.blockMu.Lock()
+	defer db.blockMu.Unlock()
+
+	req.conn = c
+	for _, key := range req.keys {
+		db.blockKeys[key] = append(db.blockKeys[key], req)
+	}
+	c.SetBlockKeys(req.keys)
+	if timeout > 0 {
+		req.timeoutTask = fmt.Sprintf("block:%p", req)
+		db.timeWheel.Delay(timeout, req.timeoutTask, func() {
+			db.blockTimeout(req)
+		})
+	}
+}
+
+// 把req从它所有key的队列里删掉, 调用者持有blockMu
+// 这时client还是阻塞状态, 回复写完之后再调用 conn.SetBlockKeys(nil) 放开它
+func (db *DB) unregisterBlocked(req *blockRequest) {
+	req.done = true
+	db.cancelBlockTimeout(req)
+	for _, key := range req.conn.GetBlockKeys() {
+		// 同一个key可能写了多次(BLPOP a a 0), 要全部删掉
+		waiters := db.blockKeys[key][:0]
+		for _, waiter := range db.blockKeys[key] {
+			if waiter != req {
+				waiters = append(waiters, waiter)
+			}
+		}
+		if len(waiters) == 0 {
+			delete(db.blockKeys, key)
+		} else {
+			db.blockKeys[key] = waiters
+		}
+	}
+}
+
+func (db *DB) cancelBlockTimeout(req *blockRequest) {
+	if req.timeoutTask != "" {
+		db.timeWheel.Cancel(req.timeoutTask)
+	}
+}
+
+// 写回结果然后放开client, client的下一条命令要等这里结束才会执行
+func (req *blockRequest) reply(result redis.Reply) {
+	if result != nil {
+		_ = req.conn.Write(result.ToBytes())
+	}
+	req.conn.SetBlockKeys(nil)
+}
+
+func (db *DB) blockTimeout(req *blockRequest) {
+	db.blockMu.Lock()
+	if req.done {
+		db.blockMu.Unlock()
+		return
+	}
+	db.unregisterBlocked(req)
+	db.blockMu.Unlock()
+	req.reply(req.nullReply())
+}
+
+// push之后调用(调用者持有key的锁), 有client在等这个key就记下来
+func (db *DB) signalKeyAsReady(key string) {
+	db.blockMu.Lock()
+	defer db.blockMu.Unlock()
+	if len(db.blockKeys[key]) == 0 {
+		return
+	}
+	db.readyKeys[key] = true
+}
+
+// 整个数据库的数据换掉之后(SWAPDB)调用, 等待的key可能已经有数据了
+// 先都标记为ready, 服务的时候list还是空的就接着等
+func (db *DB) signalAllBlockedKeys() {
+	db.blockMu.Lock()
+	defer db.blockMu.Unlock()
+	for key := range db.blockKeys {
+		db.readyKeys[key] = true
+	}
+}
+
+// 命令执行完并释放锁之后调用, 按先来后到服务等待ready key的client
+// 服务过程中的push(比如BLMOVE的destination)可能产生新的ready key, 所以要循环
+func (db *DB) handleReadyKeys() {
+	for {
+		db.blockMu.Lock()
+		if len(db.readyKeys) == 0 {
+			db.blockMu.Unlock()
+			return
+		}
+		var key string
+		for key = range db.readyKeys {
+			break
+		}
+		delete(db.readyKeys, key)
+		db.blockMu.Unlock()
+
+		for db.serveFirstWaiter(key) {
+		}
+	}
+}
+
+// 服务key队列里的第一个client, 返回是否还需要继续
+func (db *DB) serveFirstWaiter(key string) bool {
+	db.blockMu.Lock()
+	waiters := db.blockKeys[key]
+	if len(waiters) == 0 {
+		db.blockMu.Unlock()
+		return false
+	}
+	req := waiters[0]
+	db.blockMu.Unlock()
+
+	// 先拿key的锁再拿blockMu, 和其他地方的顺序一致
+	keys := []string{key}
+	if req.isMove {
+		keys = append(keys, req.destination)
+	}
+	db.Locks(keys...)
+	defer db.UnLocks(keys...)
+
+	db.blockMu.Lock()
+	if req.done {
+		// 在拿锁的过程中超时或者断开了, 接着看下一个
+		db.blockMu.Unlock()
+		return true
+	}
+	list, errReply := db.getList(key)
+	if errReply == nil && list == nil {
+		// 又被别人pop空了, 继续等下一次push
+		db.blockMu.Unlock()
+		return false
+	}
+	db.unregisterBlocked(req)
+	db.blockMu.Unlock()
+
+	// 只服务这一个key
+	served := *req
+	served.keys = []string{key}
+	result, ex, _ := db.tryServe(&served)
+	db.persist(nil, ex)
+	db.touchKeys(keys...)
+	req.reply(result)
+	return true
+}
+
+// client 断开连接时调用
+func (db *DB) releaseBlocked(c redis.Connection) {
+	db.blockMu.Lock()
+	defer db.blockMu.Unlock()
+	for _, key := range c.GetBlockKeys() {
+		for _, req := range db.blockKeys[key] {
+			if req.conn == c && !req.done {
+				db.unregisterBlocked(req)
+				c.SetBlockKeys(nil)
+				return
+			}
+		}
+	}
+}
+
+// 关闭DB时放开所有阻塞的client, 连接已经由handler关闭了, 不再回复
+func (db *DB) releaseAllBlocked() {
+	db.blockMu.Lock()
+	defer db.blockMu.Unlock()
+	for _, waiters := range db.blockKeys {
+		for _, req := range waiters {
+			if !req.done {
+				req.done = true
+				db.cancelBlockTimeout(req)
+				req.conn.SetBlockKeys(nil)
+			}
+		}
+	}
+	db.blockKeys = make(map[string][]*blockRequest)
+	db.readyKeys = make(map[string]bool)
+}
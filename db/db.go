@@ -14,21 +14,36 @@
 package db
 
 import (
-	"container/list"
 	"fmt"
-	"os"
+	"redis.simple/datastruct/bitmap"
 	"redis.simple/datastruct/dict"
+	List "redis.simple/datastruct/list"
 	"redis.simple/datastruct/lock"
+	"redis.simple/datastruct/set"
+	SortedSet "redis.simple/datastruct/sortedset"
+	"redis.simple/interface/redis"
 	"redis.simple/lib/logger"
+	"redis.simple/lib/timewheel"
 	"redis.simple/redis/reply"
-	"redis.simple/pubsub"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	dataDictSize = 1 << 16
+	ttlDictSize  = 1 << 10
+	lockerSize   = 128
+	aofQueueSize = 1 << 16
+)
+
+// 一个数据库, MultiDB 里有 databases 个, 按下标区分
+// 阻塞的client也是按数据库记录的, 只会被同一个数据库里的push唤醒
 type DB struct {
+	index int
 	// 存储
 	Data dict.Dict
 	TTLMap dict.Dict
@@ -36,79 +51,109 @@ type DB struct {
 	SubMap dict.Dict
 
 	// 这是用来存放list中block的key的
-	blockKeys map[string][]*server.Client		// map { "key" => []server }
+	blockKeys map[string][]*blockRequest		// map { "key" => []blockRequest } 先来的在前
+	// 被push之后有client在等待的key, 命令执行完(锁释放之后)再去服务这些client
+	readyKeys map[string]bool
+	// 保护blockKeys和readyKeys, 加锁顺序是先key的锁再blockMu
+	blockMu sync.Mutex
 	Locker *lock.Locks
 
-	// TimerTask interval
-	interval time.Duration
+	// 过期删除的key的个数(包括惰性删除), 用atomic读写
+	expiredKeys int64
+	// Data里所有key估计占用的内存, 用atomic读写
+	usedMemory int64
+	// 到期删除key和阻塞命令的超时, 为nil时(AOF重写用的临时DB)不设置定时任务
+	timeWheel *timewheel.TimeWheel
 
 	stopWorld sync.WaitGroup
 
-	hub *pubsub.Hub
-
-
-	// 命令发送介质(将需要记录的命令发送过去）
-	aofChan chan *reply.MultiBulkReply
-	// append file 文件描述符
-	aofFile *os.File
-
-	aofFilename string
+	// 被WATCH的key的版本号, 只记录有client在WATCH的key, key被修改时版本号加一
+	watchMu sync.Mutex
+	watched map[string]*keyVersion
+	// watched 里key的个数, 用atomic读, 没有key被WATCH时写命令不用拿watchMu
+	watchedNum int32
 
-	// 重写chan 通知主协程(处理协程)稍加改变写到缓冲去
-	aofRewriteChan chan *reply.MultiBulkReply
-	// 暂停操作
-	pausingAof sync.RWMutex
+	// 把命令交给MultiDB写入AOF, 会带上数据库的下标; 为nil时不记录(AOF重放和重写用的临时DB)
+	addAof func(*reply.MultiBulkReply)
+	// MultiDB的txMu, 时间轮里的过期删除不经过Exec, 要自己拿读锁, 免得和FLUSHDB、SWAPDB换Data同时进行; 临时DB为nil
+	txMu *sync.RWMutex
 }
 
+// 写命令执行函数返回的AOF信息, 为nil和toPersist为false一样, 不写AOF
 type extra struct {
 	// 是否需要持久化 比如失败的命令就不需要了
 	toPersist bool
-	// 持久化的特殊信息
+	// 持久化的特殊信息, 为空时原样记录命令
+	// 结果不确定(SPOP)或者和执行的时间有关(SET EX)的命令在这里换成重放时结果一样的命令
 	specialAof []*reply.MultiBulkReply
+}
 
+// DataEntity 是存放在Data里的value, Data 是具体类型的结构
+// 比如 []byte, *list.LinkedList, *set.Set 等
+type DataEntity struct {
+	Data interface{}
+
+	// 估计占用的内存(包括key), 由key的锁保护, 放进Data和被写命令修改之后重新估计
+	memory int64
+	// 最后一次访问的时间(毫秒), LRU淘汰用, atomic读写
+	accessTime int64
+	// LFU的对数计数器和上次衰减的时间(分钟), atomic读写
+	lfuCounter  uint32
+	lfuDecrTime uint32
 }
 
-var router = MakeRouter()
+// 实现dict.Entity, 根据Data的具体类型返回类型标记
+func (entity *DataEntity) Type() uint8 {
+	switch entity.Data.(type) {
+	case []byte:
+		return dict.STRING
+	case bitmap.BitMap:
+		return dict.BITMAP
+	case *List.LinkedList:
+		return dict.LIST
+	case dict.Dict:
+		return dict.HASH
+	case *set.Set:
+		return dict.SET
+	case *SortedSet.SortedSet:
+		return dict.ZSET
+	}
+	return dict.STRING
+}
 
-func MakeDB() *DB {
-	db := &DB{
+// 在init里初始化, EVAL 的执行函数最终又会用到router, 直接初始化会有初始化循环
+var router map[string]*command
+
+func init() {
+	router = MakeRouter()
+}
+
+func makeDB(index int) *DB {
+	return &DB{
+		index: index,
 		Data: dict.MakeConcurrent(dataDictSize),
 		TTLMap: dict.MakeConcurrent(ttlDictSize),
 		Locker: lock.Make(lockerSize),
-		interval: 5 * time.Second,
-		hub: pubsub.MakeHub(),
+		timeWheel: timewheel.Default,
+		blockKeys: make(map[string][]*blockRequest),
+		readyKeys: make(map[string]bool),
+		watched: make(map[string]*keyVersion),
 	}
-
-	if cofig.Properties.AppendOnly {
-		db.aofFilename = config.Properties.AppendFilename
-		db.loadAof(0)
-		aofFile, err := os.Open(db.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-		if err != nil {
-			logger.Warn(err)
-		} else {
-			db.aofFile = aofFile
-			db.aofChan = make(chan *reply.MultiBulkReply, aofQueueSize)
-		}
-		go func() {
-			db.HandleAof()  // Aof主协程(里边在重写时开启另一个协程?是不是?)
-		}()
-	}
-
-	// start timer worker
-	db.TimerTask()
-	return db
 }
 
-func (db *DB)Close() {
-	if db.aofFile != nil {
-		err := db.aofFile.Close()
-		if err != nil {
-			logger.Warn(err)
-		}
+// AOF重写时用来重放旧AOF的DB, 只有一个协程访问, 用不加锁的SimpleDict
+func makeTmpDB(index int) *DB {
+	return &DB{
+		index: index,
+		Data: dict.MakeSimple(),
+		TTLMap: dict.MakeSimple(),
+		Locker: lock.Make(lockerSize),
+		blockKeys: make(map[string][]*blockRequest),
+		readyKeys: make(map[string]bool),
+		watched: make(map[string]*keyVersion),
 	}
 }
 
-
 func (db *DB)Exec(c redis.Connection, args [][]byte) (result redis.Reply) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -117,42 +162,44 @@ func (db *DB)Exec(c redis.Connection, args [][]byte) (result redis.Reply) {
 		}
 	}()
 
+	// 订阅、SELECT、事务和跨数据库的命令已经由MultiDB处理了, 这里只有单个数据库里的命令
 	cmd := strings.ToLower(string(args[0]))
-
-	// 先处理特殊命令
-	if cmd == "subscribe" {
-		if len(args) < 2 {
-			return &reply.ArgNumErrReply{Cmd: "subscribe"}
-		}
-		return pubsub.Subscribe(db.hub, c, args[1:])
-	} else if cmd == "publish" {
-		return pubsub.Publish(db.hub, args[1:])
-	} else if cmd == "unsubscribe" {
-		return pubsub.UnSubscribe(db.hub, c, args[1:])
-	} else if cmd == "bgrewriteaof" {
-		reply := BGRewriteAOF(db, args[1:])
-		return reply
+	command, ok := router[cmd]
+	if !ok || command.isMultiDB() {
+		return reply.MakeErrReply("ERR unknown command '" + cmd + "'")
 	}
-
-
-	// normal cmd
-	cmdFunc, ok := router[cmd]
-	if !ok {
-		return reply.MakeErrReply("Err unknown command '" + cmd + "'")
+	// 参数个数在执行之前就检查, 执行函数里不必再判断
+	if !command.validateArity(args) {
+		return &reply.ArgNumErrReply{Cmd: cmd}
 	}
-	if len(args) > 1 {
-		result = cmdFunc(db, args[1:])
+	if command.isBlocking() && c != nil {
+		result = db.execBlocking(c, command, args)
 	} else {
-		// 不需要参数
-		result = cmdFunc(db, [][]byte{})
+		result = db.execWithLock(command, args)
 	}
 
-	// 这里本该得到是否成功然后aof的
-	// TODO
-
+	// 锁已经释放了, 这时再去服务被push唤醒的阻塞client
+	if command.isWrite() {
+		db.handleReadyKeys()
+	}
 	return
 }
 
+// 按命令表里key的位置统一加锁, 多key命令(MSET等)因此是原子的
+// 执行函数里不要再对这些key加锁, AOF也在释放锁之前写入
+func (db *DB)execWithLock(command *command, args [][]byte) redis.Reply {
+	keys := command.keys(args)
+	if command.isWrite() {
+		db.Locks(keys...)
+		defer db.UnLocks(keys...)
+		defer db.touchKeys(keys...)
+	} else {
+		db.RLocks(keys...)
+		defer db.RUnLocks(keys...)
+	}
+	return command.execute(db, args)
+}
+
 
 // 具体方法
 // Data access
@@ -161,6 +208,22 @@ func (db *DB)GET(key string) (*DataEntity, bool) {
 	// 为什么只有wait而没有Done呢
 	db.stopWorld.Wait()
 
+	if db.IsExpired(key) {
+		return nil, false
+	}
+	raw, ok := db.Data.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entity, _ := raw.(*DataEntity)
+	entity.updateAccess(time.Now())
+	return entity, true
+}
+
+// 和GET一样, 但是不算一次访问, 不改变LRU/LFU的信息(OBJECT IDLETIME 这类命令用)
+func (db *DB)peek(key string) (*DataEntity, bool) {
+	db.stopWorld.Wait()
+
 	if db.IsExpired(key) {
 		return nil, false
 	}
@@ -174,39 +237,71 @@ func (db *DB)GET(key string) (*DataEntity, bool) {
 
 func (db *DB)PUT(key string, entity *DataEntity) int {
 	db.stopWorld.Wait()
-	return db.Data.Put(key, entity)
+	old, _ := db.Data.Get(key)
+	result := db.Data.Put(key, entity, entity.Type())
+	db.replaceMemory(key, old, entity)
+	return result
 }
 
 // PutIfExists是指只有存在才放进去
+// 已经过期的key当作不存在
 func (db *DB)PutIfExists(key string, entity *DataEntity) int {
 	db.stopWorld.Wait()
-	return db.Data.PutIfExists(key, entity)
+	if db.IsExpired(key) {
+		return 0
+	}
+	old, _ := db.Data.Get(key)
+	result := db.Data.PutIfExists(key, entity, entity.Type())
+	if result > 0 {
+		db.replaceMemory(key, old, entity)
+	}
+	return result
 }
 
 func (db *DB)PUTIfAbsent(key string, entity *DataEntity) int {
 	db.stopWorld.Wait()
-	return db.Data.PutIfAbsent(key, entity)
+	db.IsExpired(key)
+	result := db.Data.PutIfAbsent(key, entity, entity.Type())
+	if result > 0 {
+		db.replaceMemory(key, nil, entity)
+	}
+	return result
 }
 
-func (db *DB)Remove(key string) {
+// 返回key是不是这次删掉的
+// 惰性删除过期key时只持有读锁, 几个协程可能同时删同一个key, 只有真正删掉的那个减去它的内存
+func (db *DB)Remove(key string) bool {
 	db.stopWorld.Wait()
-	db.Data.Remove(key)
+	old, _ := db.Data.Get(key)
+	removed := db.Data.Remove(key) > 0
+	if removed {
+		db.replaceMemory(key, old, nil)
+	}
 	db.TTLMap.Remove(key)
+	db.cancelExpireTask(key)
+	return removed
 }
 
 func (db *DB)Removes(keys ...string) (deleted int) {
 	db.stopWorld.Wait()
 	deleted = 0
 	for _, key := range keys {
-		if _, exists := db.Data.GET(key); exists {
+		// 已经过期的key当作不存在, IsExpired会顺便删掉它
+		if db.IsExpired(key) {
+			continue
+		}
+		if old, exists := db.Data.Get(key); exists {
+			db.replaceMemory(key, old, nil)
 			db.Data.Remove(key)
 			db.TTLMap.Remove(key)
+			db.cancelExpireTask(key)
 			deleted++
 		}
 	}
 	return deleted
 }
 
+// 调用者独占MultiDB(flagExclusive), 没有别的命令或者过期删除在访问Data
 func (db *DB)Flush() {
 	// Flush 时不能操作
 	db.stopWorld.Add(1)
@@ -214,7 +309,10 @@ func (db *DB)Flush() {
 
 	db.Data = dict.MakeConcurrent(dataDictSize)
 	db.TTLMap = dict.MakeConcurrent(ttlDictSize)
-	db.Locker = lock.Make(lockerSize)
+	atomic.StoreInt64(&db.usedMemory, 0)
+	db.touchAllKeys()
+	// 时间轮里的删除任务不一个个取消了, 到时间检查TTLMap发现没有过期时间就什么也不做
+	// Locker不能换, 其他命令可能正持有着旧的锁, 换掉之后它们会去解锁新的锁
 }
 
 // ---- Lock Function ---
@@ -252,18 +350,49 @@ func (db *DB) RUnLocks(keys ...string) {
 	db.Locker.RUnLocks(keys...)
 }
 
+func (db *DB) RWLocks(writeKeys []string, readKeys []string) {
+	db.Locker.RWLocks(writeKeys, readKeys)
+}
+
+func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
+	db.Locker.RWUnLocks(writeKeys, readKeys)
+}
+
 // --- TTL Functions ---
 // 怎么实现过期(静态还是动态?)
 // 1.开启一个计时器协程(即使这样，操作时还是要再看一次是否过期)
 // 2.操作时删除过期key
+// 现在几种一起用: 时间轮到期删除, 访问时检查(IsExpired), 再加上定时抽样(CleanExpired)兜底
+// 时间轮是所有数据库共用的, 任务的key要带上数据库的下标
+func (db *DB)genExpireTask(key string) string {
+	return "expire:" + strconv.Itoa(db.index) + ":" + key
+}
+
 func (db *DB)Expire(key string, expireTime time.Time) {
 	db.stopWorld.Wait()
-	db.TTLMap.Put(key, expireTime)
+	db.TTLMap.Put(key, expireTime, dict.STRING)
+	if db.timeWheel != nil {
+		db.timeWheel.At(expireTime, db.genExpireTask(key), func() {
+			if db.txMu != nil {
+				db.txMu.RLock()
+				defer db.txMu.RUnlock()
+			}
+			// 执行的时候过期时间可能已经改了, expireIfNeeded会在锁里再检查一次
+			db.expireIfNeeded(key, time.Now())
+		})
+	}
 }
 
 func (db *DB)Persist(key string) {
 	db.stopWorld.Wait()
 	db.TTLMap.Remove(key)
+	db.cancelExpireTask(key)
+}
+
+func (db *DB)cancelExpireTask(key string) {
+	if db.timeWheel != nil {
+		db.timeWheel.Cancel(db.genExpireTask(key))
+	}
 }
 
 func (db *DB)IsExpired(key string) bool {
@@ -273,47 +402,69 @@ func (db *DB)IsExpired(key string) bool {
 	}
 	expireTime, _ := rawExpireTime.(time.Time)
 	expired := time.Now().After(expireTime)
-	if expired {
-		db.Remove(key)
+	if expired && db.Remove(key) {
+		// 几个持有读锁的协程同时发现过期时, 只有真正删掉key的那个计数
+		db.touchKeys(key)
+		atomic.AddInt64(&db.expiredKeys, 1)
 	}
 	return expired
 }
 
-// 难道说两种结合吗(定时使用CleanExpired函数进行清除)
-func (db *DB)CleanExpired() {
-	now := time.Now()
-	// 因为foreach无法删除遍历中的key，所以要找一个集合暂时存储起来
-	// 这个集合还不能有大小限制(要么使用链表，要么先放进切片后append)
-	toRemve := list.List{}
-	db.TTLMap.ForEach(func(key string, val interface{}) bool {
-		expireTime, _ := val.(time.Time)
-		if now.After(expireTime) {
-			db.Data.Remove(key)
-			toRemve.PushBack(key)
-		}
-		return true
-	})
-	for p := toRemve.Front(); p != nil; p = p.Next() {
-		db.TTLMap.Remove(p.Value.(string))
+/*
+	只靠访问时删除(惰性删除)的话, 不再访问的过期key会一直占着内存
+	所以和redis一样再加一个主动过期: 每个周期从TTLMap里随机取一批key, 删掉其中过期的
+	如果这一批里过期的比例超过阈值, 说明过期的key还很多, 接着取下一批
+	每个周期有时间限制(由MultiDB分给各个数据库), 避免过期key很多的时候长时间占着锁
+ */
+const (
+	// 每一批取的key的个数
+	activeExpireKeysPerLoop = 20
+	// 一批里过期的key不超过这个百分比就结束
+	activeExpireAcceptableStale = 10
+)
+
+// 在key的锁里再检查一次, 避免删掉正在被命令修改(比如刚刚PERSIST)的key
+func (db *DB)expireIfNeeded(key string, now time.Time) bool {
+	db.Lock(key)
+	defer db.UnLock(key)
+	if !db.expiredAt(key, now) || !db.Remove(key) {
+		return false
 	}
+	db.touchKeys(key)
+	atomic.AddInt64(&db.expiredKeys, 1)
+	return true
 }
 
-// 每隔interval秒clean一次
-func (db *DB)Timertask() {
-	ticker := time.NewTicker(db.interval)
-	go func() {
-		for range ticker.C {
-			db.CleanExpired()
+// 对这个数据库做主动过期直到过期比例降下来, 超过deadline时 timedOut 为true
+func (db *DB)CleanExpired(deadline time.Time) (sampled int, expired int, timedOut bool) {
+	for {
+		num := db.TTLMap.Len()
+		if num == 0 {
+			return
 		}
-	}()
-}
+		if num > activeExpireKeysPerLoop {
+			num = activeExpireKeysPerLoop
+		}
+		now := time.Now()
+		keys := db.TTLMap.RandomKeys(num)
+		loopExpired := 0
+		for _, key := range keys {
+			if db.expireIfNeeded(key, now) {
+				loopExpired++
+			}
+		}
+		sampled += len(keys)
+		expired += loopExpired
 
-func (db *DB)AfterClientClose(c redis.Connection) {
-	pubsub.UnsubscribeAll(db.hub, c)
+		if time.Now().After(deadline) {
+			return sampled, expired, true
+		}
+		if loopExpired*100 <= len(keys)*activeExpireAcceptableStale {
+			return
+		}
+	}
 }
 
-
-
-
-
-
+func (db *DB)ExpiredKeys() int64 {
+	return atomic.LoadInt64(&db.expiredKeys)
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"redis.simple/config"
+	"redis.simple/datastruct/dict"
+	"redis.simple/redis/reply"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	maxmemory: 写命令执行之前如果估计的内存超过上限, 按 maxmemory-policy 淘汰key直到低于上限
+	和redis一样是近似的: 每个数据库随机取 maxmemory-samples 个key, 淘汰其中最合适的一个, 不维护全局的LRU链表
+	volatile-* 只从有过期时间的key里选, 没有可以淘汰的key或者策略是noeviction时写命令返回OOM
+	淘汰的key和过期一样写一条DEL到AOF
+ */
+
+const (
+	evictLRU = iota
+	evictLFU
+	evictTTL
+	evictRandom
+)
+
+type evictionPolicy struct {
+	kind int
+	// 只淘汰有过期时间的key
+	volatile bool
+}
+
+var evictionPolicies = map[string]evictionPolicy{
+	"allkeys-lru":     {kind: evictLRU},
+	"allkeys-lfu":     {kind: evictLFU},
+	"allkeys-random":  {kind: evictRandom},
+	"volatile-lru":    {kind: evictLRU, volatile: true},
+	"volatile-lfu":    {kind: evictLFU, volatile: true},
+	"volatile-random": {kind: evictRandom, volatile: true},
+	"volatile-ttl":    {kind: evictTTL, volatile: true},
+}
+
+var delCmd = []byte("DEL")
+
+// 写命令执行之前检查内存, 调用者持有txMu(读锁或写锁)
+// DEL这类只会减少内存的命令(flagAllowOOM)不检查
+func (mdb *MultiDB) checkMemory(command *command) reply.ErrorReply {
+	if config.Properties.MaxMemory <= 0 || !command.isWrite() || command.isAllowOOM() {
+		return nil
+	}
+	return mdb.freeMemoryIfNeeded()
+}
+
+// 淘汰key直到内存低于maxmemory, 淘汰不了时返回OOM
+func (mdb *MultiDB) freeMemoryIfNeeded() reply.ErrorReply {
+	maxMemory := config.Properties.MaxMemory
+	if maxMemory <= 0 {
+		return nil
+	}
+	policy, ok := evictionPolicies[strings.ToLower(config.Properties.MaxMemoryPolicy)]
+	for mdb.UsedMemory() > maxMemory {
+		// noeviction 和不认识的策略都不淘汰
+		if !ok || !mdb.evictOne(policy) {
+			return reply.MakeErrReply("OOM command not allowed when used memory > 'maxmemory'.")
+		}
+	}
+	return nil
+}
+
+// 淘汰的候选, score 越大越应该被淘汰
+type evictCandidate struct {
+	db    *DB
+	key   string
+	score float64
+}
+
+// 选出一个key淘汰, 没有可以淘汰的key时返回false
+func (mdb *MultiDB) evictOne(policy evictionPolicy) bool {
+	var candidate *evictCandidate
+	if policy.kind == evictRandom {
+		candidate = mdb.randomCandidate(policy.volatile)
+	} else {
+		candidate = mdb.sampleCandidate(policy)
+	}
+	if candidate == nil {
+		return false
+	}
+	mdb.evict(candidate.db, candidate.key)
+	return true
+}
+
+func evictionDict(db *DB, volatile bool) dict.Dict {
+	if volatile {
+		return db.TTLMap
+	}
+	return db.Data
+}
+
+// 和redis一样从上次的下一个数据库开始, 不总是淘汰0号数据库
+func (mdb *MultiDB) randomCandidate(volatile bool) *evictCandidate {
+	dbNum := len(mdb.dbSet)
+	start := int(atomic.AddInt32(&mdb.evictCursor, 1))
+	for i := 0; i < dbNum; i++ {
+		db := mdb.dbSet[(start+i)%dbNum]
+		keys := evictionDict(db, volatile).RandomKeys(1)
+		if len(keys) > 0 {
+			return &evictCandidate{db: db, key: keys[0]}
+		}
+	}
+	return nil
+}
+
+// 每个数据库抽样maxmemory-samples个key, 返回所有样本里score最大的
+func (mdb *MultiDB) sampleCandidate(policy evictionPolicy) *evictCandidate {
+	samples := config.Properties.MaxMemorySamples
+	if samples <= 0 {
+		samples = memorySamples
+	}
+	now := time.Now()
+	var best *evictCandidate
+	for _, db := range mdb.dbSet {
+		pool := evictionDict(db, policy.volatile)
+		if pool.Len() == 0 {
+			continue
+		}
+		for _, key := range pool.RandomDistinctKeys(samples) {
+			score, ok := db.evictScore(policy, key, now)
+			if ok && (best == nil || score > best.score) {
+				best = &evictCandidate{db: db, key: key, score: score}
+			}
+		}
+	}
+	return best
+}
+
+// 没有加锁, 只读atomic的访问信息, 选错了也只是淘汰得不那么准确
+func (db *DB) evictScore(policy evictionPolicy, key string, now time.Time) (float64, bool) {
+	if policy.kind == evictTTL {
+		raw, ok := db.TTLMap.Get(key)
+		if !ok {
+			return 0, false
+		}
+		// 越早过期越先淘汰
+		expireAt, _ := raw.(time.Time)
+		return -float64(expireAt.UnixNano() / 1e6), true
+	}
+	raw, ok := db.Data.Get(key)
+	if !ok {
+		return 0, false
+	}
+	entity, _ := raw.(*DataEntity)
+	if policy.kind == evictLFU {
+		return float64(255 - entity.lfuDecr(now)), true
+	}
+	return float64(entity.idleTime(now)), true
+}
+
+func (mdb *MultiDB) evict(db *DB, key string) {
+	db.Lock(key)
+	defer db.UnLock(key)
+	// 抽样之后key可能已经被删了
+	if _, ok := db.Data.Get(key); !ok {
+		return
+	}
+	db.Remove(key)
+	db.touchKeys(key)
+	atomic.AddInt64(&mdb.evictedKeys, 1)
+	db.AddAof(reply.MakeMultiBulkReply([][]byte{delCmd, []byte(key)}))
+}
+
+func (mdb *MultiDB) EvictedKeys() int64 {
+	return atomic.LoadInt64(&mdb.evictedKeys)
+}
@@ -0,0 +1,654 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/yuin/gopher-lua"
+	"hash/crc64"
+	"redis.simple/interface/redis"
+	"redis.simple/lib/wildcard"
+	"redis.simple/redis/reply"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	FUNCTION LOAD/LIST/DELETE/FLUSH/DUMP/RESTORE, FCALL/FCALL_RO 的执行在script.go
+	库的代码以 #!lua name=<库名> 开头, 加载时执行一遍代码, 用 redis.register_function 注册函数
+	函数名在所有库里唯一, 库只能整个替换或删除
+	FUNCTION 的写操作按原样记录到AOF, 重写AOF时每个库写成一条 FUNCTION LOAD
+ */
+
+const (
+	functionEngine = "LUA"
+	// DUMP 的格式版本, 和payload一起做校验
+	functionDumpVersion = 1
+)
+
+var functionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+type luaFunction struct {
+	name     string
+	callback *lua.LFunction
+	// 有no-writes标记的函数可以用FCALL_RO调用, 不能执行写命令
+	noWrites bool
+	flags    []string
+	lib      *functionLib
+}
+
+type functionLib struct {
+	name string
+	code string
+	// 库里的函数都是这个LState里的闭包, FCALL由调用者独占MultiDB, 所以不会并发使用
+	L         *lua.LState
+	functions map[string]*luaFunction
+	// 正在执行的FCALL的状态, 加载库的时候是nil
+	state *scriptState
+}
+
+type functionLibs struct {
+	mu        sync.Mutex
+	libs      map[string]*functionLib
+	functions map[string]*luaFunction
+}
+
+func makeFunctionLibs() *functionLibs {
+	return &functionLibs{
+		libs:      make(map[string]*functionLib),
+		functions: make(map[string]*luaFunction),
+	}
+}
+
+// 解析第一行的 #!lua name=<库名>
+func parseLibraryMeta(code string) (string, reply.ErrorReply) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", reply.MakeErrReply("ERR Missing library metadata")
+	}
+	firstLine := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		firstLine = code[:i]
+	}
+	parts := strings.Fields(strings.TrimSpace(firstLine[2:]))
+	if len(parts) == 0 {
+		return "", reply.MakeErrReply("ERR Missing library metadata")
+	}
+	if strings.ToUpper(parts[0]) != functionEngine {
+		return "", reply.MakeErrReply("ERR Engine '" + parts[0] + "' not found")
+	}
+	name := ""
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "name=") {
+			return "", reply.MakeErrReply("ERR Invalid metadata value given: " + part)
+		}
+		name = part[len("name="):]
+	}
+	if name == "" {
+		return "", reply.MakeErrReply("ERR Library name was not given")
+	}
+	if !functionNamePattern.MatchString(name) {
+		return "", reply.MakeErrReply("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+// 在新的LState里执行库的代码, 收集注册的函数, 还没有放进functionLibs
+func compileLibrary(code string) (*functionLib, reply.ErrorReply) {
+	name, errReply := parseLibraryMeta(code)
+	if errReply != nil {
+		return nil, errReply
+	}
+	lib := &functionLib{
+		name:      name,
+		code:      code,
+		L:         newLuaState(),
+		functions: make(map[string]*luaFunction),
+	}
+	L := lib.L
+	redisTbl := makeRedisTable(L, func() *scriptState {
+		return lib.state
+	})
+	// 只能在加载的时候注册函数
+	loading := true
+	redisTbl.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		if !loading {
+			L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+		}
+		fn, err := lib.registerFunction(L)
+		if err != "" {
+			L.RaiseError(err)
+		}
+		lib.functions[fn.name] = fn
+		return 0
+	}))
+	L.SetGlobal("redis", redisTbl)
+
+	// 去掉第一行, 保留换行让错误信息里的行号不变
+	body := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		body = code[i:]
+	} else {
+		body = ""
+	}
+	fn, err := L.LoadString(body)
+	if err != nil {
+		L.Close()
+		return nil, reply.MakeErrReply("ERR Error compiling function: " + luaErrorMessage(err))
+	}
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	loading = false
+	if err != nil {
+		L.Close()
+		return nil, reply.MakeErrReply("ERR Error registering functions: " + luaErrorMessage(err))
+	}
+	if len(lib.functions) == 0 {
+		L.Close()
+		return nil, reply.MakeErrReply("ERR No functions registered")
+	}
+	return lib, nil
+}
+
+// redis.register_function(name, callback) 或者
+// redis.register_function{function_name=..., callback=..., flags={...}}
+// 出错时返回错误信息
+func (lib *functionLib) registerFunction(L *lua.LState) (*luaFunction, string) {
+	fn := &luaFunction{lib: lib}
+	switch arg := L.Get(1).(type) {
+	case lua.LString:
+		callback, ok := L.Get(2).(*lua.LFunction)
+		if !ok || L.GetTop() != 2 {
+			return nil, "wrong number of arguments to redis.register_function"
+		}
+		fn.name = string(arg)
+		fn.callback = callback
+	case *lua.LTable:
+		if L.GetTop() != 1 {
+			return nil, "wrong number of arguments to redis.register_function"
+		}
+		var errMsg string
+		arg.ForEach(func(k lua.LValue, v lua.LValue) {
+			if errMsg != "" {
+				return
+			}
+			switch k.String() {
+			case "function_name":
+				name, ok := v.(lua.LString)
+				if !ok {
+					errMsg = "function_name argument given to redis.register_function must be a string"
+					return
+				}
+				fn.name = string(name)
+			case "callback":
+				callback, ok := v.(*lua.LFunction)
+				if !ok {
+					errMsg = "callback argument given to redis.register_function must be a function"
+					return
+				}
+				fn.callback = callback
+			case "flags":
+				flags, ok := v.(*lua.LTable)
+				if !ok {
+					errMsg = "flags argument to redis.register_function must be a table representing function flags"
+					return
+				}
+				errMsg = fn.parseFlags(flags)
+			case "description":
+				// 不保存描述
+			default:
+				errMsg = "unknown argument given to redis.register_function"
+			}
+		})
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		if fn.name == "" {
+			return nil, "redis.register_function must get a function name argument"
+		}
+		if fn.callback == nil {
+			return nil, "redis.register_function must get a callback argument"
+		}
+	default:
+		return nil, "calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments)."
+	}
+	if !functionNamePattern.MatchString(fn.name) {
+		return nil, "Function names can only contain letters, numbers, or underscores(_) and must be at least one character long"
+	}
+	if _, ok := lib.functions[fn.name]; ok {
+		return nil, "Function already exists in the library"
+	}
+	return fn, ""
+}
+
+// 只支持no-writes, 其他redis的标记(allow-oom等)记下来但没有作用
+func (fn *luaFunction) parseFlags(flags *lua.LTable) string {
+	for i := 1; i <= flags.Len(); i++ {
+		flag, ok := flags.RawGetInt(i).(lua.LString)
+		if !ok {
+			return "unknown flag given"
+		}
+		switch string(flag) {
+		case "no-writes":
+			fn.noWrites = true
+		case "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys":
+		default:
+			return "unknown flag given"
+		}
+		fn.flags = append(fn.flags, string(flag))
+	}
+	return ""
+}
+
+// 把编译好的库放进来, replace 为true时替换同名的库
+// 函数名和别的库冲突时不做任何修改
+func (libs *functionLibs) add(lib *functionLib, replace bool) reply.ErrorReply {
+	libs.mu.Lock()
+	defer libs.mu.Unlock()
+	old, exists := libs.libs[lib.name]
+	if exists && !replace {
+		return reply.MakeErrReply("ERR Library '" + lib.name + "' already exists")
+	}
+	for name := range lib.functions {
+		if fn, ok := libs.functions[name]; ok && fn.lib != old {
+			return reply.MakeErrReply("ERR Function " + name + " already exists")
+		}
+	}
+	if exists {
+		libs.removeLocked(old)
+	}
+	libs.libs[lib.name] = lib
+	for name, fn := range lib.functions {
+		libs.functions[name] = fn
+	}
+	return nil
+}
+
+// 删除的库不关闭LState, 已经取到函数还没开始执行的FCALL还可以用它
+func (libs *functionLibs) removeLocked(lib *functionLib) {
+	delete(libs.libs, lib.name)
+	for name := range lib.functions {
+		delete(libs.functions, name)
+	}
+}
+
+func (libs *functionLibs) remove(name string) bool {
+	libs.mu.Lock()
+	defer libs.mu.Unlock()
+	lib, ok := libs.libs[name]
+	if !ok {
+		return false
+	}
+	libs.removeLocked(lib)
+	return true
+}
+
+// 库的个数和代码的总长度, MEMORY STATS 用
+func (libs *functionLibs) stats() (int, int64) {
+	libs.mu.Lock()
+	defer libs.mu.Unlock()
+	size := int64(0)
+	for _, lib := range libs.libs {
+		size += int64(len(lib.code))
+	}
+	return len(libs.libs), size
+}
+
+func (libs *functionLibs) flush() {
+	libs.mu.Lock()
+	defer libs.mu.Unlock()
+	libs.libs = make(map[string]*functionLib)
+	libs.functions = make(map[string]*luaFunction)
+}
+
+// 按库名排序, LIST/DUMP/重写AOF的结果是确定的
+func (libs *functionLibs) list() []*functionLib {
+	libs.mu.Lock()
+	defer libs.mu.Unlock()
+	result := make([]*functionLib, 0, len(libs.libs))
+	for _, lib := range libs.libs {
+		result = append(result, lib)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+	return result
+}
+
+// readOnly 为true时(FCALL_RO)只能调用有no-writes标记的函数
+func (libs *functionLibs) getFunction(name string, readOnly bool) (*luaFunction, reply.ErrorReply) {
+	libs.mu.Lock()
+	fn, ok := libs.functions[name]
+	libs.mu.Unlock()
+	if !ok {
+		return nil, reply.MakeErrReply("ERR Function not found")
+	}
+	if readOnly && !fn.noWrites {
+		return nil, reply.MakeErrReply("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	return fn, nil
+}
+
+// 调用者已经锁住了key并且独占了MultiDB
+// 和EVAL不同, KEYS和ARGV作为参数传给函数
+func (mdb *MultiDB) runFunction(dbIndex int, fn *luaFunction, keys [][]byte, argv [][]byte, readOnly bool) redis.Reply {
+	lib := fn.lib
+	L := lib.L
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	state := &scriptState{
+		mdb:      mdb,
+		dbIndex:  dbIndex,
+		run:      &runningScript{cancel: cancel},
+		readOnly: readOnly || fn.noWrites,
+	}
+	lib.state = state
+	defer func() {
+		lib.state = nil
+	}()
+	mdb.scripts.setRunning(state.run)
+	defer mdb.scripts.setRunning(nil)
+
+	L.Push(fn.callback)
+	L.Push(bytesToLuaTable(L, keys))
+	L.Push(bytesToLuaTable(L, argv))
+	return state.result(L, L.PCall(2, 1, nil), fn.name)
+}
+
+// DUMP 的payload: 所有库的代码编码成multi bulk, 后面是2字节的版本和8字节的CRC64, 和redis的DUMP格式类似
+func dumpFunctions(libs []*functionLib) []byte {
+	codes := make([][]byte, len(libs))
+	for i, lib := range libs {
+		codes[i] = []byte(lib.code)
+	}
+	payload := reply.MakeMultiBulkReply(codes).ToBytes()
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, functionDumpVersion)
+	payload = append(payload, buf...)
+	buf = make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, crc64.Checksum(payload, crc64Table))
+	return append(payload, buf...)
+}
+
+// 解析DUMP的payload, 返回所有库的代码
+func parseFunctionDump(payload []byte) ([]string, reply.ErrorReply) {
+	errReply := reply.MakeErrReply("ERR payload version or checksum are wrong")
+	if len(payload) < 10 {
+		return nil, errReply
+	}
+	body, footer := payload[:len(payload)-8], payload[len(payload)-8:]
+	if crc64.Checksum(body, crc64Table) != binary.LittleEndian.Uint64(footer) {
+		return nil, errReply
+	}
+	if binary.LittleEndian.Uint16(body[len(body)-2:]) != functionDumpVersion {
+		return nil, errReply
+	}
+	codes, ok := parseMultiBulk(body[:len(body)-2])
+	if !ok {
+		return nil, errReply
+	}
+	return codes, nil
+}
+
+// 解析完整的一个 *n\r\n$len\r\n...\r\n, 多余的字节也算错误
+func parseMultiBulk(raw []byte) ([]string, bool) {
+	readLine := func() (string, bool) {
+		i := strings.Index(string(raw), "\r\n")
+		if i < 0 {
+			return "", false
+		}
+		line := string(raw[:i])
+		raw = raw[i+2:]
+		return line, true
+	}
+	line, ok := readLine()
+	if !ok || !strings.HasPrefix(line, "*") {
+		return nil, false
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, false
+	}
+	result := make([]string, n)
+	for i := range result {
+		line, ok = readLine()
+		if !ok || !strings.HasPrefix(line, "$") {
+			return nil, false
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size+2 > len(raw) || string(raw[size:size+2]) != "\r\n" {
+			return nil, false
+		}
+		result[i] = string(raw[:size])
+		raw = raw[size+2:]
+	}
+	return result, len(raw) == 0
+}
+
+// FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+// 所有库都编译成功并且没有冲突(包括payload里的库之间)才生效
+func (libs *functionLibs) restore(codes []string, policy string) reply.ErrorReply {
+	restored := make([]*functionLib, 0, len(codes))
+	names := make(map[string]bool)
+	// 函数名 => payload里定义它的库, 和add一样函数名不能重复
+	functions := make(map[string]string)
+	for _, code := range codes {
+		lib, errReply := compileLibrary(code)
+		if errReply != nil {
+			return errReply
+		}
+		if names[lib.name] {
+			return reply.MakeErrReply("ERR Library '" + lib.name + "' already exists")
+		}
+		for name := range lib.functions {
+			if _, ok := functions[name]; ok {
+				return reply.MakeErrReply("ERR Function " + name + " already exists")
+			}
+			functions[name] = lib.name
+		}
+		names[lib.name] = true
+		restored = append(restored, lib)
+	}
+
+	libs.mu.Lock()
+	defer libs.mu.Unlock()
+	switch policy {
+	case "FLUSH":
+		libs.libs = make(map[string]*functionLib)
+		libs.functions = make(map[string]*luaFunction)
+	case "APPEND":
+		for _, lib := range restored {
+			if _, ok := libs.libs[lib.name]; ok {
+				return reply.MakeErrReply("ERR Library " + lib.name + " already exists")
+			}
+		}
+	}
+	// REPLACE 时被替换的库里的函数不算冲突
+	for _, lib := range restored {
+		for name := range lib.functions {
+			fn, ok := libs.functions[name]
+			if ok && !(policy == "REPLACE" && names[fn.lib.name]) {
+				return reply.MakeErrReply("ERR Function " + name + " already exists")
+			}
+		}
+	}
+	for _, lib := range restored {
+		if old, ok := libs.libs[lib.name]; ok {
+			libs.removeLocked(old)
+		}
+		libs.libs[lib.name] = lib
+		for name, fn := range lib.functions {
+			libs.functions[name] = fn
+		}
+	}
+	return nil
+}
+
+// FUNCTION LIST 里的一个库
+func (lib *functionLib) toReply(withCode bool) redis.Reply {
+	names := make([]string, 0, len(lib.functions))
+	for name := range lib.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	functions := make([]redis.Reply, len(names))
+	for i, name := range names {
+		fn := lib.functions[name]
+		flags := make([][]byte, len(fn.flags))
+		for j, flag := range fn.flags {
+			flags[j] = []byte(flag)
+		}
+		functions[i] = reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeBulkReply([]byte("name")),
+			reply.MakeBulkReply([]byte(fn.name)),
+			reply.MakeBulkReply([]byte("description")),
+			&reply.NullBulkReply{},
+			reply.MakeBulkReply([]byte("flags")),
+			reply.MakeMultiBulkReply(flags),
+		})
+	}
+	result := []redis.Reply{
+		reply.MakeBulkReply([]byte("library_name")),
+		reply.MakeBulkReply([]byte(lib.name)),
+		reply.MakeBulkReply([]byte("engine")),
+		reply.MakeBulkReply([]byte(functionEngine)),
+		reply.MakeBulkReply([]byte("functions")),
+		reply.MakeMultiRawReply(functions),
+	}
+	if withCode {
+		result = append(result, reply.MakeBulkReply([]byte("library_code")), reply.MakeBulkReply([]byte(lib.code)))
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+// FUNCTION 只有LOAD/DELETE/FLUSH/RESTORE是写命令, LIST/DUMP 是只读的, 不会被MISCONF/OOM拒绝
+// DELETE/FLUSH 只会减少内存, 超过maxmemory时也可以执行; args 包括FUNCTION
+func functionFlags(args [][]byte) int {
+	if len(args) < 2 {
+		return flagReadOnly | flagNoScript
+	}
+	switch strings.ToLower(string(args[1])) {
+	case "load", "restore":
+		return flagWrite | flagNoScript
+	case "delete", "flush":
+		return flagWrite | flagAllowOOM | flagNoScript
+	}
+	return flagReadOnly | flagNoScript
+}
+
+// FUNCTION LOAD|LIST|DELETE|FLUSH|DUMP|RESTORE, args 不包含FUNCTION
+// FUNCTION KILL 在脚本执行期间也要能执行, 由MultiDB.Exec处理
+func FunctionCommand(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "load":
+		// LOAD [REPLACE] code
+		if len(args) != 2 && len(args) != 3 {
+			return &reply.ArgNumErrReply{Cmd: "function|load"}
+		}
+		replace := false
+		if len(args) == 3 {
+			if strings.ToUpper(string(args[1])) != "REPLACE" {
+				return reply.MakeErrReply("ERR Unknown option given: " + string(args[1]))
+			}
+			replace = true
+		}
+		lib, errReply := compileLibrary(string(args[len(args)-1]))
+		if errReply != nil {
+			return errReply
+		}
+		if errReply := mdb.functions.add(lib, replace); errReply != nil {
+			lib.L.Close()
+			return errReply
+		}
+		mdb.addAof(dbIndex, makeAofCmd("function", args))
+		return reply.MakeBulkReply([]byte(lib.name))
+	case "list":
+		// LIST [LIBRARYNAME pattern] [WITHCODE]
+		withCode := false
+		pattern := ""
+		for i := 1; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "WITHCODE":
+				withCode = true
+			case "LIBRARYNAME":
+				if i+1 >= len(args) {
+					return reply.MakeErrReply("ERR library name argument was not given")
+				}
+				pattern = string(args[i+1])
+				i++
+			default:
+				return reply.MakeErrReply("ERR Unknown argument " + string(args[i]))
+			}
+		}
+		result := make([]redis.Reply, 0)
+		for _, lib := range mdb.functions.list() {
+			if pattern != "" && !wildcard.Match(pattern, lib.name) {
+				continue
+			}
+			result = append(result, lib.toReply(withCode))
+		}
+		return reply.MakeMultiRawReply(result)
+	case "delete":
+		if len(args) != 2 {
+			return &reply.ArgNumErrReply{Cmd: "function|delete"}
+		}
+		if !mdb.functions.remove(string(args[1])) {
+			return reply.MakeErrReply("ERR Library not found")
+		}
+		mdb.addAof(dbIndex, makeAofCmd("function", args))
+		return &reply.OkReply{}
+	case "flush":
+		// ASYNC 和 SYNC 都是同步清空
+		if len(args) > 2 {
+			return &reply.ArgNumErrReply{Cmd: "function|flush"}
+		}
+		if len(args) == 2 {
+			mode := strings.ToUpper(string(args[1]))
+			if mode != "ASYNC" && mode != "SYNC" {
+				return &reply.SyntaxErrReply{}
+			}
+		}
+		mdb.functions.flush()
+		mdb.addAof(dbIndex, makeAofCmd("function", args))
+		return &reply.OkReply{}
+	case "dump":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "function|dump"}
+		}
+		return reply.MakeBulkReply(dumpFunctions(mdb.functions.list()))
+	case "restore":
+		// RESTORE payload [FLUSH|APPEND|REPLACE]
+		if len(args) != 2 && len(args) != 3 {
+			return &reply.ArgNumErrReply{Cmd: "function|restore"}
+		}
+		policy := "APPEND"
+		if len(args) == 3 {
+			policy = strings.ToUpper(string(args[2]))
+			if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+				return reply.MakeErrReply("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			}
+		}
+		codes, errReply := parseFunctionDump(args[1])
+		if errReply != nil {
+			return errReply
+		}
+		if errReply := mdb.functions.restore(codes, policy); errReply != nil {
+			return errReply
+		}
+		mdb.addAof(dbIndex, makeAofCmd("function", args))
+		return &reply.OkReply{}
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try FUNCTION HELP.")
+}
+
+// 重写AOF时每个库写成一条 FUNCTION LOAD
+func persistFunction(lib *functionLib) *reply.MultiBulkReply {
+	return reply.MakeMultiBulkReply([][]byte{[]byte("FUNCTION"), []byte("LOAD"), []byte(lib.code)})
+}
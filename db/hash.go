@@ -0,0 +1,394 @@
+package db
+
+import (
+	"math"
+	"math/big"
+	"redis.simple/datastruct/dict"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+	hash 的value是一个嵌套的dict.Dict, field => []byte
+	小的hash用不加锁的SimpleDict(由key的锁保护就够了), field超过hashMaxSimpleEntries个之后
+	转成ConcurrentDict, 大hash的随机取样(HRANDFIELD)不用每次都遍历整个map
+	两种都实现了dict.Dict, 命令里不用区分
+ */
+
+// 和redis的 hash-max-listpack-entries 一样
+const hashMaxSimpleEntries = 128
+
+func (db *DB) getAsDict(key string) (dict.Dict, reply.ErrorReply) {
+	entity, ok := db.GET(key)
+	if !ok {
+		return nil, nil
+	}
+	hash, ok := entity.Data.(dict.Dict)
+	if !ok {
+		return nil, &reply.WrongTypeErrReply{}
+	}
+	return hash, nil
+}
+
+// 不存在就创建并放进DB
+func (db *DB) getOrInitDict(key string) (hash dict.Dict, isNew bool, errReply reply.ErrorReply) {
+	hash, errReply = db.getAsDict(key)
+	if errReply != nil {
+		return nil, false, errReply
+	}
+	isNew = false
+	if hash == nil {
+		hash = dict.MakeSimple()
+		db.PUT(key, &DataEntity{
+			Data: hash,
+		})
+		isNew = true
+	}
+	return hash, isNew, nil
+}
+
+// 写入之后调用, 小hash太大了就换成ConcurrentDict
+func (db *DB) convertHashIfNeeded(key string, hash dict.Dict) {
+	if _, ok := hash.(*dict.SimpleDict); !ok || hash.Len() <= hashMaxSimpleEntries {
+		return
+	}
+	converted := dict.MakeConcurrent(hash.Len())
+	hash.ForEach(func(field string, val interface{}) bool {
+		converted.Put(field, val, dict.STRING)
+		return true
+	})
+	db.PUT(key, &DataEntity{
+		Data: converted,
+	})
+}
+
+// 和list一样, 没有field的hash要删掉
+func (db *DB) removeIfEmptyDict(key string, hash dict.Dict) {
+	if hash.Len() == 0 {
+		db.Remove(key)
+	}
+}
+
+func HSet(db *DB, args [][]byte) (redis.Reply, *extra) {
+	if len(args)%2 != 1 {
+		return &reply.ArgNumErrReply{Cmd: "hset"}, nil
+	}
+	key := string(args[0])
+	hash, _, errReply := db.getOrInitDict(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		added += hash.Put(string(args[i]), args[i+1], dict.STRING)
+	}
+	db.convertHashIfNeeded(key, hash)
+	return reply.MakeIntReply(int64(added)), persistAs(makeAofCmd("hset", args))
+}
+
+// HMSET 和 HSET 一样, 只是返回OK
+func HMSet(db *DB, args [][]byte) (redis.Reply, *extra) {
+	if len(args)%2 != 1 {
+		return &reply.ArgNumErrReply{Cmd: "hmset"}, nil
+	}
+	result, ex := HSet(db, args)
+	if _, ok := result.(*reply.IntReply); !ok {
+		return result, ex
+	}
+	return &reply.OkReply{}, ex
+}
+
+func HSetNX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	hash, isNew, errReply := db.getOrInitDict(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	result := hash.PutIfAbsent(string(args[1]), args[2], dict.STRING)
+	if result > 0 {
+		db.convertHashIfNeeded(key, hash)
+		return reply.MakeIntReply(1), persistAsIs
+	}
+	if isNew {
+		db.removeIfEmptyDict(key, hash)
+	}
+	return reply.MakeIntReply(0), nil
+}
+
+func HGet(db *DB, args [][]byte) redis.Reply {
+	hash, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash == nil {
+		return &reply.NullBulkReply{}
+	}
+	val, ok := hash.Get(string(args[1]))
+	if !ok {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply(val.([]byte))
+}
+
+func HMGet(db *DB, args [][]byte) redis.Reply {
+	hash, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, len(args)-1)
+	if hash == nil {
+		return reply.MakeMultiBulkReply(result)
+	}
+	for i, field := range args[1:] {
+		if val, ok := hash.Get(string(field)); ok {
+			result[i] = val.([]byte)
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+func HDel(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	hash, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if hash == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	deleted := 0
+	for _, field := range args[1:] {
+		deleted += hash.Remove(string(field))
+	}
+	if deleted == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	db.removeIfEmptyDict(key, hash)
+	return reply.MakeIntReply(int64(deleted)), persistAsIs
+}
+
+func HExists(db *DB, args [][]byte) redis.Reply {
+	hash, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash == nil {
+		return reply.MakeIntReply(0)
+	}
+	if _, ok := hash.Get(string(args[1])); ok {
+		return reply.MakeIntReply(1)
+	}
+	return reply.MakeIntReply(0)
+}
+
+func HLen(db *DB, args [][]byte) redis.Reply {
+	hash, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(int64(hash.Len()))
+}
+
+func HStrLen(db *DB, args [][]byte) redis.Reply {
+	hash, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash == nil {
+		return reply.MakeIntReply(0)
+	}
+	val, ok := hash.Get(string(args[1]))
+	if !ok {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(int64(len(val.([]byte))))
+}
+
+// 遍历hash, 按需要返回field和value
+func hashEntries(db *DB, key string, withFields bool, withValues bool) redis.Reply {
+	hash, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	if hash == nil {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	result := make([][]byte, 0, hash.Len()*2)
+	hash.ForEach(func(field string, val interface{}) bool {
+		if withFields {
+			result = append(result, []byte(field))
+		}
+		if withValues {
+			result = append(result, val.([]byte))
+		}
+		return true
+	})
+	return reply.MakeMultiBulkReply(result)
+}
+
+func HKeys(db *DB, args [][]byte) redis.Reply {
+	return hashEntries(db, string(args[0]), true, false)
+}
+
+func HVals(db *DB, args [][]byte) redis.Reply {
+	return hashEntries(db, string(args[0]), false, true)
+}
+
+func HGetAll(db *DB, args [][]byte) redis.Reply {
+	return hashEntries(db, string(args[0]), true, true)
+}
+
+func HIncrBy(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	field := string(args[1])
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+	}
+	hash, isNew, errReply := db.getOrInitDict(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	var val int64
+	if raw, ok := hash.Get(field); ok {
+		val, err = strconv.ParseInt(string(raw.([]byte)), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR hash value is not an integer"), nil
+		}
+	}
+	if (delta > 0 && val > math.MaxInt64-delta) || (delta < 0 && val < math.MinInt64-delta) {
+		if isNew {
+			db.removeIfEmptyDict(key, hash)
+		}
+		return reply.MakeErrReply("ERR increment or decrement would overflow"), nil
+	}
+	val += delta
+	hash.Put(field, []byte(strconv.FormatInt(val, 10)), dict.STRING)
+	db.convertHashIfNeeded(key, hash)
+	return reply.MakeIntReply(val), persistAsIs
+}
+
+func HIncrByFloat(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	field := string(args[1])
+	delta, err := strconv.ParseFloat(string(args[2]), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return reply.MakeErrReply("ERR value is not a valid float"), nil
+	}
+	hash, isNew, errReply := db.getOrInitDict(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	val := new(big.Float)
+	if raw, ok := hash.Get(field); ok {
+		if _, ok := val.SetString(string(raw.([]byte))); !ok {
+			return reply.MakeErrReply("ERR hash value is not a float"), nil
+		}
+	}
+	result, _ := val.Add(val, big.NewFloat(delta)).Float64()
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		if isNew {
+			db.removeIfEmptyDict(key, hash)
+		}
+		return reply.MakeErrReply("ERR increment would produce NaN or Infinity"), nil
+	}
+	resultBytes := []byte(formatFloat(result))
+	hash.Put(field, resultBytes, dict.STRING)
+	db.convertHashIfNeeded(key, hash)
+	// 和INCRBYFLOAT一样直接记录结果
+	return reply.MakeBulkReply(resultBytes), persistAs(makeAofCmd("hset", [][]byte{args[0], args[1], resultBytes}))
+}
+
+// HRANDFIELD key [count [WITHVALUES]]
+// count 为正数时返回不重复的field, 负数时可以重复, 个数是 -count
+func HRandField(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 3 {
+		return &reply.SyntaxErrReply{}
+	}
+	hash, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 1 {
+		if hash == nil {
+			return &reply.NullBulkReply{}
+		}
+		return reply.MakeBulkReply([]byte(hash.RandomKeys(1)[0]))
+	}
+
+	count, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	withValues := false
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[2])) != "WITHVALUES" {
+			return &reply.SyntaxErrReply{}
+		}
+		withValues = true
+	}
+	if hash == nil || count == 0 {
+		return &reply.EmptyMultiBulkReply{}
+	}
+
+	var fields []string
+	if count > 0 {
+		fields = hash.RandomDistinctKeys(int(count))
+	} else {
+		if count < math.MinInt64/2 {
+			return reply.MakeErrReply("ERR value is out of range")
+		}
+		fields = hash.RandomKeys(int(-count))
+	}
+	result := make([][]byte, 0, len(fields)*2)
+	for _, field := range fields {
+		result = append(result, []byte(field))
+		if withValues {
+			val, _ := hash.Get(field)
+			result = append(result, val.([]byte))
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+// 和redis的listpack编码一样, 小hash一次全部返回, cursor直接是0
+// 大hash用 dict.Dict 的Scan, cursor 的含义见那里
+func HScan(db *DB, args [][]byte) redis.Reply {
+	cursor, errReply := parseCursor(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	opts, errReply := parseScanOptions(args[2:], false)
+	if errReply != nil {
+		return errReply
+	}
+	hash, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash == nil {
+		return makeScanReply(0, [][]byte{})
+	}
+
+	items := make([][]byte, 0)
+	appendIfMatch := func(field string, val interface{}) {
+		if opts.match(field) {
+			items = append(items, []byte(field), val.([]byte))
+		}
+	}
+	if _, ok := hash.(*dict.SimpleDict); ok {
+		hash.ForEach(func(field string, val interface{}) bool {
+			appendIfMatch(field, val)
+			return true
+		})
+		return makeScanReply(0, items)
+	}
+	next := hash.Scan(cursor, opts.count, appendIfMatch)
+	return makeScanReply(next, items)
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+	"redis.simple/config"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strings"
+	"sync/atomic"
+)
+
+// INFO 的一个部分, 每个部分生成若干行 "name:value"
+type infoSection struct {
+	name      string
+	generator func(mdb *MultiDB) []string
+}
+
+// 按顺序输出
+var infoSections = []infoSection{
+	{"memory", memoryInfo},
+	{"persistence", persistenceInfo},
+	{"stats", statsInfo},
+	{"keyspace", keyspaceInfo},
+}
+
+// used_memory 是按value估计的内存, 不是进程实际占用的内存
+func memoryInfo(mdb *MultiDB) []string {
+	return []string{
+		fmt.Sprintf("used_memory:%d", mdb.UsedMemory()),
+		fmt.Sprintf("maxmemory:%d", config.Properties.MaxMemory),
+		fmt.Sprintf("maxmemory_policy:%s", config.Properties.MaxMemoryPolicy),
+	}
+}
+
+func persistenceInfo(mdb *MultiDB) []string {
+	aofEnabled := 0
+	if mdb.aofFile != nil {
+		aofEnabled = 1
+	}
+	rewriting := 0
+	if mdb.isAofRewriting() {
+		rewriting = 1
+	}
+	writeStatus := "ok"
+	if mdb.aofWriteErrors() > 0 {
+		writeStatus = "err"
+	}
+	lines := []string{
+		fmt.Sprintf("aof_enabled:%d", aofEnabled),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriting),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", atomic.LoadInt64(&mdb.aofLastRewriteSec)),
+		fmt.Sprintf("aof_current_rewrite_time_sec:%d", mdb.aofCurrentRewriteSec()),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", mdb.aofRewriteStatus()),
+		fmt.Sprintf("aof_last_write_status:%s", writeStatus),
+	}
+	// 和redis一样, 开启AOF时才有文件大小
+	if aofEnabled == 1 {
+		lines = append(lines,
+			fmt.Sprintf("aof_current_size:%d", mdb.aofSize()),
+			fmt.Sprintf("aof_base_size:%d", atomic.LoadInt64(&mdb.aofRewriteBaseSize)),
+		)
+	}
+	return lines
+}
+
+func statsInfo(mdb *MultiDB) []string {
+	return []string{
+		fmt.Sprintf("evicted_keys:%d", mdb.EvictedKeys()),
+		fmt.Sprintf("expired_keys:%d", mdb.ExpiredKeys()),
+		fmt.Sprintf("expired_stale_perc:%.2f", mdb.ExpiredStalePerc()),
+		fmt.Sprintf("expired_time_cap_reached_count:%d", mdb.ExpiredTimeCapReached()),
+	}
+}
+
+// 和redis一样只列出不为空的数据库
+func keyspaceInfo(mdb *MultiDB) []string {
+	lines := make([]string, 0)
+	for _, db := range mdb.dbSet {
+		keys := db.Data.Len()
+		if keys == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d", db.index, keys, db.TTLMap.Len()))
+	}
+	return lines
+}
+
+// INFO [section [section ...]]
+// 没有参数或者 all/default/everything 时输出所有部分
+func Info(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	selected := make(map[string]bool)
+	all := len(args) == 0
+	for _, arg := range args {
+		section := strings.ToLower(string(arg))
+		if section == "all" || section == "default" || section == "everything" {
+			all = true
+		}
+		selected[section] = true
+	}
+
+	var builder strings.Builder
+	for _, section := range infoSections {
+		if !all && !selected[section.name] {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString("# " + strings.Title(section.name) + "\r\n")
+		for _, line := range section.generator(mdb) {
+			builder.WriteString(line + "\r\n")
+		}
+	}
+	return reply.MakeBulkReply([]byte(builder.String()))
+}
@@ -0,0 +1,339 @@
+package db
+
+import (
+	"redis.simple/datastruct/bitmap"
+	"redis.simple/datastruct/dict"
+	List "redis.simple/datastruct/list"
+	"redis.simple/datastruct/set"
+	SortedSet "redis.simple/datastruct/sortedset"
+	"redis.simple/interface/redis"
+	"redis.simple/lib/wildcard"
+	"redis.simple/redis/reply"
+	"strings"
+	"time"
+)
+
+// 只判断是否过期, 不删除
+// 在Data.ForEach里不能调用IsExpired, 它会删除key, 而ForEach还持有shard的锁
+func (db *DB) expiredAt(key string, now time.Time) bool {
+	raw, ok := db.TTLMap.Get(key)
+	if !ok {
+		return false
+	}
+	expireTime, _ := raw.(time.Time)
+	return now.After(expireTime)
+}
+
+// DEL/UNLINK key [key ...]
+// UNLINK在redis里是后台释放内存, 这里删掉引用之后由GC回收, 所以两者一样
+func Del(db *DB, args [][]byte) (redis.Reply, *extra) {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	deleted := db.Removes(keys...)
+	if deleted == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	// UNLINK 也记为DEL
+	return reply.MakeIntReply(int64(deleted)), persistAs(makeAofCmd("del", args))
+}
+
+// 重复的key会重复计数
+func Exists(db *DB, args [][]byte) redis.Reply {
+	var count int64
+	for _, arg := range args {
+		if _, ok := db.GET(string(arg)); ok {
+			count++
+		}
+	}
+	return reply.MakeIntReply(count)
+}
+
+func typeName(entity *DataEntity) string {
+	switch entity.Type() {
+	case dict.STRING, dict.BITMAP:
+		return "string"
+	case dict.LIST:
+		return "list"
+	case dict.HASH:
+		return "hash"
+	case dict.SET:
+		return "set"
+	case dict.ZSET:
+		return "zset"
+	}
+	return "none"
+}
+
+func Type(db *DB, args [][]byte) redis.Reply {
+	entity, ok := db.GET(string(args[0]))
+	if !ok {
+		return reply.MakeStatusReply("none")
+	}
+	return reply.MakeStatusReply(typeName(entity))
+}
+
+// 把src连同过期时间一起搬到dest, 调用者锁住了两个key
+func (db *DB) renameKey(src string, dest string, entity *DataEntity) {
+	rawTTL, hasTTL := db.TTLMap.Get(src)
+	putWithTTL(db, dest, entity, rawTTL, hasTTL)
+	db.Remove(src)
+}
+
+func Rename(db *DB, args [][]byte) (redis.Reply, *extra) {
+	src := string(args[0])
+	dest := string(args[1])
+	entity, ok := db.GET(src)
+	if !ok {
+		return reply.MakeErrReply("ERR no such key"), nil
+	}
+	if src != dest {
+		db.renameKey(src, dest, entity)
+	}
+	return &reply.OkReply{}, persistAsIs
+}
+
+func RenameNX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	src := string(args[0])
+	dest := string(args[1])
+	entity, ok := db.GET(src)
+	if !ok {
+		return reply.MakeErrReply("ERR no such key"), nil
+	}
+	if _, exists := db.GET(dest); exists {
+		return reply.MakeIntReply(0), nil
+	}
+	db.renameKey(src, dest, entity)
+	return reply.MakeIntReply(1), persistAsIs
+}
+
+// 深拷贝value, 拷贝之后两边的修改互不影响
+// 字符串是不可变的(修改时都会生成新的slice), 可以直接共用
+func deepCopy(entity *DataEntity) *DataEntity {
+	switch val := entity.Data.(type) {
+	case bitmap.BitMap:
+		bm := make(bitmap.BitMap, len(val))
+		copy(bm, val)
+		return &DataEntity{Data: bm}
+	case *List.LinkedList:
+		list := List.Make()
+		val.Foreach(func(i int, element interface{}) bool {
+			list.Rpush(element)
+			return true
+		})
+		return &DataEntity{Data: list}
+	case *set.Set:
+		s := set.Make()
+		val.ForEach(func(member string) bool {
+			s.Add(member)
+			return true
+		})
+		return &DataEntity{Data: s}
+	case dict.Dict:
+		var hash dict.Dict
+		if _, ok := val.(*dict.SimpleDict); ok {
+			hash = dict.MakeSimple()
+		} else {
+			hash = dict.MakeConcurrent(val.Len())
+		}
+		val.ForEach(func(field string, value interface{}) bool {
+			hash.Put(field, value, dict.STRING)
+			return true
+		})
+		return &DataEntity{Data: hash}
+	case *SortedSet.SortedSet:
+		zset := SortedSet.Make()
+		val.ForEach(0, val.Len(), false, func(element *SortedSet.Element) bool {
+			zset.Add(element.Member, element.Score)
+			return true
+		})
+		return &DataEntity{Data: zset}
+	}
+	return &DataEntity{Data: entity.Data}
+}
+
+// 跨数据库的命令要锁住两个数据库里的key, 按数据库下标的顺序加锁, 避免两个方向的MOVE互相等待
+// 返回解锁的函数
+func lockAcrossDBs(srcDB *DB, src string, destDB *DB, dest string) func() {
+	if srcDB == destDB {
+		srcDB.Locks(src, dest)
+		return func() {
+			srcDB.UnLocks(src, dest)
+		}
+	}
+	first, firstKey, second, secondKey := srcDB, src, destDB, dest
+	if first.index > second.index {
+		first, firstKey, second, secondKey = second, secondKey, first, firstKey
+	}
+	first.Lock(firstKey)
+	second.Lock(secondKey)
+	return func() {
+		second.UnLock(secondKey)
+		first.UnLock(firstKey)
+	}
+}
+
+// 把value和过期时间放到destDB的dest, 调用者锁住了dest
+func putWithTTL(destDB *DB, dest string, entity *DataEntity, rawTTL interface{}, hasTTL bool) {
+	destDB.Remove(dest)
+	destDB.PUT(dest, entity)
+	if hasTTL {
+		destDB.Expire(dest, rawTTL.(time.Time))
+	}
+	destDB.touchKeys(dest)
+	// dest可能有client在BLPOP
+	if _, ok := entity.Data.(*List.LinkedList); ok {
+		destDB.signalKeyAsReady(dest)
+	}
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func Copy(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dest := string(args[1])
+	destIndex := dbIndex
+	replace := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return &reply.SyntaxErrReply{}
+			}
+			var errReply reply.ErrorReply
+			destIndex, errReply = mdb.parseDBIndex(args[i+1])
+			if errReply != nil {
+				return errReply
+			}
+			i++
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	if src == dest && destIndex == dbIndex {
+		return reply.MakeErrReply("ERR source and destination objects are the same")
+	}
+	srcDB := mdb.dbSet[dbIndex]
+	destDB := mdb.dbSet[destIndex]
+	unlock := lockAcrossDBs(srcDB, src, destDB, dest)
+	defer unlock()
+
+	entity, ok := srcDB.GET(src)
+	if !ok {
+		return reply.MakeIntReply(0)
+	}
+	if _, exists := destDB.GET(dest); exists && !replace {
+		return reply.MakeIntReply(0)
+	}
+	rawTTL, hasTTL := srcDB.TTLMap.Get(src)
+	putWithTTL(destDB, dest, deepCopy(entity), rawTTL, hasTTL)
+	// 在源数据库记录, 重放时DB参数还是相对它的
+	srcDB.AddAof(makeAofCmd("copy", args))
+	return reply.MakeIntReply(1)
+}
+
+// MOVE key db
+// 目标数据库里已经有这个key时不移动
+func Move(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	key := string(args[0])
+	destIndex, errReply := mdb.parseDBIndex(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	if destIndex == dbIndex {
+		return reply.MakeErrReply("ERR source and destination objects are the same")
+	}
+	srcDB := mdb.dbSet[dbIndex]
+	destDB := mdb.dbSet[destIndex]
+	unlock := lockAcrossDBs(srcDB, key, destDB, key)
+	defer unlock()
+
+	entity, ok := srcDB.GET(key)
+	if !ok {
+		return reply.MakeIntReply(0)
+	}
+	if _, exists := destDB.GET(key); exists {
+		return reply.MakeIntReply(0)
+	}
+	rawTTL, hasTTL := srcDB.TTLMap.Get(key)
+	putWithTTL(destDB, key, entity, rawTTL, hasTTL)
+	srcDB.Remove(key)
+	srcDB.touchKeys(key)
+	srcDB.AddAof(makeAofCmd("move", args))
+	return reply.MakeIntReply(1)
+}
+
+// KEYS pattern, 遍历整个数据库
+func Keys(db *DB, args [][]byte) redis.Reply {
+	pattern := string(args[0])
+	now := time.Now()
+	result := make([][]byte, 0)
+	db.Data.ForEach(func(key string, val interface{}) bool {
+		if !db.expiredAt(key, now) && (pattern == "*" || wildcard.Match(pattern, key)) {
+			result = append(result, []byte(key))
+		}
+		return true
+	})
+	return reply.MakeMultiBulkReply(result)
+}
+
+// 随机取的key可能已经过期了(跳过再取), 多次都是过期的就放弃
+const randomKeyTries = 100
+
+// RANDOMKEY 没有锁住key, 不能用IsExpired删除过期的key(可能删掉别的命令刚写入的值)
+// 这里只跳过, 删除留给持有key锁的访问和主动过期; 事务和脚本里也可能已经持有这个key的锁, 所以也不用expireIfNeeded
+func RandomKey(db *DB, args [][]byte) redis.Reply {
+	now := time.Now()
+	for i := 0; i < randomKeyTries && db.Data.Len() > 0; i++ {
+		keys := db.Data.RandomKeys(1)
+		if len(keys) == 0 {
+			break
+		}
+		if !db.expiredAt(keys[0], now) {
+			return reply.MakeBulkReply([]byte(keys[0]))
+		}
+	}
+	return &reply.NullBulkReply{}
+}
+
+// 和redis一样, 包括已经过期但还没删掉的key
+func DBSize(db *DB, args [][]byte) redis.Reply {
+	return reply.MakeIntReply(int64(db.Data.Len()))
+}
+
+// FLUSHDB/FLUSHALL [ASYNC|SYNC]
+// Flush 只是换上新的dict, 旧的由GC回收, 所以ASYNC和SYNC都不会阻塞
+// ASYNC 只是为了兼容而接受, 效果和SYNC完全一样
+func parseFlushMode(args [][]byte) reply.ErrorReply {
+	if len(args) > 1 {
+		return &reply.SyntaxErrReply{}
+	}
+	if len(args) == 1 {
+		mode := strings.ToUpper(string(args[0]))
+		if mode != "ASYNC" && mode != "SYNC" {
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	return nil
+}
+
+func FlushDB(db *DB, args [][]byte) (redis.Reply, *extra) {
+	if errReply := parseFlushMode(args); errReply != nil {
+		return errReply, nil
+	}
+	db.Flush()
+	return &reply.OkReply{}, persistAsIs
+}
+
+func FlushAll(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	if errReply := parseFlushMode(args); errReply != nil {
+		return errReply
+	}
+	for _, db := range mdb.dbSet {
+		db.Flush()
+	}
+	mdb.addAof(dbIndex, makeAofCmd("flushall", args))
+	return &reply.OkReply{}
+}
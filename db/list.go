@@ -1,18 +1,496 @@
 package db
 
 import (
-	"github.com/HDT3213/godis/src/datastruct/list"
-	"github.com/HDT3213/godis/src/redis/reply"
+	List "redis.simple/datastruct/list"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
 )
 
-func (db *DB)getList(key string) (*list.LinkedList, reply.ErrorReply) {
+func (db *DB)getList(key string) (*List.LinkedList, reply.ErrorReply) {
 	entity, ok := db.GET(key)
 	if !ok {
 		return nil, nil
 	}
-	bytes, ok := entity.Data.(*list.LinkedList)
+	bytes, ok := entity.Data.(*List.LinkedList)
 	if !ok {
 		return nil, &reply.WrongTypeErrReply{}
 	}
 	return bytes, nil
 }
+
+// 不存在就创建一个空的list(还没放进DB, 调用者push之后再放)
+func (db *DB)getOrInitList(key string) (list *List.LinkedList, isNew bool, errReply reply.ErrorReply) {
+	list, errReply = db.getList(key)
+	if errReply != nil {
+		return nil, false, errReply
+	}
+	isNew = false
+	if list == nil {
+		list = List.Make()
+		isNew = true
+	}
+	return list, isNew, nil
+}
+
+// list 被删空之后key也要删掉, redis里不存在空的list
+func (db *DB)removeIfEmptyList(key string, list *List.LinkedList) {
+	if list.Llen() == 0 {
+		db.Remove(key)
+	}
+}
+
+func parseIndex(raw []byte) (int, reply.ErrorReply) {
+	index, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 0, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return int(index), nil
+}
+
+// 把redis的下标(可以是负数)转为 [0, size) 之间的下标
+// 两端都超出范围时返回 start > stop, 调用者按空区间处理
+func normalizeRange(start int, stop int, size int) (int, int) {
+	if start < 0 {
+		start = size + start
+	}
+	if stop < 0 {
+		stop = size + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	return start, stop
+}
+
+func push(db *DB, args [][]byte, left bool, onlyExists bool) (redis.Reply, *extra) {
+	key := string(args[0])
+	list, isNew, errReply := db.getOrInitList(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if isNew && onlyExists {
+		return reply.MakeIntReply(0), nil
+	}
+	for _, value := range args[1:] {
+		if left {
+			list.Lpush(value)
+		} else {
+			list.Rpush(value)
+		}
+	}
+	if isNew {
+		db.PUT(key, &DataEntity{
+			Data: list,
+		})
+	}
+	db.signalKeyAsReady(key)
+	return reply.MakeIntReply(int64(list.Llen())), persistAsIs
+}
+
+func LPush(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return push(db, args, true, false)
+}
+
+func LPushX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return push(db, args, true, true)
+}
+
+func RPush(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return push(db, args, false, false)
+}
+
+func RPushX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return push(db, args, false, true)
+}
+
+// LPOP key [count] / RPOP key [count]
+func pop(db *DB, args [][]byte, left bool, cmdName string) (redis.Reply, *extra) {
+	key := string(args[0])
+	if len(args) > 2 {
+		return &reply.SyntaxErrReply{}, nil
+	}
+	withCount := len(args) == 2
+	count := 1
+	if withCount {
+		c, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || c < 0 {
+			return reply.MakeErrReply("ERR value is out of range, must be positive"), nil
+		}
+		count = int(c)
+	}
+
+	list, errReply := db.getList(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if list == nil {
+		if withCount {
+			return &reply.NullMultiBulkReply{}, nil
+		}
+		return &reply.NullBulkReply{}, nil
+	}
+
+	popped := make([][]byte, 0, count)
+	for i := 0; i < count && list.Llen() > 0; i++ {
+		var val interface{}
+		if left {
+			val = list.Lpop()
+		} else {
+			val = list.Rpop()
+		}
+		popped = append(popped, val.([]byte))
+	}
+	db.removeIfEmptyList(key, list)
+	var ex *extra
+	if len(popped) > 0 {
+		ex = persistAs(makeAofCmd(cmdName, [][]byte{args[0], []byte(strconv.Itoa(len(popped)))}))
+	}
+
+	if !withCount {
+		return reply.MakeBulkReply(popped[0]), ex
+	}
+	return reply.MakeMultiBulkReply(popped), ex
+}
+
+func LPop(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return pop(db, args, true, "lpop")
+}
+
+func RPop(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return pop(db, args, false, "rpop")
+}
+
+func LLen(db *DB, args [][]byte) redis.Reply {
+	list, errReply := db.getList(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(int64(list.Llen()))
+}
+
+func LIndex(db *DB, args [][]byte) redis.Reply {
+	index, errReply := parseIndex(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	list, errReply := db.getList(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		return &reply.NullBulkReply{}
+	}
+	if index < 0 {
+		index = list.Llen() + index
+	}
+	val := list.Lindex(index)
+	if val == nil {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply(val.([]byte))
+}
+
+func LRange(db *DB, args [][]byte) redis.Reply {
+	start, errReply := parseIndex(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	stop, errReply := parseIndex(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	list, errReply := db.getList(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	start, stop = normalizeRange(start, stop, list.Llen())
+	if start > stop {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	vals := list.Lrange(start, stop)
+	result := make([][]byte, len(vals))
+	for i, val := range vals {
+		result[i] = val.([]byte)
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// LREM key count element
+func LRem(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	count, errReply := parseIndex(args[1])
+	if errReply != nil {
+		return errReply, nil
+	}
+	list, errReply := db.getList(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if list == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	removed := list.Lrem(count, args[2])
+	if removed == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	db.removeIfEmptyList(key, list)
+	return reply.MakeIntReply(int64(removed)), persistAsIs
+}
+
+func LSet(db *DB, args [][]byte) (redis.Reply, *extra) {
+	index, errReply := parseIndex(args[1])
+	if errReply != nil {
+		return errReply, nil
+	}
+	list, errReply := db.getList(string(args[0]))
+	if errReply != nil {
+		return errReply, nil
+	}
+	if list == nil {
+		return reply.MakeErrReply("ERR no such key"), nil
+	}
+	if index < 0 {
+		index = list.Llen() + index
+	}
+	if !list.Lset(index, args[2]) {
+		return reply.MakeErrReply("ERR index out of range"), nil
+	}
+	return &reply.OkReply{}, persistAsIs
+}
+
+// LINSERT key BEFORE|AFTER pivot element
+func LInsert(db *DB, args [][]byte) (redis.Reply, *extra) {
+	var isBefore bool
+	switch strings.ToUpper(string(args[1])) {
+	case "BEFORE":
+		isBefore = true
+	case "AFTER":
+		isBefore = false
+	default:
+		return &reply.SyntaxErrReply{}, nil
+	}
+	list, errReply := db.getList(string(args[0]))
+	if errReply != nil {
+		return errReply, nil
+	}
+	if list == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	result := list.Linsert(isBefore, args[2], args[3])
+	if result <= 0 {
+		return reply.MakeIntReply(int64(result)), nil
+	}
+	return reply.MakeIntReply(int64(result)), persistAsIs
+}
+
+func LTrim(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	start, errReply := parseIndex(args[1])
+	if errReply != nil {
+		return errReply, nil
+	}
+	stop, errReply := parseIndex(args[2])
+	if errReply != nil {
+		return errReply, nil
+	}
+	list, errReply := db.getList(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if list == nil {
+		return &reply.OkReply{}, nil
+	}
+	start, stop = normalizeRange(start, stop, list.Llen())
+	if start > stop {
+		// 区间为空, 整个list都删掉
+		db.Remove(key)
+	} else {
+		list.Ltrim(start, stop)
+	}
+	return &reply.OkReply{}, persistAsIs
+}
+
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func LPos(db *DB, args [][]byte) redis.Reply {
+	element := args[1]
+	rank := 1
+	count := 1
+	withCount := false
+	maxLen := 0
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return &reply.SyntaxErrReply{}
+		}
+		val, errReply := parseIndex(args[i+1])
+		if errReply != nil {
+			return errReply
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "RANK":
+			if val == 0 {
+				return reply.MakeErrReply("ERR RANK can't be zero: use 1 to start from the first match, " +
+					"2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = val
+		case "COUNT":
+			if val < 0 {
+				return reply.MakeErrReply("ERR COUNT can't be negative")
+			}
+			count = val
+			withCount = true
+		case "MAXLEN":
+			if val < 0 {
+				return reply.MakeErrReply("ERR MAXLEN can't be negative")
+			}
+			maxLen = val
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+
+	list, errReply := db.getList(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		if withCount {
+			return &reply.EmptyMultiBulkReply{}
+		}
+		return &reply.NullBulkReply{}
+	}
+
+	// rank 为负数时从尾部开始找, 跳过前 |rank|-1 个匹配
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	positions := make([]int, 0)
+	compared := 0
+	consumer := func(i int, val interface{}) bool {
+		if maxLen > 0 && compared >= maxLen {
+			return false
+		}
+		compared++
+		if string(val.([]byte)) == string(element) {
+			if skip > 0 {
+				skip--
+			} else {
+				positions = append(positions, i)
+				if count > 0 && len(positions) >= count {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if rank > 0 {
+		list.Foreach(consumer)
+	} else {
+		list.ReverseForeach(consumer)
+	}
+
+	if !withCount {
+		if len(positions) == 0 {
+			return &reply.NullBulkReply{}
+		}
+		return reply.MakeIntReply(int64(positions[0]))
+	}
+	result := make([]redis.Reply, len(positions))
+	for i, pos := range positions {
+		result[i] = reply.MakeIntReply(int64(pos))
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+func parseDirection(raw []byte) (left bool, ok bool) {
+	switch strings.ToUpper(string(raw)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// 从source的一端pop, push到destination的一端, source和destination可以是同一个key
+// 返回移动的元素, source为空时返回nil
+func (db *DB)move(source string, destination string, fromLeft bool, toLeft bool) ([]byte, reply.ErrorReply) {
+	srcList, errReply := db.getList(source)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if srcList == nil {
+		return nil, nil
+	}
+	// 先检查destination的类型, 类型不对时source不能被修改
+	destList, isNew, errReply := db.getOrInitList(destination)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if source == destination {
+		destList, isNew = srcList, false
+	}
+
+	var val interface{}
+	if fromLeft {
+		val = srcList.Lpop()
+	} else {
+		val = srcList.Rpop()
+	}
+	if toLeft {
+		destList.Lpush(val)
+	} else {
+		destList.Rpush(val)
+	}
+	if isNew {
+		db.PUT(destination, &DataEntity{
+			Data: destList,
+		})
+	}
+	db.signalKeyAsReady(destination)
+	db.removeIfEmptyList(source, srcList)
+	return val.([]byte), nil
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func LMove(db *DB, args [][]byte) (redis.Reply, *extra) {
+	fromLeft, ok := parseDirection(args[2])
+	if !ok {
+		return &reply.SyntaxErrReply{}, nil
+	}
+	toLeft, ok := parseDirection(args[3])
+	if !ok {
+		return &reply.SyntaxErrReply{}, nil
+	}
+	val, errReply := db.move(string(args[0]), string(args[1]), fromLeft, toLeft)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if val == nil {
+		return &reply.NullBulkReply{}, nil
+	}
+	return reply.MakeBulkReply(val), persistAsIs
+}
+
+// RPOPLPUSH source destination 等价于 LMOVE source destination RIGHT LEFT
+func RPopLPush(db *DB, args [][]byte) (redis.Reply, *extra) {
+	val, errReply := db.move(string(args[0]), string(args[1]), false, true)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if val == nil {
+		return &reply.NullBulkReply{}, nil
+	}
+	return reply.MakeBulkReply(val), persistAsIs
+}
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"context"
+	"github.com/yuin/gopher-lua"
+	"redis.simple/interface/redis"
+	"redis.simple/pubsub"
+	"redis.simple/redis/reply"
+	"strings"
+)
+
+/*
+	Lua虚拟机用的是纯Go实现的gopher-lua, EVAL每次执行新建一个LState, 脚本之间不会互相影响
+	FUNCTION 的每个库有自己的LState, 一直保留到库被删除, 注册的函数是里面的闭包
+	只打开base/table/string/math这几个库, 不能访问文件和系统
+	redis.call/redis.pcall 的命令经过和Exec一样的命令表, 返回值按redis的规则在Lua和reply之间转换
+ */
+
+// 一次脚本执行的状态
+type scriptState struct {
+	mdb *MultiDB
+	// 脚本里SELECT只改变脚本自己的数据库, 不影响client
+	dbIndex int
+	run     *runningScript
+	// FCALL_RO 或者有no-writes标记的函数, 不能执行写命令
+	readOnly bool
+}
+
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// 调用者已经锁住了key并且独占了MultiDB
+func (mdb *MultiDB) runScript(dbIndex int, script *luaScript, keys [][]byte, argv [][]byte) redis.Reply {
+	L := newLuaState()
+	defer L.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+
+	state := &scriptState{
+		mdb:     mdb,
+		dbIndex: dbIndex,
+		run:     &runningScript{cancel: cancel},
+	}
+	mdb.scripts.setRunning(state.run)
+	defer mdb.scripts.setRunning(nil)
+
+	L.SetGlobal("KEYS", bytesToLuaTable(L, keys))
+	L.SetGlobal("ARGV", bytesToLuaTable(L, argv))
+	L.SetGlobal("redis", makeRedisTable(L, func() *scriptState {
+		return state
+	}))
+
+	L.Push(L.NewFunctionFromProto(script.proto))
+	return state.result(L, L.PCall(0, 1, nil), "f_"+script.sha)
+}
+
+// 取出脚本的返回值, 出错时转换成错误回复, name 用在错误信息里
+func (state *scriptState) result(L *lua.LState, err error, name string) redis.Reply {
+	if err != nil {
+		if state.run.killed {
+			return reply.MakeErrReply("ERR Error running script (call to " + name +
+				"): Script killed by user with SCRIPT KILL...")
+		}
+		// redis.call 抛出的是 {err=...}, 原样返回给client
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+				if errMsg, ok := tbl.RawGetString("err").(lua.LString); ok {
+					return reply.MakeErrReply(string(errMsg))
+				}
+			}
+		}
+		return reply.MakeErrReply("ERR Error running script (call to " + name + "): " + luaErrorMessage(err))
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return luaToReply(ret)
+}
+
+// 错误信息里不能有换行, 去掉gopher-lua附加的stack traceback
+func luaErrorMessage(err error) string {
+	if apiErr, ok := err.(*lua.ApiError); ok && apiErr.Object != nil {
+		return strings.Replace(apiErr.Object.String(), "\n", " ", -1)
+	}
+	return strings.Replace(err.Error(), "\n", " ", -1)
+}
+
+func bytesToLuaTable(L *lua.LState, args [][]byte) *lua.LTable {
+	tbl := L.CreateTable(len(args), 0)
+	for _, arg := range args {
+		tbl.Append(lua.LString(arg))
+	}
+	return tbl
+}
+
+// getState 返回当前的执行状态, 库的LState是复用的, 每次FCALL的状态不同
+// 加载库的时候状态为nil, 不能调用redis.call
+func makeRedisTable(L *lua.LState, getState func() *scriptState) *lua.LTable {
+	tbl := L.NewTable()
+	call := func(raise bool) lua.LGFunction {
+		return func(L *lua.LState) int {
+			state := getState()
+			if state == nil {
+				L.RaiseError("redis.call and redis.pcall can not be used while loading a library")
+			}
+			return state.redisCall(L, raise)
+		}
+	}
+	L.SetFuncs(tbl, map[string]lua.LGFunction{
+		"call":  call(true),
+		"pcall": call(false),
+		"error_reply": func(L *lua.LState) int {
+			L.Push(makeStatusTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(makeStatusTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1Hex(L.CheckString(1))))
+			return 1
+		},
+	})
+	return tbl
+}
+
+func makeStatusTable(L *lua.LState, field string, msg string) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString(field, lua.LString(msg))
+	return tbl
+}
+
+// redis.call 出错时抛出 {err=...}, redis.pcall 把它作为返回值
+func (state *scriptState) redisCall(L *lua.LState, raise bool) int {
+	argNum := L.GetTop()
+	if argNum == 0 {
+		L.RaiseError("Please specify at least one argument for redis.call()")
+	}
+	args := make([][]byte, argNum)
+	for i := 1; i <= argNum; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = []byte(arg)
+		case lua.LNumber:
+			args[i-1] = []byte(arg.String())
+		default:
+			L.RaiseError("Lua redis() command arguments must be strings or integers")
+		}
+	}
+
+	result := state.exec(args)
+	if errReply, ok := result.(reply.ErrorReply); ok && raise {
+		L.Error(makeStatusTable(L, "err", errReply.Error()), 1)
+	}
+	L.Push(replyToLua(L, result))
+	return 1
+}
+
+// 执行脚本里的一条命令, 和事务里一样key不再加锁
+func (state *scriptState) exec(args [][]byte) redis.Reply {
+	mdb := state.mdb
+	cmd := strings.ToLower(string(args[0]))
+	switch cmd {
+	case "select":
+		if len(args) != 2 {
+			return reply.MakeErrReply("ERR Wrong number of args calling Redis command from script")
+		}
+		dbIndex, errReply := mdb.parseDBIndex(args[1])
+		if errReply != nil {
+			return errReply
+		}
+		state.dbIndex = dbIndex
+		return &reply.OkReply{}
+	case "publish":
+		if len(args) != 3 {
+			return reply.MakeErrReply("ERR Wrong number of args calling Redis command from script")
+		}
+		return pubsub.Publish(mdb.hub, args[1:])
+	}
+	command, ok := router[cmd]
+	if !ok {
+		return reply.MakeErrReply("ERR Unknown Redis command called from script")
+	}
+	if command.isNoScript() {
+		return reply.MakeErrReply("ERR This Redis command is not allowed from scripts")
+	}
+	if !command.validateArity(args) {
+		return reply.MakeErrReply("ERR Wrong number of args calling Redis command from script")
+	}
+	if command.isWrite() {
+		if state.readOnly {
+			return reply.MakeErrReply("ERR Write commands are not allowed from read-only scripts.")
+		}
+		if !mdb.scripts.markWritten(state.run) {
+			return reply.MakeErrReply("ERR Script killed by user with SCRIPT KILL...")
+		}
+	}
+	return mdb.execLockedCommand(state.dbIndex, command, args)
+}
+
+// reply => Lua
+// 整数 => number, bulk => string, 数组 => table, 状态 => {ok=...}, 错误 => {err=...}, nil => false
+func replyToLua(L *lua.LState, r redis.Reply) lua.LValue {
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		return makeStatusTable(L, "err", errReply.Error())
+	}
+	switch r := r.(type) {
+	case *reply.IntReply:
+		return lua.LNumber(r.Code)
+	case *reply.BulkReply:
+		if r.Arg == nil {
+			return lua.LFalse
+		}
+		return lua.LString(r.Arg)
+	case *reply.MultiBulkReply:
+		tbl := L.CreateTable(len(r.Args), 0)
+		for _, arg := range r.Args {
+			if arg == nil {
+				tbl.Append(lua.LFalse)
+			} else {
+				tbl.Append(lua.LString(arg))
+			}
+		}
+		return tbl
+	case *reply.MultiRawReply:
+		tbl := L.CreateTable(len(r.Replies), 0)
+		for _, item := range r.Replies {
+			tbl.Append(replyToLua(L, item))
+		}
+		return tbl
+	case *reply.StatusReply:
+		return makeStatusTable(L, "ok", r.Status)
+	case *reply.OkReply:
+		return makeStatusTable(L, "ok", "OK")
+	case *reply.PongReply:
+		return makeStatusTable(L, "ok", "PONG")
+	case *reply.NullBulkReply, *reply.NullMultiBulkReply, *reply.NoReply:
+		return lua.LFalse
+	case *reply.EmptyMultiBulkReply:
+		return L.NewTable()
+	}
+	// 其他的reply按协议的第一个字节处理
+	raw := r.ToBytes()
+	if len(raw) > 0 && raw[0] == '+' {
+		return makeStatusTable(L, "ok", strings.TrimSuffix(string(raw[1:]), "\r\n"))
+	}
+	return lua.LString(raw)
+}
+
+// Lua => reply
+// number 截断成整数, table 有err/ok字段时是错误/状态, 否则是数组(到第一个nil为止), false和nil => nil bulk, true => 1
+func luaToReply(value lua.LValue) redis.Reply {
+	switch value := value.(type) {
+	case lua.LNumber:
+		return reply.MakeIntReply(int64(value))
+	case lua.LString:
+		return reply.MakeBulkReply([]byte(value))
+	case lua.LBool:
+		if value {
+			return reply.MakeIntReply(1)
+		}
+		return &reply.NullBulkReply{}
+	case *lua.LTable:
+		if errMsg, ok := value.RawGetString("err").(lua.LString); ok {
+			return reply.MakeErrReply(string(errMsg))
+		}
+		if status, ok := value.RawGetString("ok").(lua.LString); ok {
+			return reply.MakeStatusReply(string(status))
+		}
+		replies := make([]redis.Reply, 0, value.Len())
+		for i := 1; ; i++ {
+			item := value.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			replies = append(replies, luaToReply(item))
+		}
+		return reply.MakeMultiRawReply(replies)
+	}
+	return &reply.NullBulkReply{}
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"math/rand"
+	"redis.simple/config"
+	"redis.simple/datastruct/bitmap"
+	"redis.simple/datastruct/dict"
+	List "redis.simple/datastruct/list"
+	"redis.simple/datastruct/set"
+	SortedSet "redis.simple/datastruct/sortedset"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	内存统计: 不用runtime的统计(受GC影响, 也分不出是哪个key的), 而是按value的结构估计每个key占用的内存
+	集合类型和redis的 MEMORY USAGE 一样只看前几个元素, 用平均大小乘以元素个数
+	估计值记在DataEntity上, DB.usedMemory 是所有估计值的和, PUT/Remove 和写命令之后(touchKeys)更新
+	估计只依赖value的内容, 内容不变时估计值不变, 所以同一个entity在数据库之间移动(MOVE)也不会算错
+ */
+
+const (
+	// key在Data里的开销: dict的节点、DataEntity、key的字符串头
+	keyOverhead = 96
+	// []byte 的切片头
+	sliceOverhead = 24
+	// 链表节点: 前后指针和interface
+	listNodeOverhead = 40
+	// map里的一项: 字符串头、value和桶的开销
+	dictEntryOverhead = 48
+	// 有序集合的一个元素: dict的一项、Element、跳表节点
+	zsetEntryOverhead = 128
+
+	// 统计内存时集合类型抽样的元素个数
+	memorySamples = 5
+)
+
+// 估计key和value占用的内存, samples 是集合类型抽样的元素个数, 为0时计算所有元素
+func estimateMemory(key string, entity *DataEntity, samples int) int64 {
+	size := int64(keyOverhead + len(key))
+	switch val := entity.Data.(type) {
+	case []byte:
+		size += int64(sliceOverhead + len(val))
+	case bitmap.BitMap:
+		size += int64(sliceOverhead + len(val))
+	case *List.LinkedList:
+		size += sampleSize(val.Llen(), samples, func(consumer func(elemSize int) bool) {
+			val.Foreach(func(i int, elem interface{}) bool {
+				bytes, _ := elem.([]byte)
+				return consumer(listNodeOverhead + sliceOverhead + len(bytes))
+			})
+		})
+	case *set.Set:
+		size += sampleSize(val.Len(), samples, func(consumer func(elemSize int) bool) {
+			val.ForEach(func(member string) bool {
+				return consumer(dictEntryOverhead + len(member))
+			})
+		})
+	case dict.Dict:
+		size += sampleSize(val.Len(), samples, func(consumer func(elemSize int) bool) {
+			val.ForEach(func(field string, raw interface{}) bool {
+				bytes, _ := raw.([]byte)
+				return consumer(dictEntryOverhead + len(field) + sliceOverhead + len(bytes))
+			})
+		})
+	case *SortedSet.SortedSet:
+		size += sampleSize(int(val.Len()), samples, func(consumer func(elemSize int) bool) {
+			val.ForEach(0, val.Len(), false, func(element *SortedSet.Element) bool {
+				return consumer(zsetEntryOverhead + len(element.Member))
+			})
+		})
+	}
+	return size
+}
+
+// 遍历前samples个元素, 用平均大小乘以总数
+func sampleSize(total int, samples int, forEach func(consumer func(elemSize int) bool)) int64 {
+	if total == 0 {
+		return 0
+	}
+	sampled := 0
+	sum := int64(0)
+	forEach(func(elemSize int) bool {
+		sum += int64(elemSize)
+		sampled++
+		return samples <= 0 || sampled < samples
+	})
+	if sampled == 0 {
+		return 0
+	}
+	return sum * int64(total) / int64(sampled)
+}
+
+// key的value从old换成了entity, old或entity为nil表示原来没有或者删除了, 调用者持有key的锁
+func (db *DB) replaceMemory(key string, old interface{}, entity *DataEntity) {
+	delta := int64(0)
+	if oldEntity, ok := old.(*DataEntity); ok {
+		delta -= oldEntity.memory
+	}
+	if entity != nil {
+		entity.memory = estimateMemory(key, entity, memorySamples)
+		entity.initAccess(time.Now())
+		delta += entity.memory
+	}
+	if delta != 0 {
+		atomic.AddInt64(&db.usedMemory, delta)
+	}
+}
+
+// value被原地修改之后重新估计, 调用者持有key的锁
+func (db *DB) refreshMemory(keys ...string) {
+	for _, key := range keys {
+		raw, ok := db.Data.Get(key)
+		if !ok {
+			continue
+		}
+		entity, _ := raw.(*DataEntity)
+		memory := estimateMemory(key, entity, memorySamples)
+		if delta := memory - entity.memory; delta != 0 {
+			entity.memory = memory
+			atomic.AddInt64(&db.usedMemory, delta)
+		}
+	}
+}
+
+func (db *DB) UsedMemory() int64 {
+	return atomic.LoadInt64(&db.usedMemory)
+}
+
+func (mdb *MultiDB) UsedMemory() int64 {
+	var total int64
+	for _, db := range mdb.dbSet {
+		total += db.UsedMemory()
+	}
+	return total
+}
+
+// --- LRU/LFU ---
+
+// 和redis一样, 新的key的LFU计数器从5开始, 免得刚写入就被淘汰
+const lfuInitVal = 5
+
+// 第一次放进Data时初始化访问信息, 已经放过的entity(比如被MOVE)保留原来的
+func (entity *DataEntity) initAccess(now time.Time) {
+	if atomic.LoadInt64(&entity.accessTime) != 0 {
+		return
+	}
+	atomic.StoreInt64(&entity.accessTime, now.UnixNano()/1e6)
+	atomic.StoreUint32(&entity.lfuCounter, lfuInitVal)
+	atomic.StoreUint32(&entity.lfuDecrTime, uint32(now.Unix()/60))
+}
+
+func (entity *DataEntity) updateAccess(now time.Time) {
+	atomic.StoreInt64(&entity.accessTime, now.UnixNano()/1e6)
+	counter := entity.lfuIncr(entity.lfuDecr(now))
+	atomic.StoreUint32(&entity.lfuCounter, counter)
+	atomic.StoreUint32(&entity.lfuDecrTime, uint32(now.Unix()/60))
+}
+
+// 距离上次访问的毫秒数
+func (entity *DataEntity) idleTime(now time.Time) int64 {
+	return now.UnixNano()/1e6 - atomic.LoadInt64(&entity.accessTime)
+}
+
+// 每过 lfu-decay-time 分钟计数器减一, 返回衰减之后的值
+func (entity *DataEntity) lfuDecr(now time.Time) uint32 {
+	counter := atomic.LoadUint32(&entity.lfuCounter)
+	decayTime := config.Properties.LfuDecayTime
+	if decayTime <= 0 {
+		return counter
+	}
+	elapsed := uint32(now.Unix()/60) - atomic.LoadUint32(&entity.lfuDecrTime)
+	periods := elapsed / uint32(decayTime)
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// 对数增长, 计数器越大加一的概率越小, 最大255
+func (entity *DataEntity) lfuIncr(counter uint32) uint32 {
+	if counter >= 255 {
+		return 255
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	p := 1.0 / (base*float64(config.Properties.LfuLogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
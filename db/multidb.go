@@ -0,0 +1,425 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"redis.simple/config"
+	"redis.simple/interface/redis"
+	"redis.simple/lib/logger"
+	"redis.simple/pubsub"
+	"redis.simple/redis/reply"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	MultiDB 是整个服务端的存储, 里面有 databases 个DB
+	client 只记下SELECT的下标, 命令交给对应的DB执行
+	AOF、订阅和主动过期这些和具体数据库无关的东西放在这里
+	AOF里用SELECT标记后面的命令属于哪个数据库, 重放和重写时据此恢复到原来的数据库
+ */
+type MultiDB struct {
+	dbSet []*DB
+
+	hub *pubsub.Hub
+
+	// 有写命令的事务执行时独占(写锁), 其他命令执行时持有读锁
+	// 这样事务执行期间不会有别的命令写AOF, 事务的AOF可以攒起来作为一个 MULTI ... EXEC 写入
+	// FLUSHDB/FLUSHALL/SWAPDB 换掉Data时也独占, 不经过Exec的过期删除持有读锁
+	txMu sync.RWMutex
+	// 事务执行期间产生的AOF, 不为nil时addAof先放在这里, 由txMu的写锁保护
+	aofTx []*payload
+
+	// Lua脚本的缓存和正在执行的脚本
+	scripts *scriptCache
+	// FUNCTION LOAD 加载的函数库
+	functions *functionLibs
+
+	// 后台定时任务每秒执行的次数, 来自配置 hz
+	hz int
+	// 下一个主动过期周期从哪个数据库开始, 时间不够时下次接着做后面的数据库
+	expireCursor int
+	// 主动过期的统计, 用atomic读写
+	expireStats expireStats
+
+	// 淘汰的key的个数, 用atomic读写
+	evictedKeys int64
+	// 随机淘汰时从哪个数据库开始, 用atomic读写
+	evictCursor int32
+
+	// 命令发送介质(将需要记录的命令发送过去）
+	aofChan chan *payload
+	// append file 文件描述符
+	aofFile *os.File
+
+	aofFilename string
+
+	// 重写缓冲, 不为nil时handleAof把命令也追加到这里, 重写结束时写进新文件
+	// 只有handleAof持有pausingAof的读锁追加, 重写持有写锁读取和清空, 所以不会丢也不会挡住写入
+	aofRewriteBuf []*payload
+	// 是否正在重写, 用atomic读写, 同时只能有一个重写
+	aofRewriting int32
+	// 当前重写开始的时间(UnixNano)和上一次重写用的秒数(-1表示还没有重写过), 用atomic读写
+	aofRewriteStart   int64
+	aofLastRewriteSec int64
+	// 上一次重写的结果 ok/err
+	aofLastRewriteStatus atomic.Value
+	// 暂停操作
+	pausingAof sync.RWMutex
+	// AOF文件里最后一条SELECT的下标, -1表示还没写过
+	// 只有handleAof协程和持有pausingAof写锁的重写会访问
+	aofCurrentDB int
+
+	// appendfsync 的配置
+	aofFsync string
+	// 编码好了但还没写进文件的命令, 写入失败时留着重试, 和aofCurrentDB一样只有handleAof和重写访问
+	aofPending []byte
+	// AOF文件的大小, 用atomic读写
+	aofFileSize int64
+	// 启动时或上一次重写之后AOF文件的大小, 自动重写按它计算增长, 用atomic读写
+	aofRewriteBaseSize int64
+	// 连续写入(或fsync)失败的次数和最后一次的错误, 用atomic读写
+	aofWriteErrCount int32
+	aofLastError     atomic.Value
+	// 关闭时停止everysec的后台fsync
+	aofSyncStop chan struct{}
+}
+
+func MakeMultiDB() *MultiDB {
+	databases := config.Properties.Databases
+	if databases <= 0 {
+		databases = 16
+	}
+	mdb := &MultiDB{
+		dbSet:             make([]*DB, databases),
+		hub:               pubsub.MakeHub(),
+		hz:                normalizeHz(config.Properties.Hz),
+		scripts:           makeScriptCache(),
+		functions:         makeFunctionLibs(),
+		aofCurrentDB:      -1,
+		aofLastRewriteSec: -1,
+	}
+	for i := range mdb.dbSet {
+		db := makeDB(i)
+		db.addAof = func(cmd *reply.MultiBulkReply) {
+			mdb.addAof(db.index, cmd)
+		}
+		db.txMu = &mdb.txMu
+		mdb.dbSet[i] = db
+	}
+
+	if config.Properties.AppendOnly {
+		mdb.aofFilename = config.Properties.AppendFilename
+		mdb.aofFsync = strings.ToLower(config.Properties.AppendFsync)
+		if mdb.aofFsync != fsyncAlways && mdb.aofFsync != fsyncNo {
+			mdb.aofFsync = fsyncEverySec
+		}
+		// 重放时设置的过期任务可能马上就到期, 等加载完再删
+		mdb.txMu.Lock()
+		err := mdb.loadAof(0)
+		mdb.txMu.Unlock()
+		if err != nil {
+			mdb.handleAofLoadError(err)
+		}
+		aofFile, err := os.OpenFile(mdb.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			logger.Warn(err)
+		} else {
+			mdb.aofFile = aofFile
+			mdb.initAofSize()
+			atomic.StoreInt64(&mdb.aofRewriteBaseSize, mdb.aofSize())
+			mdb.aofChan = make(chan *payload, aofQueueSize)
+			go func() {
+				mdb.handleAof()  // Aof主协程(里边在重写时开启另一个协程?是不是?)
+			}()
+			if mdb.aofFsync == fsyncEverySec {
+				mdb.aofSyncStop = make(chan struct{})
+				go mdb.syncAofEverySec()
+			}
+		}
+	}
+
+	// start timer worker
+	mdb.Timertask()
+	return mdb
+}
+
+func (mdb *MultiDB) Exec(c redis.Connection, args [][]byte) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &reply.UnknownErrReply{}
+		}
+	}()
+
+	cmd := strings.ToLower(string(args[0]))
+
+	// 事务相关的命令
+	switch cmd {
+	case "multi", "exec", "discard", "watch", "unwatch":
+		return execTxCommand(mdb, c, cmd, args)
+	}
+	if c != nil && c.InMultiState() {
+		// 入队时AOF已经写不进去的话让EXEC放弃整个事务
+		// 入队时不淘汰key, 内存和AOF的状态到EXEC时会再检查一次
+		if command, ok := router[cmd]; ok {
+			if errReply := mdb.checkAofStatus(command.forArgs(args)); errReply != nil {
+				c.AddTxError(errReply)
+				return errReply
+			}
+		}
+		return enqueueCmd(c, args)
+	}
+	// 脚本自己独占MultiDB, SCRIPT KILL 要在脚本执行期间也能执行, 所以都不拿txMu的读锁
+	switch cmd {
+	case "eval", "evalsha", "fcall", "fcall_ro":
+		return execScript(mdb, c, cmd, args)
+	case "script":
+		if len(args) < 2 {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		return ScriptCommand(mdb, args[1:])
+	case "function":
+		// FUNCTION KILL 和 SCRIPT KILL 一样, 其他的FUNCTION子命令按普通命令执行
+		if len(args) == 2 && strings.ToLower(string(args[1])) == "kill" {
+			return mdb.scripts.kill()
+		}
+	}
+
+	// 换掉整个数据库Data的命令要等其他命令都执行完
+	if command, ok := router[cmd]; ok && command.isExclusive() {
+		mdb.txMu.Lock()
+		defer mdb.txMu.Unlock()
+	} else {
+		mdb.txMu.RLock()
+		defer mdb.txMu.RUnlock()
+	}
+
+	if errReply := mdb.checkWriteCommand(args); errReply != nil {
+		return errReply
+	}
+
+	// 先处理特殊命令
+	if cmd == "subscribe" {
+		if len(args) < 2 {
+			return &reply.ArgNumErrReply{Cmd: "subscribe"}
+		}
+		return pubsub.Subscribe(mdb.hub, c, args[1:])
+	} else if cmd == "publish" {
+		return pubsub.Publish(mdb.hub, args[1:])
+	} else if cmd == "unsubscribe" {
+		return pubsub.UnSubscribe(mdb.hub, c, args[1:])
+	} else if cmd == "bgrewriteaof" {
+		reply := BGRewriteAOF(mdb, args[1:])
+		return reply
+	} else if cmd == "select" {
+		if len(args) != 2 {
+			return &reply.ArgNumErrReply{Cmd: "select"}
+		}
+		return execSelect(mdb, c, args[1:])
+	}
+
+	// 没有连接时(比如内部调用)在0号数据库执行
+	dbIndex := 0
+	if c != nil {
+		dbIndex = c.GetDBIndex()
+	}
+	command, ok := router[cmd]
+	if ok && command.multiExecutor != nil {
+		if !command.validateArity(args) {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		result = command.multiExecutor(mdb, dbIndex, args[1:])
+		// MOVE/COPY/SWAPDB 可能让别的数据库里等待的client可以继续了
+		if command.forArgs(args).isWrite() {
+			for _, db := range mdb.dbSet {
+				db.handleReadyKeys()
+			}
+		}
+		return result
+	}
+	return mdb.dbSet[dbIndex].Exec(c, args)
+}
+
+// 写命令执行之前的检查: AOF写不进去时拒绝, 超过maxmemory时先淘汰, 调用者持有txMu
+// args 包括命令名, FUNCTION 这类命令要看子命令才知道是不是写命令
+func (mdb *MultiDB) checkWriteCommand(args [][]byte) reply.ErrorReply {
+	command, ok := router[strings.ToLower(string(args[0]))]
+	if !ok {
+		return nil
+	}
+	command = command.forArgs(args)
+	if errReply := mdb.checkAofStatus(command); errReply != nil {
+		return errReply
+	}
+	return mdb.checkMemory(command)
+}
+
+func (mdb *MultiDB) Close() {
+	for _, db := range mdb.dbSet {
+		db.releaseAllBlocked()
+	}
+	if mdb.aofSyncStop != nil {
+		close(mdb.aofSyncStop)
+	}
+	if mdb.aofFile != nil {
+		// 不管是哪种appendfsync, 关闭之前都fsync一次
+		if err := mdb.aofFile.Sync(); err != nil {
+			logger.Warn(err)
+		}
+		err := mdb.aofFile.Close()
+		if err != nil {
+			logger.Warn(err)
+		}
+	}
+}
+
+func (mdb *MultiDB) AfterClientClose(c redis.Connection) {
+	// 阻塞期间client不能执行SELECT, 所以只会阻塞在当前的数据库
+	mdb.dbSet[c.GetDBIndex()].releaseBlocked(c)
+	pubsub.UnSubscribeAll(mdb.hub, c)
+	unwatchAll(mdb, c)
+}
+
+func (mdb *MultiDB) parseDBIndex(raw []byte) (int, reply.ErrorReply) {
+	dbIndex, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return 0, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if dbIndex < 0 || dbIndex >= len(mdb.dbSet) {
+		return 0, reply.MakeErrReply("ERR DB index is out of range")
+	}
+	return dbIndex, nil
+}
+
+// SELECT index
+// 只改变client的状态, 不记录AOF(AOF里的SELECT由handleAof按需写入)
+func execSelect(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	dbIndex, errReply := mdb.parseDBIndex(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	if c != nil {
+		c.SelectDB(dbIndex)
+	}
+	return &reply.OkReply{}
+}
+
+// SWAPDB index1 index2
+// 只交换两个数据库的数据, 阻塞的client还留在原来的下标, 换过来的数据里可能就有它们等待的key
+// 时间轮里的过期任务跟着DB走, 交换之后由惰性删除和主动过期处理
+// 调用者独占MultiDB(flagExclusive), 没有别的命令持有这两个数据库里key的锁
+func SwapDB(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	index1, errReply := mdb.parseDBIndex(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	index2, errReply := mdb.parseDBIndex(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	if index1 != index2 {
+		db1, db2 := mdb.dbSet[index1], mdb.dbSet[index2]
+		db1.Data, db2.Data = db2.Data, db1.Data
+		db1.TTLMap, db2.TTLMap = db2.TTLMap, db1.TTLMap
+		memory1 := atomic.LoadInt64(&db1.usedMemory)
+		atomic.StoreInt64(&db1.usedMemory, atomic.LoadInt64(&db2.usedMemory))
+		atomic.StoreInt64(&db2.usedMemory, memory1)
+		db1.touchAllKeys()
+		db2.touchAllKeys()
+		db1.signalAllBlockedKeys()
+		db2.signalAllBlockedKeys()
+	}
+	mdb.addAof(dbIndex, makeAofCmd("swapdb", args))
+	return &reply.OkReply{}
+}
+
+// --- 主动过期 ---
+
+const (
+	// 每个周期最多占用 1/hz 秒里的这个百分比
+	activeExpireCycleTimePerc = 25
+
+	minHz = 1
+	maxHz = 500
+)
+
+type expireStats struct {
+	// 因为时间限制而提前结束的周期数
+	timeCapReached int64
+	// 估计的过期但还没删除的key的比例, float64 的bit
+	stalePerc uint64
+}
+
+func normalizeHz(hz int) int {
+	if hz < minHz {
+		return minHz
+	}
+	if hz > maxHz {
+		return maxHz
+	}
+	return hz
+}
+
+// 一个主动过期周期, 依次处理各个数据库, 所有数据库共用一个时间限制
+func (mdb *MultiDB) activeExpireCycle() {
+	mdb.txMu.RLock()
+	defer mdb.txMu.RUnlock()
+	timeLimit := time.Second * activeExpireCycleTimePerc / 100 / time.Duration(mdb.hz)
+	deadline := time.Now().Add(timeLimit)
+	sampled := 0
+	expired := 0
+	dbNum := len(mdb.dbSet)
+	for i := 0; i < dbNum; i++ {
+		index := (mdb.expireCursor + i) % dbNum
+		dbSampled, dbExpired, timedOut := mdb.dbSet[index].CleanExpired(deadline)
+		sampled += dbSampled
+		expired += dbExpired
+		if timedOut {
+			atomic.AddInt64(&mdb.expireStats.timeCapReached, 1)
+			mdb.expireCursor = index
+			break
+		}
+	}
+
+	// 和redis一样取移动平均, 单个周期的比例波动太大
+	current := 0.0
+	if sampled > 0 {
+		current = float64(expired) / float64(sampled)
+	}
+	old := math.Float64frombits(atomic.LoadUint64(&mdb.expireStats.stalePerc))
+	atomic.StoreUint64(&mdb.expireStats.stalePerc, math.Float64bits(current*0.05+old*0.95))
+}
+
+func (mdb *MultiDB) ExpiredKeys() int64 {
+	var total int64
+	for _, db := range mdb.dbSet {
+		total += db.ExpiredKeys()
+	}
+	return total
+}
+
+func (mdb *MultiDB) ExpiredTimeCapReached() int64 {
+	return atomic.LoadInt64(&mdb.expireStats.timeCapReached)
+}
+
+// 返回百分比
+func (mdb *MultiDB) ExpiredStalePerc() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&mdb.expireStats.stalePerc)) * 100
+}
+
+// 每秒执行hz次
+func (mdb *MultiDB) Timertask() {
+	ticker := time.NewTicker(time.Second / time.Duration(mdb.hz))
+	go func() {
+		for range ticker.C {
+			mdb.activeExpireCycle()
+			mdb.rewriteAofIfNeeded()
+		}
+	}()
+}
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"fmt"
+	"redis.simple/config"
+	"redis.simple/datastruct/bitmap"
+	"redis.simple/datastruct/dict"
+	List "redis.simple/datastruct/list"
+	"redis.simple/datastruct/set"
+	SortedSet "redis.simple/datastruct/sortedset"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT 和 MEMORY USAGE|STATS|DOCTOR
+	这些命令只查看key, 不算一次访问, 不会改变LRU/LFU的信息
+	MEMORY 用的是memory.go里按value结构估计的大小, 不是Go运行时实际分配的内存
+ */
+
+const (
+	// 和redis一样, 不超过44字节的字符串是embstr
+	embstrSizeLimit = 44
+
+	// MEMORY DOCTOR 每个数据库抽样的key的个数
+	doctorSamples = 100
+	// 超过这个大小的key算作大key
+	bigKeyMemory = 1 << 20
+	// 最多报告几个大key
+	doctorBigKeys = 5
+	// 内存用到maxmemory的这个百分比时提醒
+	doctorMaxMemoryPerc = 90
+)
+
+// 按Go里的结构起名字, string和redis一样区分int/embstr/raw
+func objectEncoding(entity *DataEntity) string {
+	switch val := entity.Data.(type) {
+	case []byte:
+		if len(val) <= 20 {
+			if _, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+				return "int"
+			}
+		}
+		if len(val) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case bitmap.BitMap:
+		return "raw"
+	case *List.LinkedList:
+		return "linkedlist"
+	case *set.Set, dict.Dict:
+		return "hashtable"
+	case *SortedSet.SortedSet:
+		return "skiplist"
+	}
+	return "raw"
+}
+
+// 集合类型的元素个数, 字符串的长度
+func entityLen(entity *DataEntity) int64 {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return int64(len(val))
+	case bitmap.BitMap:
+		return int64(len(val))
+	case *List.LinkedList:
+		return int64(val.Llen())
+	case *set.Set:
+		return int64(val.Len())
+	case dict.Dict:
+		return int64(val.Len())
+	case *SortedSet.SortedSet:
+		return val.Len()
+	}
+	return 0
+}
+
+// OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key
+// 访问信息一直都在记录, 所以IDLETIME和FREQ不管是什么淘汰策略都可以用
+func Object(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	entity, ok := db.peek(string(args[1]))
+	if !ok {
+		return &reply.NullBulkReply{}
+	}
+	switch subCmd {
+	case "encoding":
+		return reply.MakeBulkReply([]byte(objectEncoding(entity)))
+	case "idletime":
+		return reply.MakeIntReply(entity.idleTime(time.Now()) / 1000)
+	case "freq":
+		return reply.MakeIntReply(int64(entity.lfuDecr(time.Now())))
+	case "refcount":
+		// 没有共享的对象
+		return reply.MakeIntReply(1)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try OBJECT HELP.")
+}
+
+// MEMORY USAGE|STATS|DOCTOR, args 不包含MEMORY
+// USAGE 自己给key加读锁, 所以和COPY一样不能放进事务和脚本
+func Memory(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "usage":
+		return memoryUsage(mdb.dbSet[dbIndex], args[1:])
+	case "stats":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "memory|stats"}
+		}
+		return memoryStats(mdb)
+	case "doctor":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "memory|doctor"}
+		}
+		return reply.MakeBulkReply([]byte(memoryDoctor(mdb)))
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try MEMORY HELP.")
+}
+
+// MEMORY USAGE key [SAMPLES count]
+// count 为0时计算所有元素, 默认和统计内存时一样抽样5个
+func memoryUsage(db *DB, args [][]byte) redis.Reply {
+	if len(args) != 1 && len(args) != 3 {
+		return &reply.ArgNumErrReply{Cmd: "memory|usage"}
+	}
+	samples := memorySamples
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[1])) != "SAMPLES" {
+			return &reply.SyntaxErrReply{}
+		}
+		var err error
+		samples, err = strconv.Atoi(string(args[2]))
+		if err != nil || samples < 0 {
+			return reply.MakeErrReply("ERR value is out of range, must be positive")
+		}
+	}
+	key := string(args[0])
+	db.RLock(key)
+	defer db.RUnLock(key)
+	entity, ok := db.peek(key)
+	if !ok {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeIntReply(estimateMemory(key, entity, samples))
+}
+
+func memoryStats(mdb *MultiDB) redis.Reply {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	_, scriptSize := mdb.scripts.stats()
+	_, functionSize := mdb.functions.stats()
+
+	result := []redis.Reply{
+		reply.MakeBulkReply([]byte("total.allocated")),
+		reply.MakeIntReply(int64(memStats.HeapAlloc)),
+		reply.MakeBulkReply([]byte("lua.caches")),
+		reply.MakeIntReply(scriptSize),
+		reply.MakeBulkReply([]byte("functions.caches")),
+		reply.MakeIntReply(functionSize),
+	}
+	keys := int64(0)
+	dataset := int64(0)
+	for _, db := range mdb.dbSet {
+		dbKeys := int64(db.Data.Len())
+		if dbKeys == 0 {
+			continue
+		}
+		result = append(result,
+			reply.MakeBulkReply([]byte("db."+strconv.Itoa(db.index))),
+			reply.MakeMultiRawReply([]redis.Reply{
+				reply.MakeBulkReply([]byte("keys")),
+				reply.MakeIntReply(dbKeys),
+				reply.MakeBulkReply([]byte("expires")),
+				reply.MakeIntReply(int64(db.TTLMap.Len())),
+				reply.MakeBulkReply([]byte("dataset.bytes")),
+				reply.MakeIntReply(db.UsedMemory()),
+			}))
+		keys += dbKeys
+		dataset += db.UsedMemory()
+	}
+	bytesPerKey := int64(0)
+	if keys > 0 {
+		bytesPerKey = dataset / keys
+	}
+	datasetPerc := 0.0
+	if memStats.HeapAlloc > 0 {
+		datasetPerc = float64(dataset) * 100 / float64(memStats.HeapAlloc)
+	}
+	result = append(result,
+		reply.MakeBulkReply([]byte("keys.count")),
+		reply.MakeIntReply(keys),
+		reply.MakeBulkReply([]byte("keys.bytes-per-key")),
+		reply.MakeIntReply(bytesPerKey),
+		reply.MakeBulkReply([]byte("dataset.bytes")),
+		reply.MakeIntReply(dataset),
+		reply.MakeBulkReply([]byte("dataset.percentage")),
+		reply.MakeBulkReply([]byte(strconv.FormatFloat(datasetPerc, 'f', 2, 64))),
+	)
+	return reply.MakeMultiRawReply(result)
+}
+
+type bigKey struct {
+	dbIndex int
+	key     string
+	memory  int64
+	// 类型、编码和长度, 在锁里取好
+	desc string
+}
+
+// 每个数据库抽样一些key, 找出估计超过bigKeyMemory的, 按大小排序
+func (mdb *MultiDB) sampleBigKeys() []*bigKey {
+	result := make([]*bigKey, 0)
+	for _, db := range mdb.dbSet {
+		if db.Data.Len() == 0 {
+			continue
+		}
+		for _, key := range db.Data.RandomDistinctKeys(doctorSamples) {
+			// 估计的大小在写入时已经算好了, 直接读entity.memory要加锁
+			db.RLock(key)
+			entity, ok := db.peek(key)
+			if ok && entity.memory >= bigKeyMemory {
+				result = append(result, &bigKey{
+					dbIndex: db.index,
+					key:     key,
+					memory:  entity.memory,
+					desc:    fmt.Sprintf("%s, %s, length %d", typeName(entity), objectEncoding(entity), entityLen(entity)),
+				})
+			}
+			db.RUnLock(key)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].memory > result[j].memory
+	})
+	if len(result) > doctorBigKeys {
+		result = result[:doctorBigKeys]
+	}
+	return result
+}
+
+// 和redis一样返回一段给人看的文字
+func memoryDoctor(mdb *MultiDB) string {
+	keys := 0
+	for _, db := range mdb.dbSet {
+		keys += db.Data.Len()
+	}
+	if keys == 0 {
+		return "Hi Sam, this instance is empty or is using very little memory, " +
+			"my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data."
+	}
+
+	issues := make([]string, 0)
+	used := mdb.UsedMemory()
+	maxMemory := config.Properties.MaxMemory
+	if maxMemory > 0 && used*100 >= maxMemory*doctorMaxMemoryPerc {
+		issue := fmt.Sprintf("Used memory (%d bytes) is %d%% of maxmemory (%d bytes).",
+			used, used*100/maxMemory, maxMemory)
+		if _, ok := evictionPolicies[strings.ToLower(config.Properties.MaxMemoryPolicy)]; !ok {
+			issue += " The maxmemory-policy is " + config.Properties.MaxMemoryPolicy +
+				", write commands will fail with OOM once the limit is reached."
+		}
+		issues = append(issues, issue)
+	}
+	if evicted := mdb.EvictedKeys(); evicted > 0 {
+		issues = append(issues, fmt.Sprintf("%d keys have been evicted because of maxmemory, "+
+			"consider raising maxmemory if this instance is not meant to be a cache.", evicted))
+	}
+	for _, big := range mdb.sampleBigKeys() {
+		issues = append(issues, fmt.Sprintf("Big key '%s' in db%d uses about %d bytes (%s).",
+			big.key, big.dbIndex, big.memory, big.desc))
+	}
+
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. " +
+			"I can only account for what occurs on this base."
+	}
+	var builder strings.Builder
+	builder.WriteString("Sam, I detected a few issues in this instance memory implants:\n\n")
+	for _, issue := range issues {
+		builder.WriteString(" * " + issue + "\n\n")
+	}
+	builder.WriteString("I'm here to keep you safe, Sam. I want to help you.\n")
+	return builder.String()
+}
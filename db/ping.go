@@ -0,0 +1,16 @@
+package db
+
+import (
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+)
+
+func Ping(db *DB, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return &reply.PongReply{}
+	} else if len(args) == 1 {
+		return reply.MakeBulkReply(args[0])
+	} else {
+		return &reply.ArgNumErrReply{Cmd: "ping"}
+	}
+}
@@ -0,0 +1,372 @@
+package db
+
+import (
+	"redis.simple/interface/redis"
+	"strconv"
+)
+
+// 普通命令的执行函数, args 不包含命令名
+type CmdFunc func(db *DB, args [][]byte) redis.Reply
+
+// 写命令的执行函数, 除了回复还返回要不要写AOF以及写成什么样(见extra)
+// 执行函数自己不写AOF, 由调用者在释放key的锁之前统一写入
+type WriteCmdFunc func(db *DB, args [][]byte) (redis.Reply, *extra)
+
+// 跨数据库命令(MOVE、SWAPDB等)的执行函数, dbIndex 是client当前的数据库
+// 这类命令自己加锁, 也自己写AOF
+type MultiCmdFunc func(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply
+
+// 命令标记
+const (
+	// 会修改数据库, 需要写锁, 也只有这类命令需要AOF
+	flagWrite = 1 << iota
+	// 只读命令
+	flagReadOnly
+	// 阻塞命令, 有连接时由Exec挂起等待, 其他情况(比如AOF重放)执行函数只尝试一次
+	flagBlocking
+	// 不能放进事务的命令, MOVE/COPY 自己加锁, 和EXEC加的锁会冲突
+	flagNoMulti
+	// 不能在Lua脚本里调用的命令, 除了自己加锁的命令还有EVAL本身
+	flagNoScript
+	// 执行Lua的命令(EVAL/FCALL), 脚本和函数库的LState不能并发使用, 所以要独占MultiDB, 只读的FCALL_RO也一样
+	flagScript
+	// 只会减少内存的写命令(DEL、FLUSHDB等), 超过maxmemory时也可以执行
+	flagAllowOOM
+	// 会换掉整个数据库的Data(FLUSHDB、FLUSHALL、SWAPDB), 要独占MultiDB, 不能和其他命令或者后台的过期删除同时执行
+	flagExclusive
+)
+
+// 命令表中的一项
+// 除了执行函数之外还记录了参数个数, 读写标记和key的位置
+// Exec用它做参数检查, AOF、集群路由和COMMAND INFO也都从这里取元信息
+type command struct {
+	name     string
+	executor CmdFunc
+	// 单个数据库里的写命令只有writeExecutor
+	writeExecutor WriteCmdFunc
+	// 跨数据库的命令只有multiExecutor, 由MultiDB执行
+	multiExecutor MultiCmdFunc
+	// 和redis一样, arity 包括命令名本身
+	// arity > 0 表示参数个数固定, arity < 0 表示参数个数至少为 -arity
+	arity int
+	flags int
+	// key 的位置(命令名是第0个), firstKey 为0表示没有key
+	// lastKey 为负数时从后往前数, -1 就是最后一个参数
+	firstKey int
+	lastKey  int
+	keyStep  int
+	// key 的位置不固定时(比如 ZUNIONSTORE 的 numkeys)由 getKeys 自己解析
+	getKeys func(args [][]byte) []string
+	// 读写和子命令有关时(比如 FUNCTION)由 getFlags 根据参数决定flags, args 包括命令名
+	getFlags func(args [][]byte) int
+}
+
+func (cmd *command) validateArity(args [][]byte) bool {
+	argNum := len(args)
+	if cmd.arity >= 0 {
+		return argNum == cmd.arity
+	}
+	return argNum >= -cmd.arity
+}
+
+func (cmd *command) isWrite() bool {
+	return cmd.flags&flagWrite != 0
+}
+
+func (cmd *command) isReadOnly() bool {
+	return cmd.flags&flagReadOnly != 0
+}
+
+func (cmd *command) isBlocking() bool {
+	return cmd.flags&flagBlocking != 0
+}
+
+func (cmd *command) isNoMulti() bool {
+	return cmd.flags&flagNoMulti != 0
+}
+
+func (cmd *command) isNoScript() bool {
+	return cmd.flags&flagNoScript != 0
+}
+
+func (cmd *command) isScript() bool {
+	return cmd.flags&flagScript != 0
+}
+
+func (cmd *command) isAllowOOM() bool {
+	return cmd.flags&flagAllowOOM != 0
+}
+
+func (cmd *command) isExclusive() bool {
+	return cmd.flags&flagExclusive != 0
+}
+
+// 返回这一次调用的命令, 有getFlags时换成按参数决定的flags, 其他命令原样返回
+func (cmd *command) forArgs(args [][]byte) *command {
+	if cmd.getFlags == nil {
+		return cmd
+	}
+	resolved := *cmd
+	resolved.flags = cmd.getFlags(args)
+	return &resolved
+}
+
+// 跨数据库的命令, 要交给MultiDB执行
+func (cmd *command) isMultiDB() bool {
+	return cmd.multiExecutor != nil
+}
+
+// 在db上执行单个数据库里的命令, 调用者已经锁住了key
+// 写命令的AOF在这里写入, 这时还持有key的锁, AOF里的顺序和实际执行的顺序一致
+func (cmd *command) execute(db *DB, cmdLine [][]byte) redis.Reply {
+	if cmd.writeExecutor == nil {
+		return cmd.executor(db, cmdLine[1:])
+	}
+	result, ex := cmd.writeExecutor(db, cmdLine[1:])
+	db.persist(cmdLine, ex)
+	return result
+}
+
+// 取出命令里所有的key, args 包括命令名
+func (cmd *command) keys(args [][]byte) []string {
+	if cmd.getKeys != nil {
+		return cmd.getKeys(args)
+	}
+	if cmd.firstKey <= 0 || cmd.firstKey >= len(args) {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	step := cmd.keyStep
+	if step <= 0 {
+		step = 1
+	}
+	keys := make([]string, 0, (last-cmd.firstKey)/step+1)
+	for i := cmd.firstKey; i <= last; i += step {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
+
+// 用于 SINTERCARD/ZUNIONSTORE 这类带 numkeys 的命令
+// numkeys 在 args[numKeysIndex], 后面紧跟着 numkeys 个key, 在它之前的参数(除了命令名)也都是key
+// numkeys 不合法时返回nil, 由执行函数报错
+func numKeysGetter(numKeysIndex int) func(args [][]byte) []string {
+	return func(args [][]byte) []string {
+		if numKeysIndex >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(string(args[numKeysIndex]))
+		if err != nil || n <= 0 || numKeysIndex+n >= len(args) {
+			return nil
+		}
+		keys := make([]string, 0, numKeysIndex-1+n)
+		for _, arg := range args[1:numKeysIndex] {
+			keys = append(keys, string(arg))
+		}
+		for _, arg := range args[numKeysIndex+1 : numKeysIndex+1+n] {
+			keys = append(keys, string(arg))
+		}
+		return keys
+	}
+}
+
+func registerCommand(routerMap map[string]*command, name string, executor CmdFunc, arity int, flags int,
+	firstKey int, lastKey int, keyStep int) *command {
+	cmd := &command{
+		name:     name,
+		executor: executor,
+		arity:    arity,
+		flags:    flags,
+		firstKey: firstKey,
+		lastKey:  lastKey,
+		keyStep:  keyStep,
+	}
+	routerMap[name] = cmd
+	return cmd
+}
+
+// 单个数据库里的写命令, flags 里总是带上flagWrite
+func registerWriteCommand(routerMap map[string]*command, name string, executor WriteCmdFunc, arity int,
+	flags int, firstKey int, lastKey int, keyStep int) *command {
+	cmd := registerCommand(routerMap, name, nil, arity, flags|flagWrite, firstKey, lastKey, keyStep)
+	cmd.writeExecutor = executor
+	return cmd
+}
+
+func registerMultiDBCommand(routerMap map[string]*command, name string, executor MultiCmdFunc, arity int,
+	flags int, firstKey int, lastKey int, keyStep int) *command {
+	cmd := registerCommand(routerMap, name, nil, arity, flags, firstKey, lastKey, keyStep)
+	cmd.multiExecutor = executor
+	return cmd
+}
+
+func MakeRouter() map[string]*command {
+	routerMap := make(map[string]*command)
+
+	registerCommand(routerMap, "ping", Ping, -1, flagReadOnly, 0, 0, 0)
+	registerMultiDBCommand(routerMap, "info", Info, -1, flagReadOnly, 0, 0, 0)
+
+	// keys
+	registerWriteCommand(routerMap, "del", Del, -2, flagWrite|flagAllowOOM, 1, -1, 1)
+	registerWriteCommand(routerMap, "unlink", Del, -2, flagWrite|flagAllowOOM, 1, -1, 1)
+	registerCommand(routerMap, "exists", Exists, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "type", Type, 2, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "rename", Rename, 3, flagWrite, 1, 2, 1)
+	registerWriteCommand(routerMap, "renamenx", RenameNX, 3, flagWrite, 1, 2, 1)
+	registerMultiDBCommand(routerMap, "copy", Copy, -3, flagWrite|flagNoMulti|flagNoScript, 1, 2, 1)
+	registerMultiDBCommand(routerMap, "move", Move, 3, flagWrite|flagNoMulti|flagNoScript, 1, 1, 1)
+	registerCommand(routerMap, "keys", Keys, 2, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "scan", Scan, -2, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "randomkey", RandomKey, 1, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "dbsize", DBSize, 1, flagReadOnly, 0, 0, 0)
+	registerWriteCommand(routerMap, "flushdb", FlushDB, -1, flagWrite|flagAllowOOM|flagExclusive, 0, 0, 0)
+	registerMultiDBCommand(routerMap, "flushall", FlushAll, -1, flagWrite|flagAllowOOM|flagExclusive, 0, 0, 0)
+	registerMultiDBCommand(routerMap, "swapdb", SwapDB, 3, flagWrite|flagExclusive, 0, 0, 0)
+
+	// introspection
+	registerCommand(routerMap, "object", Object, 3, flagReadOnly, 2, 2, 1)
+	registerMultiDBCommand(routerMap, "memory", Memory, -2, flagReadOnly|flagNoMulti|flagNoScript, 2, 2, 1)
+
+	// script
+	// 直接执行时由MultiDB独占执行, 这里注册的执行函数用于事务里的EVAL, 那时key已经由EXEC锁住了
+	registerMultiDBCommand(routerMap, "eval", Eval, -3, flagWrite|flagScript|flagNoScript, 0, 0, 0).getKeys = evalKeys
+	registerMultiDBCommand(routerMap, "evalsha", EvalSha, -3, flagWrite|flagScript|flagNoScript, 0, 0, 0).getKeys = evalKeys
+	registerMultiDBCommand(routerMap, "fcall", FCall, -3, flagWrite|flagScript|flagNoScript, 0, 0, 0).getKeys = evalKeys
+	registerMultiDBCommand(routerMap, "fcall_ro", FCallRO, -3, flagReadOnly|flagScript|flagNoScript, 0, 0, 0).getKeys = evalKeys
+	registerMultiDBCommand(routerMap, "function", FunctionCommand, -2, flagReadOnly|flagNoScript, 0, 0, 0).getFlags = functionFlags
+
+	// ttl
+	registerWriteCommand(routerMap, "expire", Expire, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "pexpire", PExpire, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "expireat", ExpireAt, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "pexpireat", PExpireAt, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "ttl", TTL, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "pttl", PTTL, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "expiretime", ExpireTime, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "pexpiretime", PExpireTime, 2, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "persist", Persist, 2, flagWrite, 1, 1, 1)
+
+	// string
+	registerCommand(routerMap, "get", Get, 2, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "set", Set, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "setnx", SetNX, 3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "setex", SetEX, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "psetex", PSetEX, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "mset", MSet, -3, flagWrite, 1, -1, 2)
+	registerWriteCommand(routerMap, "msetnx", MSetNX, -3, flagWrite, 1, -1, 2)
+	registerCommand(routerMap, "mget", MGet, -2, flagReadOnly, 1, -1, 1)
+	registerWriteCommand(routerMap, "getset", GetSet, 3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "getdel", GetDel, 2, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "getex", GetEX, -2, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "incr", Incr, 2, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "incrby", IncrBy, 3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "incrbyfloat", IncrByFloat, 3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "decr", Decr, 2, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "decrby", DecrBy, 3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "append", Append, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "strlen", StrLen, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "getrange", GetRange, 4, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "setrange", SetRange, 4, flagWrite, 1, 1, 1)
+
+	// list
+	registerWriteCommand(routerMap, "lpush", LPush, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "lpushx", LPushX, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "rpush", RPush, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "rpushx", RPushX, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "lpop", LPop, -2, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "rpop", RPop, -2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "llen", LLen, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "lindex", LIndex, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "lrange", LRange, 4, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "lrem", LRem, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "lset", LSet, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "linsert", LInsert, 5, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "ltrim", LTrim, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "lpos", LPos, -3, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "lmove", LMove, 5, flagWrite, 1, 2, 1)
+	registerWriteCommand(routerMap, "rpoplpush", RPopLPush, 3, flagWrite, 1, 2, 1)
+	registerWriteCommand(routerMap, "blpop", BLPop, -3, flagWrite|flagBlocking, 1, -2, 1)
+	registerWriteCommand(routerMap, "brpop", BRPop, -3, flagWrite|flagBlocking, 1, -2, 1)
+	registerWriteCommand(routerMap, "blmove", BLMove, 6, flagWrite|flagBlocking, 1, 2, 1)
+	registerWriteCommand(routerMap, "brpoplpush", BRPopLPush, 4, flagWrite|flagBlocking, 1, 2, 1)
+
+	// hash
+	registerWriteCommand(routerMap, "hset", HSet, -4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "hsetnx", HSetNX, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "hmset", HMSet, -4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hget", HGet, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hmget", HMGet, -3, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "hdel", HDel, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hexists", HExists, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hlen", HLen, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hstrlen", HStrLen, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hkeys", HKeys, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hvals", HVals, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hgetall", HGetAll, 2, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "hincrby", HIncrBy, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "hincrbyfloat", HIncrByFloat, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hrandfield", HRandField, -2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hscan", HScan, -3, flagReadOnly, 1, 1, 1)
+
+	// set
+	registerWriteCommand(routerMap, "sadd", SAdd, -3, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "srem", SRem, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "sismember", SIsMember, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "smismember", SMIsMember, -3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "smembers", SMembers, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "scard", SCard, 2, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "spop", SPop, -2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "srandmember", SRandMember, -2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "sinter", SInter, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "sunion", SUnion, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "sdiff", SDiff, -2, flagReadOnly, 1, -1, 1)
+	registerWriteCommand(routerMap, "sinterstore", SInterStore, -3, flagWrite, 1, -1, 1)
+	registerWriteCommand(routerMap, "sunionstore", SUnionStore, -3, flagWrite, 1, -1, 1)
+	registerWriteCommand(routerMap, "sdiffstore", SDiffStore, -3, flagWrite, 1, -1, 1)
+	registerCommand(routerMap, "sintercard", SInterCard, -3, flagReadOnly, 0, 0, 0).getKeys = numKeysGetter(1)
+	registerWriteCommand(routerMap, "smove", SMove, 4, flagWrite, 1, 2, 1)
+	registerCommand(routerMap, "sscan", SScan, -3, flagReadOnly, 1, 1, 1)
+
+	// sorted set
+	registerWriteCommand(routerMap, "zadd", ZAdd, -4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "zincrby", ZIncrBy, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "zscore", ZScore, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zmscore", ZMScore, -3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zcard", ZCard, 2, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "zrem", ZRem, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "zrank", ZRank, -3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrevrank", ZRevRank, -3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrange", ZRange, -4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrevrange", ZRevRange, -4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrangebyscore", ZRangeByScore, -4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrevrangebyscore", ZRevRangeByScore, -4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrangebylex", ZRangeByLex, -4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrevrangebylex", ZRevRangeByLex, -4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zcount", ZCount, 4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zlexcount", ZLexCount, 4, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "zremrangebylex", ZRemRangeByLex, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "zremrangebyscore", ZRemRangeByScore, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "zremrangebyrank", ZRemRangeByRank, 4, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "zpopmin", ZPopMin, -2, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "zpopmax", ZPopMax, -2, flagWrite, 1, 1, 1)
+	registerWriteCommand(routerMap, "zunionstore", ZUnionStore, -4, flagWrite, 0, 0, 0).getKeys = numKeysGetter(2)
+	registerWriteCommand(routerMap, "zinterstore", ZInterStore, -4, flagWrite, 0, 0, 0).getKeys = numKeysGetter(2)
+	registerCommand(routerMap, "zscan", ZScan, -3, flagReadOnly, 1, 1, 1)
+
+	// bitmap
+	registerWriteCommand(routerMap, "setbit", SetBit, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "getbit", GetBit, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "bitcount", BitCount, -2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "bitpos", BitPos, -3, flagReadOnly, 1, 1, 1)
+	registerWriteCommand(routerMap, "bitop", BitOp, -4, flagWrite, 2, -1, 1)
+	registerWriteCommand(routerMap, "bitfield", BitField, -2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "bitfield_ro", BitFieldRO, -2, flagReadOnly, 1, 1, 1)
+
+	return routerMap
+}
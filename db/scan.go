@@ -0,0 +1,113 @@
+package db
+
+import (
+	"redis.simple/interface/redis"
+	"redis.simple/lib/wildcard"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	SCAN/SSCAN/HSCAN/ZSCAN 都基于 dict.Dict 的Scan
+	cursor 记录了shard和shard里的位置, 每次只锁一个shard, 不会像KEYS那样一次遍历整个数据库
+	整个遍历过程中一直存在的key至少返回一次, 中间增删的key可能返回也可能不返回
+ */
+
+type scanOptions struct {
+	pattern string
+	count   int
+	// 只有SCAN可以按类型过滤, 为空时不过滤
+	typeName string
+}
+
+func (opts *scanOptions) match(key string) bool {
+	return opts.pattern == "*" || wildcard.Match(opts.pattern, key)
+}
+
+var scanTypeNames = map[string]bool{
+	"string": true,
+	"list":   true,
+	"hash":   true,
+	"set":    true,
+	"zset":   true,
+}
+
+// 解析 [MATCH pattern] [COUNT count] [TYPE type], allowType 为false时不接受TYPE
+func parseScanOptions(args [][]byte, allowType bool) (*scanOptions, reply.ErrorReply) {
+	opts := &scanOptions{
+		pattern: "*",
+		count:   10,
+	}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, &reply.SyntaxErrReply{}
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			opts.pattern = string(args[i+1])
+		case "COUNT":
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if n < 1 {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			opts.count = int(n)
+		case "TYPE":
+			if !allowType {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			opts.typeName = strings.ToLower(string(args[i+1]))
+			if !scanTypeNames[opts.typeName] {
+				return nil, reply.MakeErrReply("ERR unknown type name '" + string(args[i+1]) + "'")
+			}
+		default:
+			return nil, &reply.SyntaxErrReply{}
+		}
+	}
+	return opts, nil
+}
+
+func parseCursor(raw []byte) (uint64, reply.ErrorReply) {
+	cursor, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0, reply.MakeErrReply("ERR invalid cursor")
+	}
+	return cursor, nil
+}
+
+func makeScanReply(cursor uint64, items [][]byte) redis.Reply {
+	return reply.MakeMultiRawReply([]redis.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		reply.MakeMultiBulkReply(items),
+	})
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// MATCH和TYPE是在取出来之后再过滤的, 所以一次返回的个数可能比COUNT少, 甚至为0
+func Scan(db *DB, args [][]byte) redis.Reply {
+	cursor, errReply := parseCursor(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	opts, errReply := parseScanOptions(args[1:], true)
+	if errReply != nil {
+		return errReply
+	}
+	now := time.Now()
+	keys := make([][]byte, 0)
+	next := db.Data.Scan(cursor, opts.count, func(key string, val interface{}) {
+		// 在Scan的回调里不持有shard的锁, 不过这里只判断不删除, 删除交给过期的定时任务
+		if db.expiredAt(key, now) || !opts.match(key) {
+			return
+		}
+		if opts.typeName != "" && typeName(val.(*DataEntity)) != opts.typeName {
+			return
+		}
+		keys = append(keys, []byte(key))
+	})
+	return makeScanReply(next, keys)
+}
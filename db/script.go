@@ -0,0 +1,309 @@
+package db
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	EVAL/EVALSHA/SCRIPT, FCALL/FCALL_RO 也走这里的流程(函数库在function.go)
+	脚本执行期间独占MultiDB(txMu的写锁), 和事务一样是原子的, 声明的KEYS也会加锁
+	脚本里的写命令在AOF里记录的是命令本身(和redis的effects replication一样), 作为一个 MULTI ... EXEC 写入
+	所以重放的时候不需要脚本, SCRIPT LOAD 也不用持久化
+ */
+
+type luaScript struct {
+	sha   string
+	body  string
+	proto *lua.FunctionProto
+}
+
+// 正在执行的脚本, SCRIPT KILL 用
+type runningScript struct {
+	cancel context.CancelFunc
+	// 已经执行过写命令的脚本不能KILL, 否则数据库会停在脚本的中间状态
+	written bool
+	killed  bool
+}
+
+type scriptCache struct {
+	mu      sync.Mutex
+	scripts map[string]*luaScript
+	running *runningScript
+}
+
+func makeScriptCache() *scriptCache {
+	return &scriptCache{
+		scripts: make(map[string]*luaScript),
+	}
+}
+
+func sha1Hex(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// 编译脚本并放进缓存, 已经有了就直接返回
+func (cache *scriptCache) load(body string) (*luaScript, reply.ErrorReply) {
+	sha := sha1Hex(body)
+	if script, ok := cache.get(sha); ok {
+		return script, nil
+	}
+	chunk, err := parse.Parse(strings.NewReader(body), "@user_script")
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR Error compiling script (new function): " + err.Error())
+	}
+	proto, err := lua.Compile(chunk, "@user_script")
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR Error compiling script (new function): " + err.Error())
+	}
+	script := &luaScript{
+		sha:   sha,
+		body:  body,
+		proto: proto,
+	}
+	cache.mu.Lock()
+	cache.scripts[sha] = script
+	cache.mu.Unlock()
+	return script, nil
+}
+
+func (cache *scriptCache) get(sha string) (*luaScript, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	script, ok := cache.scripts[strings.ToLower(sha)]
+	return script, ok
+}
+
+// 缓存的脚本的个数和代码的总长度, MEMORY STATS 用
+func (cache *scriptCache) stats() (int, int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	size := int64(0)
+	for _, script := range cache.scripts {
+		size += int64(len(script.body))
+	}
+	return len(cache.scripts), size
+}
+
+func (cache *scriptCache) flush() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.scripts = make(map[string]*luaScript)
+}
+
+func (cache *scriptCache) setRunning(run *runningScript) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.running = run
+}
+
+// 脚本要执行写命令了, 已经被KILL时返回false
+func (cache *scriptCache) markWritten(run *runningScript) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if run.killed {
+		return false
+	}
+	run.written = true
+	return true
+}
+
+func (cache *scriptCache) kill() redis.Reply {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	run := cache.running
+	if run == nil {
+		return reply.MakeErrReply("NOTBUSY No scripts in execution right now.")
+	}
+	if run.written {
+		return reply.MakeErrReply("UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	run.killed = true
+	run.cancel()
+	return &reply.OkReply{}
+}
+
+// EVAL/EVALSHA/FCALL 的key: args[2] 是numkeys, 后面紧跟着numkeys个key
+func evalKeys(args [][]byte) []string {
+	if len(args) < 3 {
+		return nil
+	}
+	n, err := strconv.Atoi(string(args[2]))
+	if err != nil || n <= 0 || 3+n > len(args) {
+		return nil
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = string(args[3+i])
+	}
+	return keys
+}
+
+// 执行脚本的函数, 调用者锁住key并且独占MultiDB
+type scriptRunner func(dbIndex int) redis.Reply
+
+// 解析 script|sha|function numkeys [key ...] [arg ...], args 不包含命令名
+// 脚本不存在、编译失败这些错误在加锁之前就返回
+func (mdb *MultiDB) prepareScript(cmd string, args [][]byte) (scriptRunner, redis.Reply) {
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, reply.MakeErrReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-2 {
+		return nil, reply.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys, argv := args[2:2+numKeys], args[2+numKeys:]
+
+	switch cmd {
+	case "fcall", "fcall_ro":
+		readOnly := cmd == "fcall_ro"
+		fn, errReply := mdb.functions.getFunction(string(args[0]), readOnly)
+		if errReply != nil {
+			return nil, errReply
+		}
+		return func(dbIndex int) redis.Reply {
+			return mdb.runFunction(dbIndex, fn, keys, argv, readOnly)
+		}, nil
+	case "evalsha":
+		script, ok := mdb.scripts.get(string(args[0]))
+		if !ok {
+			return nil, reply.MakeErrReply("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return func(dbIndex int) redis.Reply {
+			return mdb.runScript(dbIndex, script, keys, argv)
+		}, nil
+	}
+	script, errReply := mdb.scripts.load(string(args[0]))
+	if errReply != nil {
+		return nil, errReply
+	}
+	return func(dbIndex int) redis.Reply {
+		return mdb.runScript(dbIndex, script, keys, argv)
+	}, nil
+}
+
+// 直接执行的EVAL/EVALSHA/FCALL/FCALL_RO, args 包含命令名
+func execScript(mdb *MultiDB, c redis.Connection, cmd string, args [][]byte) redis.Reply {
+	if !router[cmd].validateArity(args) {
+		return &reply.ArgNumErrReply{Cmd: cmd}
+	}
+	run, errReply := mdb.prepareScript(cmd, args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	dbIndex := 0
+	if c != nil {
+		dbIndex = c.GetDBIndex()
+	}
+	lockKeys := evalKeys(args)
+	db := mdb.dbSet[dbIndex]
+
+	mdb.txMu.Lock()
+	defer mdb.txMu.Unlock()
+	// 淘汰的DEL要在aofTx之前直接写入AOF
+	if errReply := mdb.checkWriteCommand(args); errReply != nil {
+		return errReply
+	}
+	mdb.aofTx = make([]*payload, 0)
+	result := func() redis.Reply {
+		defer mdb.flushAofTx()
+		// 不知道脚本会怎么用这些key, 都加写锁
+		db.Locks(lockKeys...)
+		defer db.UnLocks(lockKeys...)
+		return run(dbIndex)
+	}()
+	for _, db := range mdb.dbSet {
+		db.handleReadyKeys()
+	}
+	return result
+}
+
+// 事务里的EVAL/EVALSHA/FCALL/FCALL_RO, EXEC已经锁住了key并且独占了MultiDB
+func execScriptLocked(mdb *MultiDB, cmd string, dbIndex int, args [][]byte) redis.Reply {
+	run, errReply := mdb.prepareScript(cmd, args)
+	if errReply != nil {
+		return errReply
+	}
+	return run(dbIndex)
+}
+
+func Eval(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	return execScriptLocked(mdb, "eval", dbIndex, args)
+}
+
+func EvalSha(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	return execScriptLocked(mdb, "evalsha", dbIndex, args)
+}
+
+func FCall(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	return execScriptLocked(mdb, "fcall", dbIndex, args)
+}
+
+func FCallRO(mdb *MultiDB, dbIndex int, args [][]byte) redis.Reply {
+	return execScriptLocked(mdb, "fcall_ro", dbIndex, args)
+}
+
+// SCRIPT LOAD|EXISTS|FLUSH|KILL, args 不包含SCRIPT
+func ScriptCommand(mdb *MultiDB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "load":
+		if len(args) != 2 {
+			return &reply.ArgNumErrReply{Cmd: "script|load"}
+		}
+		script, errReply := mdb.scripts.load(string(args[1]))
+		if errReply != nil {
+			return errReply
+		}
+		return reply.MakeBulkReply([]byte(script.sha))
+	case "exists":
+		if len(args) < 2 {
+			return &reply.ArgNumErrReply{Cmd: "script|exists"}
+		}
+		result := make([]redis.Reply, len(args)-1)
+		for i, sha := range args[1:] {
+			_, ok := mdb.scripts.get(string(sha))
+			result[i] = reply.MakeIntReply(boolToInt(ok))
+		}
+		return reply.MakeMultiRawReply(result)
+	case "flush":
+		// ASYNC 和 SYNC 都是同步清空
+		if len(args) > 2 {
+			return &reply.ArgNumErrReply{Cmd: "script|flush"}
+		}
+		if len(args) == 2 {
+			mode := strings.ToUpper(string(args[1]))
+			if mode != "ASYNC" && mode != "SYNC" {
+				return &reply.SyntaxErrReply{}
+			}
+		}
+		mdb.scripts.flush()
+		return &reply.OkReply{}
+	case "kill":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "script|kill"}
+		}
+		return mdb.scripts.kill()
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try SCRIPT HELP.")
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,443 @@
+package db
+
+import (
+	"math"
+	"redis.simple/datastruct/set"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+	多个key的命令(SINTER/SUNIONSTORE/SMOVE...)涉及的key都由Exec统一加锁,
+	所以这里的读取和写入整体上是原子的
+ */
+
+func (db *DB) getAsSet(key string) (*set.Set, reply.ErrorReply) {
+	entity, ok := db.GET(key)
+	if !ok {
+		return nil, nil
+	}
+	s, ok := entity.Data.(*set.Set)
+	if !ok {
+		return nil, &reply.WrongTypeErrReply{}
+	}
+	return s, nil
+}
+
+// 不存在就创建并放进DB
+func (db *DB) getOrInitSet(key string) (s *set.Set, isNew bool, errReply reply.ErrorReply) {
+	s, errReply = db.getAsSet(key)
+	if errReply != nil {
+		return nil, false, errReply
+	}
+	isNew = false
+	if s == nil {
+		s = set.Make()
+		db.PUT(key, &DataEntity{
+			Data: s,
+		})
+		isNew = true
+	}
+	return s, isNew, nil
+}
+
+func (db *DB) removeIfEmptySet(key string, s *set.Set) {
+	if s.Len() == 0 {
+		db.Remove(key)
+	}
+}
+
+func membersToBytes(members []string) [][]byte {
+	result := make([][]byte, len(members))
+	for i, member := range members {
+		result[i] = []byte(member)
+	}
+	return result
+}
+
+func SAdd(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	s, _, errReply := db.getOrInitSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	added := 0
+	for _, member := range args[1:] {
+		added += s.Add(string(member))
+	}
+	return reply.MakeIntReply(int64(added)), persistAsIs
+}
+
+func SRem(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	s, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if s == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	removed := 0
+	for _, member := range args[1:] {
+		removed += s.Remove(string(member))
+	}
+	if removed == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	db.removeIfEmptySet(key, s)
+	return reply.MakeIntReply(int64(removed)), persistAsIs
+}
+
+func SIsMember(db *DB, args [][]byte) redis.Reply {
+	s, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s != nil && s.Has(string(args[1])) {
+		return reply.MakeIntReply(1)
+	}
+	return reply.MakeIntReply(0)
+}
+
+func SMIsMember(db *DB, args [][]byte) redis.Reply {
+	s, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(args)-1)
+	for i, member := range args[1:] {
+		if s != nil && s.Has(string(member)) {
+			result[i] = reply.MakeIntReply(1)
+		} else {
+			result[i] = reply.MakeIntReply(0)
+		}
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+func SMembers(db *DB, args [][]byte) redis.Reply {
+	s, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	return reply.MakeMultiBulkReply(membersToBytes(s.ToSlice()))
+}
+
+func SCard(db *DB, args [][]byte) redis.Reply {
+	s, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(int64(s.Len()))
+}
+
+// SPOP key [count]
+// 弹出的元素是随机的, AOF里记为SREM, 重放的时候结果才一致
+func SPop(db *DB, args [][]byte) (redis.Reply, *extra) {
+	if len(args) > 2 {
+		return &reply.SyntaxErrReply{}, nil
+	}
+	key := string(args[0])
+	count := int64(1)
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count < 0 {
+			return reply.MakeErrReply("ERR value is out of range, must be positive"), nil
+		}
+	}
+	s, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if s == nil {
+		if len(args) == 1 {
+			return &reply.NullBulkReply{}, nil
+		}
+		return &reply.EmptyMultiBulkReply{}, nil
+	}
+	if count > int64(s.Len()) {
+		count = int64(s.Len())
+	}
+	members := s.RandomDistinctMembers(int(count))
+	for _, member := range members {
+		s.Remove(member)
+	}
+	db.removeIfEmptySet(key, s)
+	popped := membersToBytes(members)
+	var ex *extra
+	if len(popped) > 0 {
+		ex = persistAs(makeAofCmd("srem", append([][]byte{args[0]}, popped...)))
+	}
+	if len(args) == 1 {
+		return reply.MakeBulkReply(popped[0]), ex
+	}
+	return reply.MakeMultiBulkReply(popped), ex
+}
+
+// SRANDMEMBER key [count]
+// count 为正数时返回不重复的元素, 负数时可以重复, 个数是 -count
+func SRandMember(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 2 {
+		return &reply.SyntaxErrReply{}
+	}
+	s, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 1 {
+		if s == nil {
+			return &reply.NullBulkReply{}
+		}
+		return reply.MakeBulkReply([]byte(s.RandomMembers(1)[0]))
+	}
+	count, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if s == nil || count == 0 {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	if count > 0 {
+		return reply.MakeMultiBulkReply(membersToBytes(s.RandomDistinctMembers(int(count))))
+	}
+	if count < math.MinInt64/2 {
+		return reply.MakeErrReply("ERR value is out of range")
+	}
+	return reply.MakeMultiBulkReply(membersToBytes(s.RandomMembers(int(-count))))
+}
+
+const (
+	setInter = iota
+	setUnion
+	setDiff
+)
+
+// SINTER/SUNION/SDIFF 的计算, 不存在的key当作空集合
+// 返回的是新的集合, 可以直接存到别的key里
+func (db *DB) setOperation(keys []string, op int) (*set.Set, reply.ErrorReply) {
+	sets := make([]*set.Set, len(keys))
+	for i, key := range keys {
+		s, errReply := db.getAsSet(key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		sets[i] = s
+	}
+
+	var result *set.Set
+	switch op {
+	case setInter:
+		for _, s := range sets {
+			if s == nil {
+				return set.Make(), nil
+			}
+		}
+		result = sets[0].Union(set.Make())
+		for _, s := range sets[1:] {
+			result = result.Intersect(s)
+		}
+	case setUnion:
+		result = set.Make()
+		for _, s := range sets {
+			if s != nil {
+				result = result.Union(s)
+			}
+		}
+	case setDiff:
+		if sets[0] == nil {
+			return set.Make(), nil
+		}
+		result = sets[0].Union(set.Make())
+		for _, s := range sets[1:] {
+			if s != nil {
+				result = result.Diff(s)
+			}
+		}
+	}
+	return result, nil
+}
+
+func setOperationCommand(db *DB, args [][]byte, op int) redis.Reply {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	result, errReply := db.setOperation(keys, op)
+	if errReply != nil {
+		return errReply
+	}
+	if result.Len() == 0 {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	return reply.MakeMultiBulkReply(membersToBytes(result.ToSlice()))
+}
+
+// 结果存到destination, 原来的值(不管什么类型)和过期时间都会被覆盖
+func setOperationStore(db *DB, args [][]byte, op int) (redis.Reply, *extra) {
+	dest := string(args[0])
+	keys := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		keys[i] = string(arg)
+	}
+	result, errReply := db.setOperation(keys, op)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if result.Len() == 0 {
+		db.Remove(dest)
+	} else {
+		db.PUT(dest, &DataEntity{
+			Data: result,
+		})
+		db.Persist(dest)
+	}
+	return reply.MakeIntReply(int64(result.Len())), persistAsIs
+}
+
+func SInter(db *DB, args [][]byte) redis.Reply {
+	return setOperationCommand(db, args, setInter)
+}
+
+func SUnion(db *DB, args [][]byte) redis.Reply {
+	return setOperationCommand(db, args, setUnion)
+}
+
+func SDiff(db *DB, args [][]byte) redis.Reply {
+	return setOperationCommand(db, args, setDiff)
+}
+
+func SInterStore(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return setOperationStore(db, args, setInter)
+}
+
+func SUnionStore(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return setOperationStore(db, args, setUnion)
+}
+
+func SDiffStore(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return setOperationStore(db, args, setDiff)
+}
+
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+// 遍历最小的集合, 数到limit就停下来
+func SInterCard(db *DB, args [][]byte) redis.Reply {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys <= 0 {
+		return reply.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-1) {
+		return reply.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	limit := int64(0)
+	rest := args[1+numKeys:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(string(rest[0])) != "LIMIT" {
+			return &reply.SyntaxErrReply{}
+		}
+		limit, err = strconv.ParseInt(string(rest[1]), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR LIMIT can't be negative")
+		}
+		if limit < 0 {
+			return reply.MakeErrReply("ERR LIMIT can't be negative")
+		}
+	}
+
+	sets := make([]*set.Set, numKeys)
+	empty := false
+	for i, arg := range args[1 : 1+numKeys] {
+		s, errReply := db.getAsSet(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		if s == nil {
+			empty = true
+		}
+		sets[i] = s
+	}
+	if empty {
+		return reply.MakeIntReply(0)
+	}
+	smallest := 0
+	for i, s := range sets {
+		if s.Len() < sets[smallest].Len() {
+			smallest = i
+		}
+	}
+	var count int64
+	sets[smallest].ForEach(func(member string) bool {
+		for i, s := range sets {
+			if i != smallest && !s.Has(member) {
+				return true
+			}
+		}
+		count++
+		return limit == 0 || count < limit
+	})
+	return reply.MakeIntReply(count)
+}
+
+// SMOVE source destination member
+func SMove(db *DB, args [][]byte) (redis.Reply, *extra) {
+	src := string(args[0])
+	dest := string(args[1])
+	member := string(args[2])
+	srcSet, errReply := db.getAsSet(src)
+	if errReply != nil {
+		return errReply, nil
+	}
+	destSet, errReply := db.getAsSet(dest)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if srcSet == nil || !srcSet.Has(member) {
+		return reply.MakeIntReply(0), nil
+	}
+	if src == dest {
+		return reply.MakeIntReply(1), nil
+	}
+	if destSet == nil {
+		destSet, _, _ = db.getOrInitSet(dest)
+	}
+	srcSet.Move(destSet, member)
+	db.removeIfEmptySet(src, srcSet)
+	return reply.MakeIntReply(1), persistAsIs
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func SScan(db *DB, args [][]byte) redis.Reply {
+	cursor, errReply := parseCursor(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	opts, errReply := parseScanOptions(args[2:], false)
+	if errReply != nil {
+		return errReply
+	}
+	set, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if set == nil {
+		return makeScanReply(0, [][]byte{})
+	}
+	members := make([][]byte, 0)
+	next := set.Scan(cursor, opts.count, func(member string) {
+		if opts.match(member) {
+			members = append(members, []byte(member))
+		}
+	})
+	return makeScanReply(next, members)
+}
@@ -0,0 +1,921 @@
+package db
+
+import (
+	"math"
+	"redis.simple/datastruct/set"
+	SortedSet "redis.simple/datastruct/sortedset"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+)
+
+func (db *DB) getAsSortedSet(key string) (*SortedSet.SortedSet, reply.ErrorReply) {
+	entity, ok := db.GET(key)
+	if !ok {
+		return nil, nil
+	}
+	zset, ok := entity.Data.(*SortedSet.SortedSet)
+	if !ok {
+		return nil, &reply.WrongTypeErrReply{}
+	}
+	return zset, nil
+}
+
+// 不存在就创建并放进DB
+func (db *DB) getOrInitSortedSet(key string) (zset *SortedSet.SortedSet, isNew bool, errReply reply.ErrorReply) {
+	zset, errReply = db.getAsSortedSet(key)
+	if errReply != nil {
+		return nil, false, errReply
+	}
+	isNew = false
+	if zset == nil {
+		zset = SortedSet.Make()
+		db.PUT(key, &DataEntity{
+			Data: zset,
+		})
+		isNew = true
+	}
+	return zset, isNew, nil
+}
+
+func (db *DB) removeIfEmptySortedSet(key string, zset *SortedSet.SortedSet) {
+	if zset.Len() == 0 {
+		db.Remove(key)
+	}
+}
+
+// score 可以是 inf/-inf, 但不能是 nan
+func parseScore(raw []byte) (float64, reply.ErrorReply) {
+	score, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, reply.MakeErrReply("ERR value is not a valid float")
+	}
+	return score, nil
+}
+
+// 和redis一样输出 inf/-inf, 数值太大或太小时才用科学计数法
+func formatScore(score float64) string {
+	if math.IsInf(score, 1) {
+		return "inf"
+	}
+	if math.IsInf(score, -1) {
+		return "-inf"
+	}
+	abs := math.Abs(score)
+	if abs != 0 && (abs < 1e-4 || abs >= 1e17) {
+		return strconv.FormatFloat(score, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+func elementsReply(elements []*SortedSet.Element, withScores bool) redis.Reply {
+	size := len(elements)
+	if withScores {
+		size *= 2
+	}
+	result := make([][]byte, 0, size)
+	for _, element := range elements {
+		result = append(result, []byte(element.Member))
+		if withScores {
+			result = append(result, []byte(formatScore(element.Score)))
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func ZAdd(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return &reply.SyntaxErrReply{}, nil
+	}
+	if nx && xx {
+		return reply.MakeErrReply("ERR XX and NX options at the same time are not compatible"), nil
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return reply.MakeErrReply("ERR GT, LT, and/or NX options at the same time are not compatible"), nil
+	}
+	if incr && len(pairs) != 2 {
+		return reply.MakeErrReply("ERR INCR option supports a single increment-element pair"), nil
+	}
+	// 先检查完所有的score再修改, 出错时什么都不做
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, errReply := parseScore(pairs[j*2])
+		if errReply != nil {
+			return errReply, nil
+		}
+		scores[j] = score
+	}
+
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if zset == nil {
+		if xx {
+			if incr {
+				return &reply.NullBulkReply{}, nil
+			}
+			return reply.MakeIntReply(0), nil
+		}
+		zset, _, _ = db.getOrInitSortedSet(key)
+	}
+
+	added, changed := 0, 0
+	var newScore float64
+	for j, score := range scores {
+		member := string(pairs[j*2+1])
+		element, exists := zset.Get(member)
+		if (exists && nx) || (!exists && xx) {
+			if incr {
+				return &reply.NullBulkReply{}, nil
+			}
+			continue
+		}
+		newScore = score
+		if exists && incr {
+			newScore = element.Score + score
+			if math.IsNaN(newScore) {
+				return reply.MakeErrReply("ERR resulting score is not a number (NaN)"), nil
+			}
+		}
+		if exists && ((gt && newScore <= element.Score) || (lt && newScore >= element.Score)) {
+			if incr {
+				return &reply.NullBulkReply{}, nil
+			}
+			continue
+		}
+		if !exists {
+			added++
+		} else if newScore != element.Score {
+			changed++
+		}
+		zset.Add(member, newScore)
+	}
+	db.removeIfEmptySortedSet(key, zset)
+	var ex *extra
+	if added+changed > 0 {
+		ex = persistAsIs
+	}
+
+	if incr {
+		return reply.MakeBulkReply([]byte(formatScore(newScore))), ex
+	}
+	if ch {
+		return reply.MakeIntReply(int64(added + changed)), ex
+	}
+	return reply.MakeIntReply(int64(added)), ex
+}
+
+func ZIncrBy(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	delta, errReply := parseScore(args[1])
+	if errReply != nil {
+		return errReply, nil
+	}
+	member := string(args[2])
+	zset, _, errReply := db.getOrInitSortedSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	score := delta
+	if element, exists := zset.Get(member); exists {
+		score = element.Score + delta
+		if math.IsNaN(score) {
+			return reply.MakeErrReply("ERR resulting score is not a number (NaN)"), nil
+		}
+	}
+	zset.Add(member, score)
+	return reply.MakeBulkReply([]byte(formatScore(score))), persistAsIs
+}
+
+func ZScore(db *DB, args [][]byte) redis.Reply {
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return &reply.NullBulkReply{}
+	}
+	element, exists := zset.Get(string(args[1]))
+	if !exists {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply([]byte(formatScore(element.Score)))
+}
+
+func ZMScore(db *DB, args [][]byte) redis.Reply {
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, len(args)-1)
+	if zset == nil {
+		return reply.MakeMultiBulkReply(result)
+	}
+	for i, member := range args[1:] {
+		if element, exists := zset.Get(string(member)); exists {
+			result[i] = []byte(formatScore(element.Score))
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+func ZCard(db *DB, args [][]byte) redis.Reply {
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(zset.Len())
+}
+
+func ZRem(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	var removed int64
+	for _, member := range args[1:] {
+		if zset.Remove(string(member)) {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	db.removeIfEmptySortedSet(key, zset)
+	return reply.MakeIntReply(removed), persistAsIs
+}
+
+// ZRANK/ZREVRANK key member [WITHSCORE]
+func zrank(db *DB, args [][]byte, desc bool) redis.Reply {
+	withScore := false
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[2])) != "WITHSCORE" {
+			return &reply.SyntaxErrReply{}
+		}
+		withScore = true
+	} else if len(args) > 3 {
+		return &reply.SyntaxErrReply{}
+	}
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	var rank int64 = -1
+	if zset != nil {
+		rank = zset.GetRank(string(args[1]), desc)
+	}
+	if rank < 0 {
+		if withScore {
+			return &reply.NullMultiBulkReply{}
+		}
+		return &reply.NullBulkReply{}
+	}
+	if withScore {
+		element, _ := zset.Get(string(args[1]))
+		return reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeIntReply(rank),
+			reply.MakeBulkReply([]byte(formatScore(element.Score))),
+		})
+	}
+	return reply.MakeIntReply(rank)
+}
+
+func ZRank(db *DB, args [][]byte) redis.Reply {
+	return zrank(db, args, false)
+}
+
+func ZRevRank(db *DB, args [][]byte) redis.Reply {
+	return zrank(db, args, true)
+}
+
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// ZRANGE 系列命令解析之后的参数
+type zrangeSpec struct {
+	key        string
+	start      []byte
+	stop       []byte
+	by         int
+	rev        bool
+	withScores bool
+	hasLimit   bool
+	offset     int64
+	// 小于0表示不限制
+	count int64
+}
+
+// 解析 start stop 之后的选项, allowBy 为false时(比如ZRANGEBYSCORE)不能再写BYSCORE/BYLEX/REV
+func parseZRangeOptions(spec *zrangeSpec, args [][]byte, allowBy bool) reply.ErrorReply {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BYSCORE":
+			if !allowBy {
+				return &reply.SyntaxErrReply{}
+			}
+			spec.by = zrangeByScore
+		case "BYLEX":
+			if !allowBy {
+				return &reply.SyntaxErrReply{}
+			}
+			spec.by = zrangeByLex
+		case "REV":
+			if !allowBy {
+				return &reply.SyntaxErrReply{}
+			}
+			spec.rev = true
+		case "WITHSCORES":
+			spec.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return &reply.SyntaxErrReply{}
+			}
+			offset, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			count, err := strconv.ParseInt(string(args[i+2]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			spec.hasLimit = true
+			spec.offset = offset
+			spec.count = count
+			i += 2
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	if spec.hasLimit && spec.by == zrangeByRank {
+		return reply.MakeErrReply("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if spec.withScores && spec.by == zrangeByLex {
+		return reply.MakeErrReply("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	return nil
+}
+
+func zrangeGeneric(db *DB, spec *zrangeSpec) redis.Reply {
+	if !spec.hasLimit {
+		spec.count = -1
+	}
+	switch spec.by {
+	case zrangeByScore:
+		// REV 的时候先写的是max
+		min, max := spec.start, spec.stop
+		if spec.rev {
+			min, max = max, min
+		}
+		minBorder, err := SortedSet.ParseScoreBorder(string(min))
+		if err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		maxBorder, err := SortedSet.ParseScoreBorder(string(max))
+		if err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		zset, errReply := db.getAsSortedSet(spec.key)
+		if errReply != nil {
+			return errReply
+		}
+		if zset == nil || spec.offset < 0 {
+			return &reply.EmptyMultiBulkReply{}
+		}
+		elements := zset.RangeByScore(minBorder, maxBorder, spec.offset, spec.count, spec.rev)
+		return elementsReply(elements, spec.withScores)
+	case zrangeByLex:
+		min, max := spec.start, spec.stop
+		if spec.rev {
+			min, max = max, min
+		}
+		minBorder, err := SortedSet.ParseLexBorder(string(min))
+		if err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		maxBorder, err := SortedSet.ParseLexBorder(string(max))
+		if err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		zset, errReply := db.getAsSortedSet(spec.key)
+		if errReply != nil {
+			return errReply
+		}
+		if zset == nil || spec.offset < 0 {
+			return &reply.EmptyMultiBulkReply{}
+		}
+		elements := zset.RangeByLex(minBorder, maxBorder, spec.offset, spec.count, spec.rev)
+		return elementsReply(elements, false)
+	}
+
+	start, err := strconv.ParseInt(string(spec.start), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	stop, err := strconv.ParseInt(string(spec.stop), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	zset, errReply := db.getAsSortedSet(spec.key)
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	from, to := normalizeRange(int(start), int(stop), int(zset.Len()))
+	if from > to {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	elements := zset.Range(int64(from), int64(to)+1, spec.rev)
+	return elementsReply(elements, spec.withScores)
+}
+
+// ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func ZRange(db *DB, args [][]byte) redis.Reply {
+	spec := &zrangeSpec{
+		key:   string(args[0]),
+		start: args[1],
+		stop:  args[2],
+	}
+	if errReply := parseZRangeOptions(spec, args[3:], true); errReply != nil {
+		return errReply
+	}
+	return zrangeGeneric(db, spec)
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func ZRevRange(db *DB, args [][]byte) redis.Reply {
+	spec := &zrangeSpec{
+		key:   string(args[0]),
+		start: args[1],
+		stop:  args[2],
+		rev:   true,
+	}
+	if errReply := parseZRangeOptions(spec, args[3:], false); errReply != nil {
+		return errReply
+	}
+	return zrangeGeneric(db, spec)
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func ZRangeByScore(db *DB, args [][]byte) redis.Reply {
+	spec := &zrangeSpec{
+		key:   string(args[0]),
+		start: args[1],
+		stop:  args[2],
+		by:    zrangeByScore,
+	}
+	if errReply := parseZRangeOptions(spec, args[3:], false); errReply != nil {
+		return errReply
+	}
+	return zrangeGeneric(db, spec)
+}
+
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func ZRevRangeByScore(db *DB, args [][]byte) redis.Reply {
+	spec := &zrangeSpec{
+		key:   string(args[0]),
+		start: args[1],
+		stop:  args[2],
+		by:    zrangeByScore,
+		rev:   true,
+	}
+	if errReply := parseZRangeOptions(spec, args[3:], false); errReply != nil {
+		return errReply
+	}
+	return zrangeGeneric(db, spec)
+}
+
+// ZRANGEBYLEX key min max [LIMIT offset count]
+func ZRangeByLex(db *DB, args [][]byte) redis.Reply {
+	spec := &zrangeSpec{
+		key:   string(args[0]),
+		start: args[1],
+		stop:  args[2],
+		by:    zrangeByLex,
+	}
+	if errReply := parseZRangeOptions(spec, args[3:], false); errReply != nil {
+		return errReply
+	}
+	return zrangeGeneric(db, spec)
+}
+
+// ZREVRANGEBYLEX key max min [LIMIT offset count]
+func ZRevRangeByLex(db *DB, args [][]byte) redis.Reply {
+	spec := &zrangeSpec{
+		key:   string(args[0]),
+		start: args[1],
+		stop:  args[2],
+		by:    zrangeByLex,
+		rev:   true,
+	}
+	if errReply := parseZRangeOptions(spec, args[3:], false); errReply != nil {
+		return errReply
+	}
+	return zrangeGeneric(db, spec)
+}
+
+func ZLexCount(db *DB, args [][]byte) redis.Reply {
+	min, err := SortedSet.ParseLexBorder(string(args[1]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	max, err := SortedSet.ParseLexBorder(string(args[2]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(zset.LexCount(min, max))
+}
+
+func ZRemRangeByLex(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	min, err := SortedSet.ParseLexBorder(string(args[1]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error()), nil
+	}
+	max, err := SortedSet.ParseLexBorder(string(args[2]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error()), nil
+	}
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	removed := zset.RemoveByLex(min, max)
+	if removed == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	db.removeIfEmptySortedSet(key, zset)
+	return reply.MakeIntReply(removed), persistAsIs
+}
+
+func ZCount(db *DB, args [][]byte) redis.Reply {
+	min, err := SortedSet.ParseScoreBorder(string(args[1]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	max, err := SortedSet.ParseScoreBorder(string(args[2]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(zset.Count(min, max))
+}
+
+func ZRemRangeByScore(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	min, err := SortedSet.ParseScoreBorder(string(args[1]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error()), nil
+	}
+	max, err := SortedSet.ParseScoreBorder(string(args[2]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error()), nil
+	}
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	removed := zset.RemoveByScore(min, max)
+	if removed == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	db.removeIfEmptySortedSet(key, zset)
+	return reply.MakeIntReply(removed), persistAsIs
+}
+
+func ZRemRangeByRank(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	start, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+	}
+	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+	}
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0), nil
+	}
+	from, to := normalizeRange(int(start), int(stop), int(zset.Len()))
+	if from > to {
+		return reply.MakeIntReply(0), nil
+	}
+	removed := zset.RemoveByRank(int64(from), int64(to)+1)
+	if removed == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	db.removeIfEmptySortedSet(key, zset)
+	return reply.MakeIntReply(removed), persistAsIs
+}
+
+// ZPOPMIN/ZPOPMAX key [count]
+func zpop(db *DB, args [][]byte, desc bool) (redis.Reply, *extra) {
+	if len(args) > 2 {
+		return &reply.SyntaxErrReply{}, nil
+	}
+	key := string(args[0])
+	count := int64(1)
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count < 0 {
+			return reply.MakeErrReply("ERR value is out of range, must be positive"), nil
+		}
+	}
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if zset == nil || count == 0 {
+		return &reply.EmptyMultiBulkReply{}, nil
+	}
+	elements := zset.Pop(count, desc)
+	db.removeIfEmptySortedSet(key, zset)
+	return elementsReply(elements, true), persistAsIs
+}
+
+func ZPopMin(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return zpop(db, args, false)
+}
+
+func ZPopMax(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return zpop(db, args, true)
+}
+
+// ZUNIONSTORE/ZINTERSTORE 的一个输入, 普通的set也可以作为输入, score都是1
+type zsetInput struct {
+	zset   *SortedSet.SortedSet
+	set    *set.Set
+	weight float64
+}
+
+func (input *zsetInput) len() int64 {
+	if input.zset != nil {
+		return input.zset.Len()
+	}
+	if input.set != nil {
+		return int64(input.set.Len())
+	}
+	return 0
+}
+
+func (input *zsetInput) forEach(consumer func(member string, score float64)) {
+	if input.zset != nil {
+		input.zset.ForEach(0, input.zset.Len(), false, func(element *SortedSet.Element) bool {
+			consumer(element.Member, element.Score)
+			return true
+		})
+	} else if input.set != nil {
+		input.set.ForEach(func(member string) bool {
+			consumer(member, 1)
+			return true
+		})
+	}
+}
+
+func (input *zsetInput) get(member string) (float64, bool) {
+	if input.zset != nil {
+		element, ok := input.zset.Get(member)
+		if !ok {
+			return 0, false
+		}
+		return element.Score, true
+	}
+	if input.set != nil && input.set.Has(member) {
+		return 1, true
+	}
+	return 0, false
+}
+
+// 和redis一样, inf * 0 这种结果是nan的当作0
+func weightedScore(score float64, weight float64) float64 {
+	result := score * weight
+	if math.IsNaN(result) {
+		return 0
+	}
+	return result
+}
+
+func aggregateScore(aggregate string, a float64, b float64) float64 {
+	switch aggregate {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	result := a + b
+	// inf + -inf
+	if math.IsNaN(result) {
+		return 0
+	}
+	return result
+}
+
+// ZUNIONSTORE/ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX]
+func zsetStore(db *DB, args [][]byte, isUnion bool, cmdName string) (redis.Reply, *extra) {
+	dest := string(args[0])
+	numKeys, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+	}
+	if numKeys < 1 {
+		return reply.MakeErrReply("ERR at least 1 input key is needed for '" + cmdName + "' command"), nil
+	}
+	if numKeys > int64(len(args)-2) {
+		return &reply.SyntaxErrReply{}, nil
+	}
+	keys := args[2 : 2+numKeys]
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "SUM"
+	rest := args[2+numKeys:]
+	for i := 0; i < len(rest); i++ {
+		switch strings.ToUpper(string(rest[i])) {
+		case "WEIGHTS":
+			if int64(len(rest)-i-1) < numKeys {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			for j := range weights {
+				weight, err := strconv.ParseFloat(string(rest[i+1+j]), 64)
+				if err != nil || math.IsNaN(weight) {
+					return reply.MakeErrReply("ERR weight value is not a float"), nil
+				}
+				weights[j] = weight
+			}
+			i += int(numKeys)
+		case "AGGREGATE":
+			if i+1 >= len(rest) {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			aggregate = strings.ToUpper(string(rest[i+1]))
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			i++
+		default:
+			return &reply.SyntaxErrReply{}, nil
+		}
+	}
+
+	inputs := make([]*zsetInput, numKeys)
+	for i, key := range keys {
+		input := &zsetInput{
+			weight: weights[i],
+		}
+		if entity, ok := db.GET(string(key)); ok {
+			switch val := entity.Data.(type) {
+			case *SortedSet.SortedSet:
+				input.zset = val
+			case *set.Set:
+				input.set = val
+			default:
+				return &reply.WrongTypeErrReply{}, nil
+			}
+		}
+		inputs[i] = input
+	}
+
+	result := SortedSet.Make()
+	if isUnion {
+		for _, input := range inputs {
+			input.forEach(func(member string, score float64) {
+				score = weightedScore(score, input.weight)
+				if element, ok := result.Get(member); ok {
+					score = aggregateScore(aggregate, element.Score, score)
+				}
+				result.Add(member, score)
+			})
+		}
+	} else {
+		// 遍历最小的输入, 再去其他输入里找
+		smallest := 0
+		for i, input := range inputs {
+			if input.len() < inputs[smallest].len() {
+				smallest = i
+			}
+		}
+		inputs[smallest].forEach(func(member string, _ float64) {
+			var score float64
+			for i, input := range inputs {
+				memberScore, ok := input.get(member)
+				if !ok {
+					return
+				}
+				memberScore = weightedScore(memberScore, input.weight)
+				if i == 0 {
+					score = memberScore
+				} else {
+					score = aggregateScore(aggregate, score, memberScore)
+				}
+			}
+			result.Add(member, score)
+		})
+	}
+
+	if result.Len() == 0 {
+		db.Remove(dest)
+	} else {
+		db.PUT(dest, &DataEntity{
+			Data: result,
+		})
+		db.Persist(dest)
+	}
+	return reply.MakeIntReply(result.Len()), persistAsIs
+}
+
+func ZUnionStore(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return zsetStore(db, args, true, "zunionstore")
+}
+
+func ZInterStore(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return zsetStore(db, args, false, "zinterstore")
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+// 返回 member score 交替排列
+func ZScan(db *DB, args [][]byte) redis.Reply {
+	cursor, errReply := parseCursor(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	opts, errReply := parseScanOptions(args[2:], false)
+	if errReply != nil {
+		return errReply
+	}
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return makeScanReply(0, [][]byte{})
+	}
+	items := make([][]byte, 0)
+	next := zset.Scan(cursor, opts.count, func(element *SortedSet.Element) {
+		if opts.match(element.Member) {
+			items = append(items, []byte(element.Member), []byte(formatScore(element.Score)))
+		}
+	})
+	return makeScanReply(next, items)
+}
@@ -0,0 +1,540 @@
+package db
+
+import (
+	"math"
+	"math/big"
+	"redis.simple/datastruct/bitmap"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 和redis一样, 字符串最大 512MB
+const maxStringLength = 512 * 1024 * 1024
+
+// 字符串直接以[]byte存放在DataEntity里
+// bitmap也是字符串, 但是会被bit命令原地修改, 所以这里返回一份拷贝
+func (db *DB) getAsString(key string) ([]byte, reply.ErrorReply) {
+	entity, ok := db.GET(key)
+	if !ok {
+		return nil, nil
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		return val, nil
+	case bitmap.BitMap:
+		bytes := make([]byte, len(val))
+		copy(bytes, val)
+		return bytes, nil
+	}
+	return nil, &reply.WrongTypeErrReply{}
+}
+
+func checkStringLength(length int) reply.ErrorReply {
+	if length > maxStringLength {
+		return reply.MakeErrReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	return nil
+}
+
+// 过期时间以毫秒存储, 再大就不能转成 time.Time 了
+const maxExpireMs = math.MaxInt64 / int64(time.Millisecond)
+
+// 解析 EX/PX/EXAT/PXAT 的参数, 返回过期的时间点
+// 相对时间也在这里转为绝对时间, AOF 只记录 PEXPIREAT
+func parseExpireTime(option string, raw []byte, cmdName string) (time.Time, reply.ErrorReply) {
+	val, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return time.Time{}, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	invalidErr := reply.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+	if val <= 0 {
+		return time.Time{}, invalidErr
+	}
+	ms := val
+	if option == "EX" || option == "EXAT" {
+		if val > maxExpireMs/1000 {
+			return time.Time{}, invalidErr
+		}
+		ms = val * 1000
+	}
+	if option == "EX" || option == "PX" {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		if ms > maxExpireMs-now {
+			return time.Time{}, invalidErr
+		}
+		ms += now
+	} else if ms > maxExpireMs {
+		return time.Time{}, invalidErr
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+func Get(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	bytes, err := db.getAsString(key)
+	if err != nil {
+		return err
+	}
+	if bytes == nil {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply(bytes)
+}
+
+const (
+	upsertPolicy = iota // default
+	insertPolicy        // set nx
+	updatePolicy        // set xx
+)
+
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+//     EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func Set(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	value := args[1]
+	policy := upsertPolicy
+	returnOld := false
+	keepTTL := false
+	hasExpire := false
+	var expireAt time.Time
+
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "NX":
+			if policy == updatePolicy {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			policy = insertPolicy
+		case "XX":
+			if policy == insertPolicy {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			policy = updatePolicy
+		case "GET":
+			returnOld = true
+		case "KEEPTTL":
+			if hasExpire {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || keepTTL || i+1 >= len(args) {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			var errReply reply.ErrorReply
+			expireAt, errReply = parseExpireTime(option, args[i+1], "set")
+			if errReply != nil {
+				return errReply, nil
+			}
+			hasExpire = true
+			i++
+		default:
+			return &reply.SyntaxErrReply{}, nil
+		}
+	}
+
+	old, errReply := db.getAsString(key)
+	if returnOld && errReply != nil {
+		// GET 选项要求旧值是字符串
+		return errReply, nil
+	}
+
+	entity := &DataEntity{
+		Data: value,
+	}
+	var result int
+	switch policy {
+	case upsertPolicy:
+		result = 1
+		db.PUT(key, entity)
+	case insertPolicy:
+		result = db.PUTIfAbsent(key, entity)
+	case updatePolicy:
+		result = db.PutIfExists(key, entity)
+	}
+
+	var ex *extra
+	if result > 0 {
+		// NX/XX/GET 在重放时没有意义, 只记录写入的值
+		if hasExpire {
+			db.Expire(key, expireAt)
+			ex = persistAs(makeAofCmd("set", [][]byte{args[0], value}), makeExpireCmd(key, expireAt))
+		} else if keepTTL {
+			ex = persistAs(makeAofCmd("set", [][]byte{args[0], value, []byte("KEEPTTL")}))
+		} else {
+			db.Persist(key)
+			ex = persistAs(makeAofCmd("set", [][]byte{args[0], value}))
+		}
+	}
+
+	if returnOld {
+		if old == nil {
+			return &reply.NullBulkReply{}, ex
+		}
+		return reply.MakeBulkReply(old), ex
+	}
+	if result > 0 {
+		return &reply.OkReply{}, ex
+	}
+	return &reply.NullBulkReply{}, ex
+}
+
+func SetNX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	entity := &DataEntity{
+		Data: args[1],
+	}
+	result := db.PUTIfAbsent(key, entity)
+	if result == 0 {
+		return reply.MakeIntReply(0), nil
+	}
+	return reply.MakeIntReply(1), persistAs(makeAofCmd("set", args))
+}
+
+// SETEX key seconds value
+func SetEX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return setWithTTL(db, args, "EX", "setex")
+}
+
+// PSETEX key milliseconds value
+func PSetEX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return setWithTTL(db, args, "PX", "psetex")
+}
+
+func setWithTTL(db *DB, args [][]byte, unit string, cmdName string) (redis.Reply, *extra) {
+	key := string(args[0])
+	value := args[2]
+	expireAt, errReply := parseExpireTime(unit, args[1], cmdName)
+	if errReply != nil {
+		return errReply, nil
+	}
+	db.PUT(key, &DataEntity{
+		Data: value,
+	})
+	db.Expire(key, expireAt)
+	return &reply.OkReply{}, persistAs(makeAofCmd("set", [][]byte{args[0], value}), makeExpireCmd(key, expireAt))
+}
+
+// MSET key value [key value ...]
+// key 已经在Exec里用 db.Locks 全部锁住了, 所以整个过程是原子的
+func MSet(db *DB, args [][]byte) (redis.Reply, *extra) {
+	if len(args)%2 != 0 {
+		return &reply.ArgNumErrReply{Cmd: "mset"}, nil
+	}
+	for i := 0; i < len(args); i += 2 {
+		key := string(args[i])
+		db.PUT(key, &DataEntity{
+			Data: args[i+1],
+		})
+		db.Persist(key)
+	}
+	return &reply.OkReply{}, persistAsIs
+}
+
+// MSETNX 只有所有key都不存在时才写入
+func MSetNX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	if len(args)%2 != 0 {
+		return &reply.ArgNumErrReply{Cmd: "msetnx"}, nil
+	}
+	for i := 0; i < len(args); i += 2 {
+		if _, exists := db.GET(string(args[i])); exists {
+			return reply.MakeIntReply(0), nil
+		}
+	}
+	for i := 0; i < len(args); i += 2 {
+		db.PUT(string(args[i]), &DataEntity{
+			Data: args[i+1],
+		})
+	}
+	return reply.MakeIntReply(1), persistAs(makeAofCmd("mset", args))
+}
+
+// 不是字符串的key返回nil, 而不是报错
+func MGet(db *DB, args [][]byte) redis.Reply {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		bytes, err := db.getAsString(string(arg))
+		if err != nil {
+			result[i] = nil
+			continue
+		}
+		result[i] = bytes
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+func GetSet(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	value := args[1]
+
+	old, err := db.getAsString(key)
+	if err != nil {
+		return err, nil
+	}
+	db.PUT(key, &DataEntity{
+		Data: value,
+	})
+	db.Persist(key)
+	ex := persistAs(makeAofCmd("set", args))
+	if old == nil {
+		return &reply.NullBulkReply{}, ex
+	}
+	return reply.MakeBulkReply(old), ex
+}
+
+func GetDel(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	old, err := db.getAsString(key)
+	if err != nil {
+		return err, nil
+	}
+	if old == nil {
+		return &reply.NullBulkReply{}, nil
+	}
+	db.Remove(key)
+	return reply.MakeBulkReply(old), persistAs(makeAofCmd("del", args))
+}
+
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+//     PXAT unix-time-milliseconds | PERSIST]
+func GetEX(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	persist := false
+	hasExpire := false
+	var expireAt time.Time
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "PERSIST":
+			if hasExpire {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || persist || i+1 >= len(args) {
+				return &reply.SyntaxErrReply{}, nil
+			}
+			var errReply reply.ErrorReply
+			expireAt, errReply = parseExpireTime(option, args[i+1], "getex")
+			if errReply != nil {
+				return errReply, nil
+			}
+			hasExpire = true
+			i++
+		default:
+			return &reply.SyntaxErrReply{}, nil
+		}
+	}
+
+	bytes, err := db.getAsString(key)
+	if err != nil {
+		return err, nil
+	}
+	if bytes == nil {
+		return &reply.NullBulkReply{}, nil
+	}
+	var ex *extra
+	if hasExpire {
+		db.Expire(key, expireAt)
+		ex = persistAs(makeExpireCmd(key, expireAt))
+	} else if persist {
+		db.Persist(key)
+		ex = persistAs(makeAofCmd("persist", [][]byte{args[0]}))
+	}
+	return reply.MakeBulkReply(bytes), ex
+}
+
+// ---- 计数器 ----
+// INCR 之类的命令不会改变key的过期时间
+
+func incrBy(db *DB, key string, delta int64) (redis.Reply, *extra) {
+	bytes, err := db.getAsString(key)
+	if err != nil {
+		return err, nil
+	}
+	var val int64
+	if bytes != nil {
+		var parseErr error
+		val, parseErr = strconv.ParseInt(string(bytes), 10, 64)
+		if parseErr != nil {
+			return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+		}
+	}
+	if (delta > 0 && val > math.MaxInt64-delta) || (delta < 0 && val < math.MinInt64-delta) {
+		return reply.MakeErrReply("ERR increment or decrement would overflow"), nil
+	}
+	val += delta
+	db.PUT(key, &DataEntity{
+		Data: []byte(strconv.FormatInt(val, 10)),
+	})
+	return reply.MakeIntReply(val), persistAs(makeAofCmd("incrby", [][]byte{[]byte(key), []byte(strconv.FormatInt(delta, 10))}))
+}
+
+func Incr(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return incrBy(db, string(args[0]), 1)
+}
+
+func Decr(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return incrBy(db, string(args[0]), -1)
+}
+
+func IncrBy(db *DB, args [][]byte) (redis.Reply, *extra) {
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+	}
+	return incrBy(db, string(args[0]), delta)
+}
+
+func DecrBy(db *DB, args [][]byte) (redis.Reply, *extra) {
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range"), nil
+	}
+	if delta == math.MinInt64 {
+		return reply.MakeErrReply("ERR decrement would overflow"), nil
+	}
+	return incrBy(db, string(args[0]), -delta)
+}
+
+// 浮点数的结果和redis一样用十进制表示, 不用科学计数法
+func formatFloat(val float64) string {
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+func IncrByFloat(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	delta, err := strconv.ParseFloat(string(args[1]), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return reply.MakeErrReply("ERR value is not a valid float"), nil
+	}
+
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	val := new(big.Float)
+	if bytes != nil {
+		if _, ok := val.SetString(string(bytes)); !ok {
+			return reply.MakeErrReply("ERR value is not a valid float"), nil
+		}
+	}
+	result, _ := val.Add(val, big.NewFloat(delta)).Float64()
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return reply.MakeErrReply("ERR increment would produce NaN or Infinity"), nil
+	}
+	resultBytes := []byte(formatFloat(result))
+	db.PUT(key, &DataEntity{
+		Data: resultBytes,
+	})
+	// 浮点运算在重放时可能有误差, 所以直接记录结果
+	return reply.MakeBulkReply(resultBytes), persistAs(makeAofCmd("set", [][]byte{args[0], resultBytes, []byte("KEEPTTL")}))
+}
+
+// ---- 子串操作 ----
+
+func Append(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	bytes, err := db.getAsString(key)
+	if err != nil {
+		return err, nil
+	}
+	if errReply := checkStringLength(len(bytes) + len(args[1])); errReply != nil {
+		return errReply, nil
+	}
+	// 不在原来的slice上append, 旧值可能还被别处引用着
+	value := make([]byte, len(bytes)+len(args[1]))
+	copy(value, bytes)
+	copy(value[len(bytes):], args[1])
+	db.PUT(key, &DataEntity{
+		Data: value,
+	})
+	return reply.MakeIntReply(int64(len(value))), persistAsIs
+}
+
+func StrLen(db *DB, args [][]byte) redis.Reply {
+	bytes, err := db.getAsString(string(args[0]))
+	if err != nil {
+		return err
+	}
+	return reply.MakeIntReply(int64(len(bytes)))
+}
+
+// GETRANGE key start end, 支持负数下标, 两端都包含
+func GetRange(db *DB, args [][]byte) redis.Reply {
+	start, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	end, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	bytes, errReply := db.getAsString(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	size := int64(len(bytes))
+	if start < 0 && end < 0 && start > end {
+		return reply.MakeBulkReply([]byte{})
+	}
+	if start < 0 {
+		start = size + start
+	}
+	if end < 0 {
+		end = size + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if start > end || size == 0 {
+		return reply.MakeBulkReply([]byte{})
+	}
+	return reply.MakeBulkReply(bytes[start : end+1])
+}
+
+// SETRANGE key offset value, 原字符串不够长时用0补齐
+func SetRange(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || offset < 0 {
+		return reply.MakeErrReply("ERR offset is out of range"), nil
+	}
+	value := args[2]
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply, nil
+	}
+	if len(value) == 0 {
+		// 什么都不写, 也不会创建key
+		return reply.MakeIntReply(int64(len(bytes))), nil
+	}
+	if offset > maxStringLength {
+		return checkStringLength(maxStringLength + 1), nil
+	}
+	if errReply := checkStringLength(int(offset) + len(value)); errReply != nil {
+		return errReply, nil
+	}
+
+	size := len(bytes)
+	if int(offset)+len(value) > size {
+		size = int(offset) + len(value)
+	}
+	result := make([]byte, size)
+	copy(result, bytes)
+	copy(result[offset:], value)
+	db.PUT(key, &DataEntity{
+		Data: result,
+	})
+	return reply.MakeIntReply(int64(len(result))), persistAsIs
+}
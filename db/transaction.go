@@ -0,0 +1,362 @@
+package db
+
+import (
+	"redis.simple/interface/redis"
+	"redis.simple/pubsub"
+	"redis.simple/redis/reply"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	MULTI/EXEC/DISCARD 和 WATCH/UNWATCH
+	MULTI 之后的命令只检查参数个数就放进client的队列, 回复 +QUEUED
+	入队时出错(未知命令、参数个数不对)的话EXEC放弃整个事务; 执行时出错和redis一样不回滚, 其他命令照常执行
+	EXEC 先锁住所有命令用到的key(还有WATCH的key), 再检查WATCH的key的版本号, 都没变才依次执行
+	WATCH 用的是乐观锁: 记下key当时的版本号, 写命令、过期删除、FLUSH、SWAPDB 都会让版本号加一
+ */
+
+type keyVersion struct {
+	// WATCH这个key的client的个数, 为0时删掉
+	watchers int
+	version  uint64
+}
+
+// 返回key现在的版本号, 先删掉已经过期的key, 免得之后的惰性删除让EXEC失败
+func (db *DB) watch(key string) uint64 {
+	db.RLock(key)
+	defer db.RUnLock(key)
+	db.IsExpired(key)
+
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	kv, ok := db.watched[key]
+	if !ok {
+		kv = &keyVersion{}
+		db.watched[key] = kv
+		atomic.AddInt32(&db.watchedNum, 1)
+	}
+	kv.watchers++
+	return kv.version
+}
+
+func (db *DB) unwatch(key string) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	kv, ok := db.watched[key]
+	if !ok {
+		return
+	}
+	kv.watchers--
+	if kv.watchers <= 0 {
+		delete(db.watched, key)
+		atomic.AddInt32(&db.watchedNum, -1)
+	}
+}
+
+func (db *DB) getVersion(key string) uint64 {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	kv, ok := db.watched[key]
+	if !ok {
+		return 0
+	}
+	return kv.version
+}
+
+// key被修改了, 调用者持有key的锁
+// 除了WATCH的版本号, 被原地修改的value(比如LPUSH)占用的内存也在这里重新估计
+func (db *DB) touchKeys(keys ...string) {
+	db.refreshMemory(keys...)
+	if atomic.LoadInt32(&db.watchedNum) == 0 {
+		return
+	}
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for _, key := range keys {
+		if kv, ok := db.watched[key]; ok {
+			kv.version++
+		}
+	}
+}
+
+// 整个数据库的数据都换了(FLUSHDB、SWAPDB)
+func (db *DB) touchAllKeys() {
+	if atomic.LoadInt32(&db.watchedNum) == 0 {
+		return
+	}
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for _, kv := range db.watched {
+		kv.version++
+	}
+}
+
+// MULTI/EXEC/DISCARD/WATCH/UNWATCH 都需要连接
+func execTxCommand(mdb *MultiDB, c redis.Connection, cmd string, args [][]byte) redis.Reply {
+	if c == nil {
+		return reply.MakeErrReply("ERR " + cmd + " is not allowed here")
+	}
+	switch cmd {
+	case "multi":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		return startMulti(c)
+	case "exec":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		return execMulti(mdb, c)
+	case "discard":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		return discardMulti(mdb, c)
+	case "watch":
+		if len(args) < 2 {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		return Watch(mdb, c, args[1:])
+	case "unwatch":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		unwatchAll(mdb, c)
+		return &reply.OkReply{}
+	}
+	return reply.MakeErrReply("ERR unknown command '" + cmd + "'")
+}
+
+func startMulti(c redis.Connection) redis.Reply {
+	if c.InMultiState() {
+		return reply.MakeErrReply("ERR MULTI calls can not be nested")
+	}
+	c.SetMultiState(true)
+	return &reply.OkReply{}
+}
+
+// 除了命令表里的命令, 事务里还可以有SELECT、PUBLISH和SCRIPT
+// 订阅和BGREWRITEAOF 不能放进事务
+func enqueueCmd(c redis.Connection, args [][]byte) redis.Reply {
+	cmd := strings.ToLower(string(args[0]))
+	var errReply redis.Reply
+	switch cmd {
+	case "select":
+		// 和redis一样, 下标在执行时才检查
+		if len(args) != 2 {
+			errReply = &reply.ArgNumErrReply{Cmd: cmd}
+		}
+	case "script":
+		if len(args) < 2 {
+			errReply = &reply.ArgNumErrReply{Cmd: cmd}
+		}
+	case "publish":
+		if len(args) != 3 {
+			errReply = &reply.ArgNumErrReply{Cmd: cmd}
+		}
+	case "subscribe", "unsubscribe", "bgrewriteaof":
+		errReply = reply.MakeErrReply("ERR Command not allowed inside a transaction")
+	default:
+		command, ok := router[cmd]
+		if !ok {
+			errReply = reply.MakeErrReply("ERR unknown command '" + cmd + "'")
+		} else if command.isNoMulti() {
+			errReply = reply.MakeErrReply("ERR Command not allowed inside a transaction")
+		} else if !command.validateArity(args) {
+			errReply = &reply.ArgNumErrReply{Cmd: cmd}
+		}
+	}
+	if errReply != nil {
+		c.AddTxError(errReply)
+		return errReply
+	}
+	c.EnqueueCmd(args)
+	return &reply.QueuedReply{}
+}
+
+func discardMulti(mdb *MultiDB, c redis.Connection) redis.Reply {
+	if !c.InMultiState() {
+		return reply.MakeErrReply("ERR DISCARD without MULTI")
+	}
+	c.ClearQueuedCmds()
+	c.SetMultiState(false)
+	unwatchAll(mdb, c)
+	return &reply.OkReply{}
+}
+
+// WATCH key [key ...]
+// 记在client当前的数据库下, 之后SELECT到别的数据库也还是WATCH这个数据库的key
+func Watch(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	if c.InMultiState() {
+		return reply.MakeErrReply("ERR WATCH inside MULTI is not allowed")
+	}
+	// 会惰性删除过期的key, 和其他命令一样不能和FLUSHDB、SWAPDB同时执行
+	mdb.txMu.RLock()
+	defer mdb.txMu.RUnlock()
+	dbIndex := c.GetDBIndex()
+	db := mdb.dbSet[dbIndex]
+	watching := c.GetWatching()
+	for _, arg := range args {
+		watchedKey := redis.WatchedKey{DBIndex: dbIndex, Key: string(arg)}
+		if _, ok := watching[watchedKey]; ok {
+			continue
+		}
+		watching[watchedKey] = db.watch(watchedKey.Key)
+	}
+	return &reply.OkReply{}
+}
+
+// EXEC、DISCARD、UNWATCH 和断开连接时调用
+func unwatchAll(mdb *MultiDB, c redis.Connection) {
+	watching := c.GetWatching()
+	for watchedKey := range watching {
+		mdb.dbSet[watchedKey.DBIndex].unwatch(watchedKey.Key)
+		delete(watching, watchedKey)
+	}
+}
+
+// 事务要加锁的key, 按数据库分开
+type txKeys struct {
+	writeKeys map[int][]string
+	readKeys  map[int][]string
+	// 有写命令或者脚本时要独占MultiDB
+	hasWrite bool
+}
+
+// SELECT 会改变之后的命令所在的数据库, 所以要按顺序跟踪
+func collectTxKeys(mdb *MultiDB, c redis.Connection, cmdLines [][][]byte) *txKeys {
+	keys := &txKeys{
+		writeKeys: make(map[int][]string),
+		readKeys:  make(map[int][]string),
+	}
+	dbIndex := c.GetDBIndex()
+	for _, cmdLine := range cmdLines {
+		cmd := strings.ToLower(string(cmdLine[0]))
+		if cmd == "select" {
+			if index, errReply := mdb.parseDBIndex(cmdLine[1]); errReply == nil {
+				dbIndex = index
+			}
+			continue
+		}
+		command, ok := router[cmd]
+		if !ok {
+			continue
+		}
+		command = command.forArgs(cmdLine)
+		if command.isWrite() || command.isScript() {
+			keys.hasWrite = true
+		}
+		if command.isWrite() {
+			keys.writeKeys[dbIndex] = append(keys.writeKeys[dbIndex], command.keys(cmdLine)...)
+		} else {
+			keys.readKeys[dbIndex] = append(keys.readKeys[dbIndex], command.keys(cmdLine)...)
+		}
+	}
+	// WATCH的key在检查版本号和执行的过程中也不能被改
+	for watchedKey := range c.GetWatching() {
+		keys.readKeys[watchedKey.DBIndex] = append(keys.readKeys[watchedKey.DBIndex], watchedKey.Key)
+	}
+	return keys
+}
+
+func execMulti(mdb *MultiDB, c redis.Connection) redis.Reply {
+	if !c.InMultiState() {
+		return reply.MakeErrReply("ERR EXEC without MULTI")
+	}
+	defer func() {
+		c.ClearQueuedCmds()
+		c.SetMultiState(false)
+		unwatchAll(mdb, c)
+	}()
+	if len(c.GetTxErrors()) > 0 {
+		return reply.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	cmdLines := c.GetQueuedCmdLine()
+	keys := collectTxKeys(mdb, c, cmdLines)
+	if !keys.hasWrite {
+		mdb.txMu.RLock()
+		defer mdb.txMu.RUnlock()
+		return mdb.execLocked(c, cmdLines, keys)
+	}
+
+	mdb.txMu.Lock()
+	defer mdb.txMu.Unlock()
+	// 淘汰的DEL要在aofTx之前直接写入AOF
+	if errReply := mdb.checkTxWriteCommands(cmdLines); errReply != nil {
+		return reply.MakeErrReply("EXECABORT Transaction discarded because of: " + errReply.Error())
+	}
+	mdb.aofTx = make([]*payload, 0, len(cmdLines))
+	result := func() redis.Reply {
+		// 执行中panic了也要把已经执行的命令写进AOF
+		defer mdb.flushAofTx()
+		return mdb.execLocked(c, cmdLines, keys)
+	}()
+	// 和普通命令一样, 锁释放之后再服务被push唤醒的阻塞client
+	for _, db := range mdb.dbSet {
+		db.handleReadyKeys()
+	}
+	return result
+}
+
+// 入队之后AOF可能开始写不进去了, 内存也可能超过了maxmemory, 所以执行之前对写命令再检查一次, 调用者持有txMu的写锁
+func (mdb *MultiDB) checkTxWriteCommands(cmdLines [][][]byte) reply.ErrorReply {
+	for _, cmdLine := range cmdLines {
+		if errReply := mdb.checkWriteCommand(cmdLine); errReply != nil {
+			return errReply
+		}
+	}
+	return nil
+}
+
+// 加锁, 检查WATCH, 然后依次执行
+// 按数据库下标的顺序加锁, 和跨数据库命令的顺序一致
+func (mdb *MultiDB) execLocked(c redis.Connection, cmdLines [][][]byte, keys *txKeys) redis.Reply {
+	for i, db := range mdb.dbSet {
+		if len(keys.writeKeys[i])+len(keys.readKeys[i]) > 0 {
+			db.RWLocks(keys.writeKeys[i], keys.readKeys[i])
+			defer db.RWUnLocks(keys.writeKeys[i], keys.readKeys[i])
+		}
+	}
+
+	for watchedKey, version := range c.GetWatching() {
+		if mdb.dbSet[watchedKey.DBIndex].getVersion(watchedKey.Key) != version {
+			return &reply.NullMultiBulkReply{}
+		}
+	}
+
+	results := make([]redis.Reply, 0, len(cmdLines))
+	for _, cmdLine := range cmdLines {
+		results = append(results, mdb.execQueued(c, cmdLine))
+	}
+	return reply.MakeMultiRawReply(results)
+}
+
+// 执行事务里的一条命令, key已经锁住了
+// 阻塞命令直接调用执行函数, 只尝试一次
+func (mdb *MultiDB) execQueued(c redis.Connection, cmdLine [][]byte) redis.Reply {
+	cmd := strings.ToLower(string(cmdLine[0]))
+	switch cmd {
+	case "select":
+		return execSelect(mdb, c, cmdLine[1:])
+	case "publish":
+		return pubsub.Publish(mdb.hub, cmdLine[1:])
+	case "script":
+		return ScriptCommand(mdb, cmdLine[1:])
+	}
+	return mdb.execLockedCommand(c.GetDBIndex(), router[cmd], cmdLine)
+}
+
+// 执行命令表里的一条命令, 调用者(事务或者脚本)已经锁住了key并且独占了MultiDB, AOF重放时只有一个协程, 不用加锁
+func (mdb *MultiDB) execLockedCommand(dbIndex int, command *command, cmdLine [][]byte) redis.Reply {
+	if command.isMultiDB() {
+		return command.multiExecutor(mdb, dbIndex, cmdLine[1:])
+	}
+	db := mdb.dbSet[dbIndex]
+	result := command.execute(db, cmdLine)
+	if command.isWrite() {
+		db.touchKeys(command.keys(cmdLine)...)
+	}
+	return result
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"math"
+	"redis.simple/interface/redis"
+	"redis.simple/redis/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	EXPIRE/PEXPIRE/EXPIREAT/PEXPIREAT 最终都转成一个绝对时间,
+	AOF里只记录 PEXPIREAT, 重放的时候不会延长key的寿命
+	过期时间已经过去的直接删除key, AOF里记为 DEL
+ */
+
+func toMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// 返回key的过期时间, 没有设置过期时间时 ok 为false
+func (db *DB) ttlOf(key string) (expireTime time.Time, ok bool) {
+	raw, ok := db.TTLMap.Get(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return raw.(time.Time), true
+}
+
+// 按 unit 把参数转为毫秒级的绝对时间, relative 为true时相对于现在
+// 和SET的EX不一样, 这里可以是0或者负数(表示马上过期)
+func parseExpireAt(raw []byte, unit time.Duration, relative bool, cmdName string) (int64, reply.ErrorReply) {
+	val, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 0, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	invalidErr := reply.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+	ms := val
+	if unit == time.Second {
+		if val > math.MaxInt64/1000 || val < math.MinInt64/1000 {
+			return 0, invalidErr
+		}
+		ms = val * 1000
+	}
+	if relative {
+		now := toMs(time.Now())
+		if ms > maxExpireMs-now {
+			return 0, invalidErr
+		}
+		ms += now
+	} else if ms > maxExpireMs {
+		return 0, invalidErr
+	}
+	return ms, nil
+}
+
+// [NX|XX|GT|LT]
+type expireCondition struct {
+	nx, xx, gt, lt bool
+}
+
+func parseExpireCondition(args [][]byte) (*expireCondition, reply.ErrorReply) {
+	cond := &expireCondition{}
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg)) {
+		case "NX":
+			cond.nx = true
+		case "XX":
+			cond.xx = true
+		case "GT":
+			cond.gt = true
+		case "LT":
+			cond.lt = true
+		default:
+			return nil, reply.MakeErrReply("ERR Unsupported option " + string(arg))
+		}
+	}
+	if cond.nx && (cond.xx || cond.gt || cond.lt) {
+		return nil, reply.MakeErrReply("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if cond.gt && cond.lt {
+		return nil, reply.MakeErrReply("ERR GT and LT options at the same time are not compatible")
+	}
+	return cond, nil
+}
+
+// 没有过期时间的key当作永不过期, 所以 GT 总是失败, LT 总是成功
+func (cond *expireCondition) allow(current time.Time, hasTTL bool, expireAtMs int64) bool {
+	if cond.nx && hasTTL {
+		return false
+	}
+	if cond.xx && !hasTTL {
+		return false
+	}
+	if cond.gt && (!hasTTL || expireAtMs <= toMs(current)) {
+		return false
+	}
+	if cond.lt && hasTTL && expireAtMs >= toMs(current) {
+		return false
+	}
+	return true
+}
+
+func expireGeneric(db *DB, args [][]byte, unit time.Duration, relative bool, cmdName string) (redis.Reply, *extra) {
+	key := string(args[0])
+	expireAtMs, errReply := parseExpireAt(args[1], unit, relative, cmdName)
+	if errReply != nil {
+		return errReply, nil
+	}
+	cond, errReply := parseExpireCondition(args[2:])
+	if errReply != nil {
+		return errReply, nil
+	}
+	if _, exists := db.GET(key); !exists {
+		return reply.MakeIntReply(0), nil
+	}
+	current, hasTTL := db.ttlOf(key)
+	if !cond.allow(current, hasTTL, expireAtMs) {
+		return reply.MakeIntReply(0), nil
+	}
+
+	if expireAtMs <= toMs(time.Now()) {
+		db.Remove(key)
+		return reply.MakeIntReply(1), persistAs(makeAofCmd("del", [][]byte{args[0]}))
+	}
+	expireAt := time.Unix(0, expireAtMs*int64(time.Millisecond))
+	db.Expire(key, expireAt)
+	return reply.MakeIntReply(1), persistAs(makeExpireCmd(key, expireAt))
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+func Expire(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return expireGeneric(db, args, time.Second, true, "expire")
+}
+
+// PEXPIRE key milliseconds [NX|XX|GT|LT]
+func PExpire(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return expireGeneric(db, args, time.Millisecond, true, "pexpire")
+}
+
+// EXPIREAT key unix-time-seconds [NX|XX|GT|LT]
+func ExpireAt(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return expireGeneric(db, args, time.Second, false, "expireat")
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+func PExpireAt(db *DB, args [][]byte) (redis.Reply, *extra) {
+	return expireGeneric(db, args, time.Millisecond, false, "pexpireat")
+}
+
+// key不存在返回-2, 没有过期时间返回-1
+func ttlGeneric(db *DB, args [][]byte, unit time.Duration, absolute bool) redis.Reply {
+	key := string(args[0])
+	if _, exists := db.GET(key); !exists {
+		return reply.MakeIntReply(-2)
+	}
+	expireTime, hasTTL := db.ttlOf(key)
+	if !hasTTL {
+		return reply.MakeIntReply(-1)
+	}
+	if absolute {
+		ms := toMs(expireTime)
+		if unit == time.Second {
+			return reply.MakeIntReply(ms / 1000)
+		}
+		return reply.MakeIntReply(ms)
+	}
+	remain := toMs(expireTime) - toMs(time.Now())
+	if remain < 0 {
+		remain = 0
+	}
+	if unit == time.Second {
+		// 和redis一样四舍五入
+		return reply.MakeIntReply((remain + 500) / 1000)
+	}
+	return reply.MakeIntReply(remain)
+}
+
+func TTL(db *DB, args [][]byte) redis.Reply {
+	return ttlGeneric(db, args, time.Second, false)
+}
+
+func PTTL(db *DB, args [][]byte) redis.Reply {
+	return ttlGeneric(db, args, time.Millisecond, false)
+}
+
+func ExpireTime(db *DB, args [][]byte) redis.Reply {
+	return ttlGeneric(db, args, time.Second, true)
+}
+
+func PExpireTime(db *DB, args [][]byte) redis.Reply {
+	return ttlGeneric(db, args, time.Millisecond, true)
+}
+
+func Persist(db *DB, args [][]byte) (redis.Reply, *extra) {
+	key := string(args[0])
+	if _, exists := db.GET(key); !exists {
+		return reply.MakeIntReply(0), nil
+	}
+	if _, hasTTL := db.ttlOf(key); !hasTTL {
+		return reply.MakeIntReply(0), nil
+	}
+	db.Persist(key)
+	return reply.MakeIntReply(1), persistAsIs
+}
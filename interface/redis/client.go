@@ -3,8 +3,35 @@ package redis
 type Connection interface {
 	Write([]byte) error
 
-	SubChanel(channel string)
+	SubsChannel(channel string)
 	UnSubsChannel(channel string)
 	SubsCount()int
 	GetChannels()[]string
+
+	// 阻塞命令(BLPOP等)等待的key, 设为nil表示不再阻塞
+	SetBlockKeys(keys []string)
+	GetBlockKeys() []string
+
+	// SELECT 选中的数据库
+	GetDBIndex() int
+	SelectDB(dbIndex int)
+
+	// 事务: MULTI 之后的命令先放进队列, EXEC 时一起执行
+	InMultiState() bool
+	SetMultiState(state bool)
+	GetQueuedCmdLine() [][][]byte
+	EnqueueCmd(cmdLine [][]byte)
+	// 入队时的错误(未知命令、参数个数不对), 有错误时EXEC放弃整个事务
+	AddTxError(err Reply)
+	GetTxErrors() []Reply
+	// 清空队列和入队错误
+	ClearQueuedCmds()
+	// WATCH 的key => WATCH 时的版本号
+	GetWatching() map[WatchedKey]uint64
+}
+
+// WATCH 的一个key, 不同数据库里的同名key是不同的key
+type WatchedKey struct {
+	DBIndex int
+	Key     string
 }
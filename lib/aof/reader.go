@@ -0,0 +1,169 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 逐条读取AOF文件里的命令, 记录读完的完整命令的字节数
+// 加载AOF和 aof-check 共用, 出错时可以知道文件从哪里开始坏掉, 两者对事务的处理也一样(ReadBlock)
+
+const (
+	// 和redis一样, 一个参数最大 512MB (proto-max-bulk-len)
+	maxBulkLength = 512 * 1024 * 1024
+	// 一条命令最多的参数个数, 超过了只可能是文件坏了
+	maxArgCount = 1 << 24
+	// 按参数个数预先分配的上限, 更多的参数边读边扩容
+	argPrealloc = 1024
+)
+
+// 文件在一条命令的中间结束, 一般是写到一半的时候宕机了
+var ErrTruncated = errors.New("unexpected end of file")
+
+// 读取出错, Offset 是最后一条完整命令结束的位置, 也就是出错的命令开始的位置
+type Error struct {
+	Offset int64
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Err.Error(), e.Offset)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// 文件只是末尾不完整, 前面的命令都是好的
+func (e *Error) Truncated() bool {
+	return e.Err == ErrTruncated
+}
+
+type Reader struct {
+	reader *bufio.Reader
+	// 读完的完整命令的字节数
+	offset int64
+	// 实际读了的字节数
+	read int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(r)}
+}
+
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// 读取下一条命令, 文件正好在两条命令之间结束时返回 io.EOF, 其他错误都是 *Error
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		if err == io.EOF && r.read == r.offset {
+			return nil, io.EOF
+		}
+		return nil, r.fail(err)
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, r.fail(errors.New("expected '*'"))
+	}
+	// 长度在分配内存之前检查, 坏掉的长度不能让加载panic或者耗尽内存
+	count, err := strconv.ParseUint(string(line[1:]), 10, 32)
+	if err != nil || count == 0 || count > maxArgCount {
+		return nil, r.fail(errors.New("invalid multibulk length"))
+	}
+	prealloc := count
+	if prealloc > argPrealloc {
+		prealloc = argPrealloc
+	}
+	args := make([][]byte, 0, prealloc)
+	for i := uint64(0); i < count; i++ {
+		line, err = r.readLine()
+		if err != nil {
+			return nil, r.fail(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, r.fail(errors.New("expected '$'"))
+		}
+		size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || size < 0 || size > maxBulkLength {
+			return nil, r.fail(errors.New("invalid bulk length"))
+		}
+		arg := make([]byte, size+2)
+		n, err := io.ReadFull(r.reader, arg)
+		r.read += int64(n)
+		if err != nil {
+			return nil, r.fail(err)
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, r.fail(errors.New("expected CRLF after bulk"))
+		}
+		args = append(args, arg[:size])
+	}
+	r.offset = r.read
+	return args, nil
+}
+
+// 读取下一组命令: 事务 MULTI ... EXEC (包括MULTI和EXEC)作为一组, 事务之外的命令一条一组
+// 文件正好在两组之间结束时返回 io.EOF
+// 事务中间出错(包括在事务中间结束)时 Offset 是MULTI开始的位置, 截到这里不会留下没有EXEC的MULTI,
+// 否则之后追加的命令都会在这个没有结束的事务里, 下次加载时又被一起截掉
+func (r *Reader) ReadBlock() ([][][]byte, error) {
+	offset := r.offset
+	args, err := r.ReadCommand()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "exec":
+		return nil, &Error{Offset: offset, Err: errors.New("unexpected EXEC")}
+	case "multi":
+	default:
+		return [][][]byte{args}, nil
+	}
+
+	block := [][][]byte{args}
+	for {
+		args, err := r.ReadCommand()
+		if err == io.EOF {
+			return nil, &Error{Offset: offset, Err: ErrTruncated}
+		}
+		if err != nil {
+			if aofErr, ok := err.(*Error); ok {
+				return nil, &Error{Offset: offset, Err: aofErr.Err}
+			}
+			return nil, &Error{Offset: offset, Err: err}
+		}
+		block = append(block, args)
+		switch strings.ToLower(string(args[0])) {
+		case "multi":
+			return nil, &Error{Offset: offset, Err: errors.New("unexpected MULTI")}
+		case "exec":
+			return block, nil
+		}
+	}
+}
+
+// 读一行, 去掉结尾的 \r\n
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.reader.ReadBytes('\n')
+	r.read += int64(len(line))
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("expected CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (r *Reader) fail(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return &Error{Offset: r.offset, Err: err}
+}
@@ -0,0 +1,199 @@
+package aof
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+)
+
+func encode(args ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+func join(cmds ...[]byte) []byte {
+	return bytes.Join(cmds, nil)
+}
+
+// 读到出错或者结束, 返回读到的命令条数和错误(正常结束时为nil)
+func readAll(data []byte) (int, error) {
+	reader := NewReader(bytes.NewReader(data))
+	count := 0
+	for {
+		block, err := reader.ReadBlock()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		count += len(block)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	data := join(encode("SET", "a", "1"), encode("SET", "b", ""))
+	reader := NewReader(bytes.NewReader(data))
+	args, err := reader.ReadCommand()
+	if err != nil || len(args) != 3 || string(args[2]) != "1" {
+		t.Fatalf("unexpected command %q, err %v", args, err)
+	}
+	if reader.Offset() != int64(len(encode("SET", "a", "1"))) {
+		t.Errorf("expected offset %d, got %d", len(encode("SET", "a", "1")), reader.Offset())
+	}
+	args, err = reader.ReadCommand()
+	if err != nil || len(args) != 3 || len(args[2]) != 0 {
+		t.Fatalf("unexpected command %q, err %v", args, err)
+	}
+	if _, err = reader.ReadCommand(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	if reader.Offset() != int64(len(data)) {
+		t.Errorf("expected offset %d, got %d", len(data), reader.Offset())
+	}
+}
+
+func TestReadCommandTruncated(t *testing.T) {
+	first := encode("SET", "a", "1")
+	second := encode("SET", "b", "2")
+	// 在第二条命令的每一个位置截断, 都应该报告截断在第二条命令开始的位置
+	for cut := 1; cut < len(second); cut++ {
+		data := join(first, second[:cut])
+		_, err := readAll(data)
+		aofErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("cut at %d: expected *Error, got %v", cut, err)
+		}
+		if !aofErr.Truncated() {
+			t.Errorf("cut at %d: expected truncated, got %v", cut, aofErr)
+		}
+		if aofErr.Offset != int64(len(first)) {
+			t.Errorf("cut at %d: expected offset %d, got %d", cut, len(first), aofErr.Offset)
+		}
+	}
+}
+
+func TestReadCommandCorrupt(t *testing.T) {
+	first := encode("SET", "a", "1")
+	cases := []string{
+		"+OK\r\n",
+		"*x\r\n",
+		"*0\r\n",
+		"*1\r\n:1\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$3\r\nabcde\r\n",
+		"*1\n",
+		// 长度超过上限, 不能先按长度分配内存
+		"*4294967295\r\n",
+		"*16777217\r\n",
+		"*1\r\n$9223372036854775000\r\n",
+		"*1\r\n$536870913\r\n",
+	}
+	for _, c := range cases {
+		_, err := readAll(join(first, []byte(c)))
+		aofErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("%q: expected *Error, got %v", c, err)
+		}
+		if aofErr.Truncated() {
+			t.Errorf("%q: expected format error, got %v", c, aofErr)
+		}
+		if aofErr.Offset != int64(len(first)) {
+			t.Errorf("%q: expected offset %d, got %d", c, len(first), aofErr.Offset)
+		}
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	data := join(encode("SET", "a", "1"), encode("MULTI"), encode("SET", "b", "2"), encode("INCR", "b"),
+		encode("EXEC"), encode("DEL", "a"))
+	reader := NewReader(bytes.NewReader(data))
+	sizes := []int{1, 4, 1}
+	for i, size := range sizes {
+		block, err := reader.ReadBlock()
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if len(block) != size {
+			t.Errorf("block %d: expected %d commands, got %d", i, size, len(block))
+		}
+	}
+	if _, err := reader.ReadBlock(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+// 文件在事务里的一条命令中间结束: 要截到MULTI之前, 截掉之后再读不能留下没有EXEC的MULTI
+func TestReadBlockTruncatedTx(t *testing.T) {
+	head := join(encode("SET", "a", "1"), encode("SELECT", "1"))
+	tx := join(encode("MULTI"), encode("SET", "b", "2"))
+	last := encode("SET", "c", "3")
+	for cut := 0; cut < len(last); cut++ {
+		data := join(head, tx, last[:cut])
+		_, err := readAll(data)
+		aofErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("cut at %d: expected *Error, got %v", cut, err)
+		}
+		if !aofErr.Truncated() {
+			t.Errorf("cut at %d: expected truncated, got %v", cut, aofErr)
+		}
+		if aofErr.Offset != int64(len(head)) {
+			t.Fatalf("cut at %d: expected offset %d (MULTI), got %d", cut, len(head), aofErr.Offset)
+		}
+
+		fixed := data[:aofErr.Offset]
+		count, err := readAll(fixed)
+		if err != nil {
+			t.Fatalf("cut at %d: fixed file is still invalid: %v", cut, err)
+		}
+		if count != 2 {
+			t.Errorf("cut at %d: expected 2 commands after fix, got %d", cut, count)
+		}
+		if bytes.Contains(fixed, encode("MULTI")) {
+			t.Errorf("cut at %d: fixed file still has a MULTI", cut)
+		}
+	}
+}
+
+func TestReadBlockCorruptTx(t *testing.T) {
+	head := encode("SET", "a", "1")
+	data := join(head, encode("MULTI"), encode("SET", "b", "2"), []byte("garbage\r\n"), encode("EXEC"))
+	_, err := readAll(data)
+	aofErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if aofErr.Truncated() {
+		t.Errorf("expected format error, got %v", aofErr)
+	}
+	if aofErr.Offset != int64(len(head)) {
+		t.Errorf("expected offset %d (MULTI), got %d", len(head), aofErr.Offset)
+	}
+}
+
+func TestReadBlockUnbalanced(t *testing.T) {
+	head := encode("SET", "a", "1")
+	cases := map[string][]byte{
+		"nested MULTI": join(head, encode("MULTI"), encode("MULTI"), encode("EXEC")),
+		"stray EXEC":   join(head, encode("EXEC")),
+	}
+	for name, data := range cases {
+		_, err := readAll(data)
+		aofErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("%s: expected *Error, got %v", name, err)
+		}
+		if aofErr.Truncated() {
+			t.Errorf("%s: expected format error, got %v", name, aofErr)
+		}
+		if aofErr.Offset != int64(len(head)) {
+			t.Errorf("%s: expected offset %d, got %d", name, len(head), aofErr.Offset)
+		}
+	}
+}
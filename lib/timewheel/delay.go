@@ -0,0 +1,23 @@
+package timewheel
+
+import "time"
+
+// 默认的时间轮, 精度1ms
+// 过期删除、阻塞命令超时和客户端空闲超时共用这一个
+var Default = New(time.Millisecond)
+
+func init() {
+	Default.Start()
+}
+
+func At(at time.Time, key string, job func()) {
+	Default.At(at, key, job)
+}
+
+func Delay(duration time.Duration, key string, job func()) {
+	Default.Delay(duration, key, job)
+}
+
+func Cancel(key string) {
+	Default.Cancel(key)
+}
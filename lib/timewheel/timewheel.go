@@ -0,0 +1,231 @@
+package timewheel
+
+import (
+	"container/list"
+	"fmt"
+	"redis.simple/lib/logger"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+	分层时间轮, 和linux内核的定时器一样
+	第0层有256格, 每格一个tick; 往上每层64格, 每格是下一层转一圈的时间
+	tick为1ms时能覆盖 2^32 ms(约49天), 更远的任务先放在最高层最远的一格, 转到时再重新放
+	每个tick只处理当前一格, 低位转完一圈时把上一层对应的格子里的任务重新放到下面(cascade)
+	添加和删除都是链表操作, 所以是O(1)
+ */
+
+const (
+	nearBits  = 8
+	nearSize  = 1 << nearBits
+	nearMask  = nearSize - 1
+	levelBits = 6
+	levelSize = 1 << levelBits
+	levelMask = levelSize - 1
+	// 第0层之外的层数
+	levelCount = 4
+)
+
+type task struct {
+	key string
+	// 到期的tick(从时间轮启动开始算)
+	expire uint64
+	job    func()
+
+	slot    *list.List
+	element *list.Element
+}
+
+type TimeWheel struct {
+	// 每一格的时间
+	tick time.Duration
+	// tick 0 对应的时间
+	start time.Time
+
+	mu sync.Mutex
+	// 下一个要处理的tick
+	now    uint64
+	near   [nearSize]*list.List
+	levels [levelCount][levelSize]*list.List
+	// key => task, 用于删除
+	tasks map[string]*task
+
+	stopChan chan struct{}
+}
+
+func New(tick time.Duration) *TimeWheel {
+	tw := &TimeWheel{
+		tick:     tick,
+		start:    time.Now(),
+		tasks:    make(map[string]*task),
+		stopChan: make(chan struct{}),
+	}
+	for i := range tw.near {
+		tw.near[i] = list.New()
+	}
+	for i := range tw.levels {
+		for j := range tw.levels[i] {
+			tw.levels[i][j] = list.New()
+		}
+	}
+	return tw
+}
+
+func (tw *TimeWheel) Start() {
+	go tw.run()
+}
+
+func (tw *TimeWheel) Stop() {
+	close(tw.stopChan)
+}
+
+// 在at时刻执行job, 已经有同样key的任务时替换掉它
+// job在单独的协程里执行, 不要假设它和添加它的协程之间的顺序
+func (tw *TimeWheel) At(at time.Time, key string, job func()) {
+	var expire uint64
+	if elapsed := at.Sub(tw.start); elapsed > 0 {
+		// 向上取整, 保证不会提前执行
+		expire = uint64((elapsed + tw.tick - 1) / tw.tick)
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.remove(key)
+	t := &task{
+		key:    key,
+		expire: expire,
+		job:    job,
+	}
+	tw.tasks[key] = t
+	tw.place(t)
+}
+
+func (tw *TimeWheel) Delay(duration time.Duration, key string, job func()) {
+	tw.At(time.Now().Add(duration), key, job)
+}
+
+// 任务不存在(或者已经执行了)时什么也不做
+func (tw *TimeWheel) Cancel(key string) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.remove(key)
+}
+
+func (tw *TimeWheel) remove(key string) {
+	t, ok := tw.tasks[key]
+	if !ok {
+		return
+	}
+	t.slot.Remove(t.element)
+	delete(tw.tasks, key)
+}
+
+// 根据离现在还有多少个tick决定放在哪一层, 调用者持有mu
+func (tw *TimeWheel) place(t *task) {
+	expire := t.expire
+	if expire < tw.now {
+		// 已经过了, 下一个tick执行
+		expire = tw.now
+	}
+	diff := expire - tw.now
+	var slot *list.List
+	if diff < nearSize {
+		slot = tw.near[expire&nearMask]
+	} else {
+		for i := 0; i < levelCount; i++ {
+			shift := uint(nearBits + i*levelBits)
+			limit := uint64(1) << (shift + levelBits)
+			if diff >= limit && i < levelCount-1 {
+				continue
+			}
+			if diff >= limit {
+				// 超出时间轮的范围, 先放在最远的一格
+				expire = tw.now + limit - 1
+			}
+			slot = tw.levels[i][(expire>>shift)&levelMask]
+			break
+		}
+	}
+	t.slot = slot
+	t.element = slot.PushBack(t)
+}
+
+// 把第level层第index格的任务重新放到下面的层
+func (tw *TimeWheel) cascade(level int, index uint64) {
+	slot := tw.levels[level][index]
+	for e := slot.Front(); e != nil; {
+		next := e.Next()
+		t := slot.Remove(e).(*task)
+		tw.place(t)
+		e = next
+	}
+}
+
+// 处理一个tick, 返回到期的任务, 调用者持有mu
+func (tw *TimeWheel) advance() []*task {
+	index := tw.now & nearMask
+	if index == 0 {
+		// 第0层转完了一圈, 从上一层取下一格; 上一层也转完一圈时再往上
+		for i := 0; i < levelCount; i++ {
+			shift := uint(nearBits + i*levelBits)
+			levelIndex := (tw.now >> shift) & levelMask
+			tw.cascade(i, levelIndex)
+			if levelIndex != 0 {
+				break
+			}
+		}
+	}
+
+	var due []*task
+	slot := tw.near[index]
+	for e := slot.Front(); e != nil; {
+		next := e.Next()
+		t := slot.Remove(e).(*task)
+		if t.expire > tw.now {
+			// 超出范围的任务还没到时间, 重新放
+			tw.place(t)
+		} else {
+			delete(tw.tasks, t.key)
+			due = append(due, t)
+		}
+		e = next
+	}
+	tw.now++
+	return due
+}
+
+func (tw *TimeWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tw.onTicker()
+		case <-tw.stopChan:
+			return
+		}
+	}
+}
+
+// ticker可能会丢失(协程没有及时调度), 所以按实际经过的时间追上去
+func (tw *TimeWheel) onTicker() {
+	target := uint64(time.Since(tw.start) / tw.tick)
+	tw.mu.Lock()
+	var due []*task
+	for tw.now <= target {
+		due = append(due, tw.advance()...)
+	}
+	tw.mu.Unlock()
+
+	for _, t := range due {
+		go func(job func()) {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Warn(fmt.Sprintf("timewheel job panic: %v\n%s", err, string(debug.Stack())))
+				}
+			}()
+			job()
+		}(t.job)
+	}
+}
@@ -0,0 +1,145 @@
+package timewheel
+
+import (
+	"testing"
+	"time"
+)
+
+// 不启动时间轮, 手动推进ticks个tick, 返回每个任务执行时的tick
+func runTicks(tw *TimeWheel, ticks uint64, fired map[string]uint64) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for i := uint64(0); i < ticks; i++ {
+		now := tw.now
+		for _, t := range tw.advance() {
+			fired[t.key] = now
+		}
+	}
+}
+
+// 在第tick个tick到期
+func atTick(tw *TimeWheel, tick uint64, key string) {
+	tw.At(tw.start.Add(time.Duration(tick)*tw.tick), key, func() {})
+}
+
+func TestCascade(t *testing.T) {
+	tw := New(time.Millisecond)
+	expires := map[string]uint64{
+		"now":          0,
+		"near":         1,
+		"near-last":    nearSize - 1,
+		"level0-first": nearSize,
+		"level0":       nearSize + 1,
+		"level0-mid":   300,
+		"level0-last":  nearSize<<levelBits - 1,
+		"level1-first": nearSize << levelBits,
+		"level1":       nearSize<<levelBits + 5,
+		"level1-mid":   70000,
+		"level2":       nearSize<<(2*levelBits) + 3,
+	}
+	for key, expire := range expires {
+		atTick(tw, expire, key)
+	}
+	fired := make(map[string]uint64)
+	runTicks(tw, nearSize<<(2*levelBits)+10, fired)
+	for key, expire := range expires {
+		tick, ok := fired[key]
+		if !ok {
+			t.Errorf("%s (tick %d) didn't fire", key, expire)
+			continue
+		}
+		if tick != expire {
+			t.Errorf("%s: expected to fire at tick %d, got %d", key, expire, tick)
+		}
+	}
+	if len(tw.tasks) != 0 {
+		t.Errorf("expected no pending tasks, got %d", len(tw.tasks))
+	}
+}
+
+// 时间轮已经转了一段时间之后添加的任务, 各层的下标要从当前的tick算
+func TestAddAfterStart(t *testing.T) {
+	tw := New(time.Millisecond)
+	fired := make(map[string]uint64)
+	runTicks(tw, 1000, fired)
+	expires := map[string]uint64{
+		"past":   10,
+		"near":   1100,
+		"level0": 1000 + 20000,
+		"level1": 1000 + 300000,
+	}
+	for key, expire := range expires {
+		atTick(tw, expire, key)
+	}
+	runTicks(tw, 301010, fired)
+	if fired["past"] != 1000 {
+		t.Errorf("a task in the past should fire at the next tick 1000, got %d", fired["past"])
+	}
+	for _, key := range []string{"near", "level0", "level1"} {
+		if fired[key] != expires[key] {
+			t.Errorf("%s: expected to fire at tick %d, got %d", key, expires[key], fired[key])
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tw := New(time.Millisecond)
+	atTick(tw, 10, "near")
+	atTick(tw, 300, "cascaded")
+	atTick(tw, 500, "kept")
+	tw.Cancel("near")
+	// 转过256之后 cascaded 已经从第1层移到了第0层, 还要能删掉
+	fired := make(map[string]uint64)
+	runTicks(tw, 280, fired)
+	tw.Cancel("cascaded")
+	tw.Cancel("not-exist")
+	runTicks(tw, 300, fired)
+	if _, ok := fired["near"]; ok {
+		t.Error("near was cancelled but fired")
+	}
+	if _, ok := fired["cascaded"]; ok {
+		t.Error("cascaded was cancelled but fired")
+	}
+	if fired["kept"] != 500 {
+		t.Errorf("kept: expected to fire at tick 500, got %d", fired["kept"])
+	}
+	// 已经执行了的任务再删除什么也不做
+	tw.Cancel("kept")
+}
+
+func TestReplace(t *testing.T) {
+	tw := New(time.Millisecond)
+	atTick(tw, 100, "key")
+	atTick(tw, 5000, "key")
+	fired := make(map[string]uint64)
+	runTicks(tw, 6000, fired)
+	if fired["key"] != 5000 {
+		t.Errorf("expected the replaced task to fire at tick 5000, got %d", fired["key"])
+	}
+}
+
+func TestDelay(t *testing.T) {
+	tw := New(time.Millisecond)
+	tw.Start()
+	defer tw.Stop()
+
+	done := make(chan time.Time, 1)
+	start := time.Now()
+	tw.Delay(20*time.Millisecond, "delay", func() {
+		done <- time.Now()
+	})
+	tw.Delay(20*time.Millisecond, "cancelled", func() {
+		t.Error("cancelled task fired")
+	})
+	tw.Cancel("cancelled")
+	select {
+	case at := <-done:
+		if at.Sub(start) < 20*time.Millisecond {
+			t.Errorf("fired too early: %v", at.Sub(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("task didn't fire")
+	}
+	// 等一会, 确认被删除的任务没有执行
+	time.Sleep(30 * time.Millisecond)
+}
@@ -0,0 +1,88 @@
+package wildcard
+
+// 和redis的stringmatchlen一样的glob匹配, KEYS/SCAN的MATCH都用这个
+// *  任意个字符
+// ?  一个字符
+// [abc] [^abc] [a-z]  字符集合, ^ 表示取反
+// \x 转义
+
+func Match(pattern string, str string) bool {
+	p, s := 0, 0
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			// 连续的*和一个*是一样的
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := s; i <= len(str); i++ {
+				if Match(pattern[p+1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s >= len(str) {
+				return false
+			}
+			s++
+		case '[':
+			if s >= len(str) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			matched := false
+			for p < len(pattern) && pattern[p] != ']' {
+				c := pattern[p]
+				if c == '\\' && p+1 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						matched = true
+					}
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end := c, pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[s] >= start && str[s] <= end {
+						matched = true
+					}
+					p += 2
+				} else if c == str[s] {
+					matched = true
+				}
+				p++
+			}
+			if not {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			s++
+			// 这时p指向']', 没有']'时和redis一样当作到了结尾
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			if s >= len(str) || pattern[p] != str[s] {
+				return false
+			}
+			s++
+		default:
+			if s >= len(str) || pattern[p] != str[s] {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	return s == len(str)
+}
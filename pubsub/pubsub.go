@@ -26,7 +26,7 @@ func makeMsg(t string, channel string, code int64) []byte {
  * return: is new subscribed
  */
 func subscribe0(hub *Hub, channel string, client redis.Connection) bool {
-	client.SubChanel(channel)
+	client.SubsChannel(channel)
 
 	// add to Hub
 	raw, ok := hub.subs.Get(channel)
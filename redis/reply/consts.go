@@ -8,6 +8,14 @@ func (r *PongReply)ToBytes()[]byte {
     return PongBytes
 }
 
+type QueuedReply struct {}
+
+var queuedBytes = []byte("+QUEUED\r\n")
+
+func (r *QueuedReply)ToBytes()[]byte {
+    return queuedBytes
+}
+
 type OkReply struct {}
 
 var okBytes = []byte("+OK\r\n")
@@ -32,6 +40,15 @@ func (r *EmptyMultiBulkReply)ToBytes()[]byte {
     return emptyMultiBulkBytes
 }
 
+var nullMultiBulkBytes = []byte("*-1\r\n")
+
+// null array, 比如对不存在的key执行 LPOP key count
+type NullMultiBulkReply struct {}
+
+func (r *NullMultiBulkReply)ToBytes()[]byte {
+    return nullMultiBulkBytes
+}
+
 // reply nothing, for commands like subscribe
 type NoReply struct {}
 
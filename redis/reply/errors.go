@@ -29,14 +29,14 @@ func (r *ArgNumErrReply) Error()string {
 // SyntaxErr
 type SyntaxErrReply struct {}
 
-var syntaxErrBytes = []byte("-Err syntax error\r\n")
+var syntaxErrBytes = []byte("-ERR syntax error\r\n")
 
 func (r *SyntaxErrReply)ToBytes()[]byte {
     return syntaxErrBytes
 }
 
 func (r *SyntaxErrReply)Error()string {
-    return "Err syntax error"
+    return "ERR syntax error"
 }
 
 // WrongTypeErr
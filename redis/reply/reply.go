@@ -6,7 +6,7 @@ import (
 )
 
 var (
-    nullBulkReplyBytes = []byte("$-1")
+    nullBulkReplyBytes = []byte("$-1\r\n")
     CRLF               = "\r\n"
 )
 
@@ -23,7 +23,8 @@ func MakeBulkReply(arg []byte) *BulkReply {
 }
 
 func (r *BulkReply) ToBytes() []byte {
-    if len(r.Arg) == 0 {
+    // nil 是 null bulk, 空的[]byte是空字符串
+    if r.Arg == nil {
         return nullBulkReplyBytes
     }
     return []byte("$" + strconv.Itoa(len(r.Arg)) + CRLF + string(r.Arg) + CRLF)
@@ -54,6 +55,27 @@ func (r *MultiBulkReply) ToBytes() []byte {
     return []byte(res)
 }
 
+/* ---- Multi Raw Reply ---- */
+
+// 元素可以是任意reply的数组, 比如 LPOS COUNT 返回的整数数组
+type MultiRawReply struct {
+    Replies []redis.Reply
+}
+
+func MakeMultiRawReply(replies []redis.Reply) *MultiRawReply {
+    return &MultiRawReply{
+        Replies: replies,
+    }
+}
+
+func (r *MultiRawReply) ToBytes() []byte {
+    res := "*" + strconv.Itoa(len(r.Replies)) + CRLF
+    for _, rep := range r.Replies {
+        res += string(rep.ToBytes())
+    }
+    return []byte(res)
+}
+
 /* ---- Status Reply ---- */
 
 type StatusReply struct {
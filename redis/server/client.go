@@ -1,8 +1,10 @@
 package server
 
 import (
-	"github.com/HDT3213/godis/src/lib/sync/atomic"
-	"github.com/HDT3213/godis/src/lib/sync/wait"
+	"fmt"
+	"redis.simple/interface/redis"
+	"redis.simple/lib/sync/atomic"
+	"redis.simple/lib/sync/wait"
 	"net"
 	"sync"
 	"time"
@@ -40,8 +42,18 @@ type Client struct {
 	//那就把剩余的key里的这个client全部remove掉(这里就需要通过
 	//一个key-->找到client-->找到剩余的key)
 	blockKeys []string
+	// 阻塞期间不能执行下一条命令, 解除阻塞时close
+	unblocked chan struct{}
 	// 订阅信息
 	subs map[string]bool
+	// SELECT 选中的数据库, 只有处理这个连接的协程会读写
+	dbIndex int
+
+	// 事务状态, 和dbIndex一样只有处理这个连接的协程会读写
+	multiState bool
+	queue      [][][]byte
+	txErrors   []redis.Reply
+	watching   map[redis.WatchedKey]uint64
 }
 
 func MakeClient(conn net.Conn) *Client {
@@ -50,6 +62,11 @@ func MakeClient(conn net.Conn) *Client {
 	}
 }
 
+// 空闲超时任务在时间轮里的key
+func (c *Client)idleTask() string {
+	return fmt.Sprintf("idle:%p", c)
+}
+
 func (c *Client)Close() error {
 	// 数据发送时还用wait.Add(1) 发送完成后wait.Done()
 	// 所以最多再等10s，不主动退出就强制关闭
@@ -108,4 +125,79 @@ func (c *Client)GetChannels() []string {
 		i++
 	}
 	return channels
-}
\ No newline at end of file
+}
+
+// 阻塞命令挂起时设置等待的key, 被服务或者超时后设为nil
+func (c *Client)SetBlockKeys(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(keys) > 0 && len(c.blockKeys) == 0 {
+		c.unblocked = make(chan struct{})
+	}
+	if len(keys) == 0 && len(c.blockKeys) > 0 {
+		close(c.unblocked)
+	}
+	c.blockKeys = keys
+}
+
+func (c *Client)GetBlockKeys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blockKeys
+}
+
+// 等待阻塞命令结束, 保证回复的顺序和命令的顺序一致
+func (c *Client)waitUnblocked() {
+	c.mu.Lock()
+	ch := c.unblocked
+	blocked := len(c.blockKeys) > 0
+	c.mu.Unlock()
+	if blocked {
+		<-ch
+	}
+}
+
+func (c *Client)GetDBIndex() int {
+	return c.dbIndex
+}
+
+func (c *Client)SelectDB(dbIndex int) {
+	c.dbIndex = dbIndex
+}
+
+func (c *Client)InMultiState() bool {
+	return c.multiState
+}
+
+func (c *Client)SetMultiState(state bool) {
+	c.multiState = state
+}
+
+func (c *Client)GetQueuedCmdLine() [][][]byte {
+	return c.queue
+}
+
+func (c *Client)EnqueueCmd(cmdLine [][]byte) {
+	c.queue = append(c.queue, cmdLine)
+}
+
+func (c *Client)AddTxError(err redis.Reply) {
+	c.txErrors = append(c.txErrors, err)
+}
+
+func (c *Client)GetTxErrors() []redis.Reply {
+	return c.txErrors
+}
+
+func (c *Client)ClearQueuedCmds() {
+	c.queue = nil
+	c.txErrors = nil
+}
+
+func (c *Client)GetWatching() map[redis.WatchedKey]uint64 {
+	if c.watching == nil {
+		c.watching = make(map[redis.WatchedKey]uint64)
+	}
+	return c.watching
+}
@@ -3,17 +3,19 @@ package server
 import (
 	"bufio"
 	"context"
-	"github.com/HDT3213/godis/src/cluster"
-	"github.com/HDT3213/godis/src/config"
-	DBImpl "github.com/HDT3213/godis/src/db"
-	"github.com/HDT3213/godis/src/interface/db"
-	"github.com/HDT3213/godis/src/lib/logger"
-	"github.com/HDT3213/godis/src/lib/sync/atomic"
-	"github.com/HDT3213/godis/src/redis/reply"
+	"redis.simple/cluster"
+	"redis.simple/config"
+	DBImpl "redis.simple/db"
+	"redis.simple/interface/db"
+	"redis.simple/lib/logger"
+	"redis.simple/lib/sync/atomic"
+	"redis.simple/lib/timewheel"
+	"redis.simple/redis/reply"
 	"io"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 )
 
 var (
@@ -40,7 +42,7 @@ func MakeHandler() *Handler {
 		len(config.Properties.Peers) > 0 {
 		db = cluster.MakeCluster()
 	} else {
-		db = DBImpl.MakeDB()
+		db = DBImpl.MakeMultiDB()
 	}
 	return &Handler{
 		db: db,
@@ -49,6 +51,7 @@ func MakeHandler() *Handler {
 
 
 func (h *Handler) closeClient(client *Client) {
+	timewheel.Cancel(client.idleTask())
 	_ = client.Close()
 	h.db.AfterClientClose(client)
 	h.activeConn.Delete(client)
@@ -64,6 +67,7 @@ func (h *Handler)Handle(ctx context.Context, conn net.Conn) {
 	}
 	// 将client存储到sync.Map中去
 	h.activeConn.Store(client, 1)
+	h.resetIdleTimeout(client)
 
 	reader := bufio.NewReader(conn)
 	var fixedLen int64 = 0 // 将读取的长度
@@ -101,8 +105,8 @@ func (h *Handler)Handle(ctx context.Context, conn net.Conn) {
 				其他的都应该是正常的 因为即使的错误的语法也遵守RESP规范的，所以EOF错误
 				就可以判断是连接出了问题
 			*/
-			_ = client.Close()
-			h.activeConn.Delete(client)
+			// 还要清理订阅和阻塞的信息
+			h.closeClient(client)
 			return
 		}
 
@@ -157,17 +161,22 @@ func (h *Handler)Handle(ctx context.Context, conn net.Conn) {
 				client.isRecving.Set(false)
 
 
+				// 上一条是阻塞命令(BLPOP等)的话要等它结束
+				client.waitUnblocked()
+
 				// 中间还要执行命令(还可以开一个协程)
+				// 阻塞命令的结果会由别的协程写回, 所以也要通过client.Write加锁写
 				result := h.db.Exec(client, client.args)
 				if result != nil {
-					_, _ = conn.Write(result.ToBytes())
+					_ = client.Write(result.ToBytes())
 				} else {
-					_, _ = conn.Write(UnknownErrReplyByte)
+					_ = client.Write(UnknownErrReplyBytes)
 				}
 				// Exec之前还不能Done以及将args变为空
 
 
 				client.WaitingReply.Done()
+				h.resetIdleTimeout(client)
 
 				client.expectedArgsCount = 0
 				client.recivedCount = 0
@@ -177,6 +186,23 @@ func (h *Handler)Handle(ctx context.Context, conn net.Conn) {
 	}
 }
 
+// 每执行完一条命令重新计时, 超时之后关闭连接, 读取出错后由Handle清理
+// 和redis一样, 阻塞中或者订阅了频道的client不算空闲
+func (h *Handler) resetIdleTimeout(client *Client) {
+	if config.Properties.Timeout <= 0 {
+		return
+	}
+	timeout := time.Duration(config.Properties.Timeout) * time.Second
+	timewheel.Delay(timeout, client.idleTask(), func() {
+		if len(client.GetBlockKeys()) > 0 || client.SubsCount() > 0 {
+			h.resetIdleTimeout(client)
+			return
+		}
+		logger.Info("closing idle client " + client.conn.RemoteAddr().String())
+		_ = client.conn.Close()
+	})
+}
+
 func (h *Handler)Close() error {
 	logger.Info("handler shuting down...")
 	// listener出错后能够判断是要关闭了,